@@ -1,24 +1,42 @@
 package zdap
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math/rand/v2"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/modfin/zdap/internal/utils"
 )
 
 type Client struct {
-	cli    *http.Client
-	user   string
-	server string
+	cli     *http.Client
+	user    string
+	server  string
+	baseURL string
+	headers http.Header
+
+	timeout    time.Duration
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	negotiation *negotiation
+}
+
+// negotiation holds the server version once known, it is shared by the copies of a client
+type negotiation struct {
+	mu      sync.Mutex
+	version *ServerVersion
 }
 
 type ClaimArgs struct {
@@ -26,79 +44,285 @@ type ClaimArgs struct {
 	TtlSeconds  int64
 }
 
+// Option configures a Client created by New
+type Option func(c *Client)
+
+// WithHTTPClient sets the http client used for requests, http.DefaultClient is used by default
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.cli = client
+	}
+}
+
+// WithHTTPS makes the client talk https to servers given without a scheme
+func WithHTTPS() Option {
+	return func(c *Client) {
+		if !strings.Contains(c.server, "://") {
+			c.baseURL = "https://" + c.server
+		}
+	}
+}
+
+// WithHeader adds a header to every request
+func WithHeader(key, value string) Option {
+	return func(c *Client) {
+		c.headers.Add(key, value)
+	}
+}
+
+// AdminTokenHeader is the header carrying the admin token of zdapd, required by the admin requests
+const AdminTokenHeader = "admin-token"
+
+// WithAdminToken authenticates the requests of the client as admin requests
+func WithAdminToken(token string) Option {
+	return WithHeader(AdminTokenHeader, token)
+}
+
+// WithTimeout limits the time of each request attempt, 0 means no limit other than the context of the call
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithRetries sets how many times idempotent calls are retried on network errors and temporarily unavailable
+// servers. The backoff doubles for every attempt, starting at backoff and capped at maxBackoff.
+func WithRetries(retries int, backoff, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+const (
+	defaultRetries    = 2
+	defaultBackoff    = 200 * time.Millisecond
+	defaultMaxBackoff = 5 * time.Second
+)
+
+// New creates a client for server, which is either <host>:<port> or a http(s) url, acting as user
+func New(server, user string, opts ...Option) *Client {
+	c := &Client{
+		cli:        http.DefaultClient,
+		user:       user,
+		server:     server,
+		baseURL:    "http://" + server,
+		headers:    http.Header{},
+		retries:    defaultRetries,
+		backoff:    defaultBackoff,
+		maxBackoff: defaultMaxBackoff,
+
+		negotiation: &negotiation{},
+	}
+	if strings.HasPrefix(server, "http://") || strings.HasPrefix(server, "https://") {
+		c.baseURL = strings.TrimRight(server, "/")
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.cli == nil {
+		c.cli = http.DefaultClient
+	}
+	return c
+}
+
+// NewClient creates a client using the http client, see New for more options
 func NewClient(client *http.Client, user, server string) *Client {
-	return &Client{cli: client, server: server, user: user}
+	return New(server, user, WithHTTPClient(client))
 }
+
 func (c Client) Server() string {
 	return c.server
 }
 
+func (c Client) Version() (*ServerVersion, error) {
+	return c.VersionContext(context.Background())
+}
+
+// VersionContext returns the version of the server, servers that predate versioning are reported with an empty
+// ServerVersion. Once the version is known the client uses the versioned routes if the server supports them.
+func (c Client) VersionContext(ctx context.Context) (*ServerVersion, error) {
+	if v := c.negotiated(); v != nil {
+		return v, nil
+	}
+	v, err := fetch[*ServerVersion](ctx, c, "GET", "version", nil)
+	if errors.Is(err, ErrNotFound) {
+		v, err = &ServerVersion{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.negotiation.mu.Lock()
+	c.negotiation.version = v
+	c.negotiation.mu.Unlock()
+	return v, nil
+}
+
+func (c Client) negotiated() *ServerVersion {
+	if c.negotiation == nil {
+		return nil
+	}
+	c.negotiation.mu.Lock()
+	defer c.negotiation.mu.Unlock()
+	return c.negotiation.version
+}
+
 func (c Client) Status() (*ServerStatus, error) {
-	return fetch[*ServerStatus](c, "GET", "status", nil)
+	return c.StatusContext(context.Background())
+}
+
+func (c Client) StatusContext(ctx context.Context) (*ServerStatus, error) {
+	return fetch[*ServerStatus](ctx, c, "GET", "status", nil)
+}
+
+func (c Client) GetBuilds() (*BuildQueue, error) {
+	return c.GetBuildsContext(context.Background())
+}
+
+func (c Client) GetBuildsContext(ctx context.Context) (*BuildQueue, error) {
+	return fetch[*BuildQueue](ctx, c, "GET", "builds", nil)
 }
 
 func (c Client) GetResources() ([]PublicResource, error) {
-	return fetch[[]PublicResource](c, "GET", "resources", nil)
+	return c.GetResourcesContext(context.Background())
+}
+
+func (c Client) GetResourcesContext(ctx context.Context) ([]PublicResource, error) {
+	return fetch[[]PublicResource](ctx, c, "GET", "resources", nil)
 }
 
 func (c Client) GetResourceSnaps(resource string) (PublicResource, error) {
-	return fetch[PublicResource](c, "GET", "resources/:resource", nil, resource)
+	return c.GetResourceSnapsContext(context.Background(), resource)
+}
+
+func (c Client) GetResourceSnapsContext(ctx context.Context, resource string) (PublicResource, error) {
+	return fetch[PublicResource](ctx, c, "GET", "resources/:resource", nil, resource)
 }
 
 func (c Client) CloneSnap(resource string, snap time.Time, claimArgs ClaimArgs) (*PublicClone, error) {
+	return c.CloneSnapContext(context.Background(), resource, snap, claimArgs)
+}
+
+func (c Client) CloneSnapContext(ctx context.Context, resource string, snap time.Time, claimArgs ClaimArgs) (*PublicClone, error) {
 	if !claimArgs.ClaimPooled {
-		return fetch[*PublicClone](c, "POST", "resources/:resource/snaps/:createdAt", nil, resource, snap)
+		return fetch[*PublicClone](ctx, c, "POST", "resources/:resource/snaps/:createdAt", nil, resource, snap)
 	}
 
 	var qp url.Values
 	if claimArgs.TtlSeconds != 0 {
 		qp = url.Values{"ttl": []string{strconv.FormatInt(claimArgs.TtlSeconds, 10)}}
 	}
-	return fetch[*PublicClone](c, "POST", "resources/:resource/claim", qp, resource)
+	return fetch[*PublicClone](ctx, c, "POST", "resources/:resource/claim", qp, resource)
 }
 
 func (c Client) GetClones(resource string) ([]PublicClone, error) {
-	return fetch[[]PublicClone](c, "GET", "resources/:resource/clones", nil, resource)
+	return c.GetClonesContext(context.Background(), resource)
+}
+
+func (c Client) GetClonesContext(ctx context.Context, resource string) ([]PublicClone, error) {
+	return fetch[[]PublicClone](ctx, c, "GET", "resources/:resource/clones", nil, resource)
 }
 
 func (c Client) ExpireClaim(resource string, claimId string) error {
-	return call(c, "DELETE", "resources/:resource/claims/:claimId", nil, resource, claimId)
+	return c.ExpireClaimContext(context.Background(), resource, claimId)
+}
+
+func (c Client) ExpireClaimContext(ctx context.Context, resource string, claimId string) error {
+	return call(ctx, c, "DELETE", "resources/:resource/claims/:claimId", nil, resource, claimId)
 }
 
 func (c Client) DestroyClone(resource string, clone time.Time) error {
-	return call(c, "DELETE", "resources/:resource/clones/:time", nil, resource, clone)
+	return c.DestroyCloneContext(context.Background(), resource, clone)
 }
 
-func getResource(resource string, resourcePlaceholders []any) string {
+func (c Client) DestroyCloneContext(ctx context.Context, resource string, clone time.Time) error {
+	return call(ctx, c, "DELETE", "resources/:resource/clones/:time", nil, resource, clone)
+}
+
+func (c Client) GetCloneHealth(resource string, clone time.Time) (*CloneHealth, error) {
+	return c.GetCloneHealthContext(context.Background(), resource, clone)
+}
+
+func (c Client) GetCloneHealthContext(ctx context.Context, resource string, clone time.Time) (*CloneHealth, error) {
+	return fetch[*CloneHealth](ctx, c, "GET", "resources/:resource/clones/:time/health", nil, resource, clone)
+}
+
+func (c Client) PinSnap(resource string, snap time.Time) (*PublicSnap, error) {
+	return c.PinSnapContext(context.Background(), resource, snap)
+}
+
+func (c Client) PinSnapContext(ctx context.Context, resource string, snap time.Time) (*PublicSnap, error) {
+	return fetch[*PublicSnap](ctx, c, "POST", "resources/:resource/snaps/:createdAt/pin", nil, resource, snap)
+}
+
+func (c Client) UnpinSnap(resource string, snap time.Time) (*PublicSnap, error) {
+	return c.UnpinSnapContext(context.Background(), resource, snap)
+}
+
+func (c Client) UnpinSnapContext(ctx context.Context, resource string, snap time.Time) (*PublicSnap, error) {
+	return fetch[*PublicSnap](ctx, c, "DELETE", "resources/:resource/snaps/:createdAt/pin", nil, resource, snap)
+}
+
+func (c Client) DeprecateSnap(resource string, snap time.Time, reason string) (*PublicSnap, error) {
+	return c.DeprecateSnapContext(context.Background(), resource, snap, reason)
+}
+
+func (c Client) DeprecateSnapContext(ctx context.Context, resource string, snap time.Time, reason string) (*PublicSnap, error) {
+	var qp url.Values
+	if reason != "" {
+		qp = url.Values{"reason": []string{reason}}
+	}
+	return fetch[*PublicSnap](ctx, c, "POST", "resources/:resource/snaps/:createdAt/deprecation", qp, resource, snap)
+}
+
+func (c Client) UndeprecateSnap(resource string, snap time.Time) (*PublicSnap, error) {
+	return c.UndeprecateSnapContext(context.Background(), resource, snap)
+}
+
+func (c Client) UndeprecateSnapContext(ctx context.Context, resource string, snap time.Time) (*PublicSnap, error) {
+	return fetch[*PublicSnap](ctx, c, "DELETE", "resources/:resource/snaps/:createdAt/deprecation", nil, resource, snap)
+}
+
+func (c Client) IssueCertificate() (*PublicCertificate, error) {
+	return c.IssueCertificateContext(context.Background())
+}
+
+func (c Client) IssueCertificateContext(ctx context.Context) (*PublicCertificate, error) {
+	return fetch[*PublicCertificate](ctx, c, "POST", "certificates", nil)
+}
+
+var placeholderReg = regexp.MustCompile("(:\\w*)")
+
+func getResource(resource string, resourcePlaceholders []any) (string, error) {
 	if len(resourcePlaceholders) == 0 {
-		return resource
+		return resource, nil
 	}
-	placeholder := regexp.MustCompile("(:\\w*)")
 	for i, s := range resourcePlaceholders {
 		var phVal string
 		switch val := s.(type) {
 		case string:
-			phVal = val
+			phVal = url.PathEscape(val)
 		case time.Time:
 			if !val.IsZero() {
 				phVal = val.Format(utils.TimestampFormat)
 			}
 		default:
-			log.Fatalf("getResource: unknown placeholder type: %T for placeholder: %d, resource: %s", val, i, resource)
+			return "", fmt.Errorf("unknown placeholder type %T for placeholder %d of %s", val, i, resource)
 		}
-		ph := placeholder.FindString(resource)
+		ph := placeholderReg.FindString(resource)
 		resource = strings.Replace(resource, ph, phVal, 1)
 	}
-	return strings.TrimRight(resource, "/")
+	return strings.TrimRight(resource, "/"), nil
 }
 
-func call(c Client, method, resource string, queryParams url.Values, resourcePlaceholders ...any) error {
-	_, err := do(c, method, resource, queryParams, resourcePlaceholders...)
+func call(ctx context.Context, c Client, method, resource string, queryParams url.Values, resourcePlaceholders ...any) error {
+	_, err := do(ctx, c, method, resource, queryParams, resourcePlaceholders...)
 	return err
 }
 
-func fetch[Response any](c Client, method, resource string, queryParams url.Values, resourcePlaceholders ...any) (response Response, err error) {
-	data, err := do(c, method, resource, queryParams, resourcePlaceholders...)
+func fetch[Response any](ctx context.Context, c Client, method, resource string, queryParams url.Values, resourcePlaceholders ...any) (response Response, err error) {
+	data, err := do(ctx, c, method, resource, queryParams, resourcePlaceholders...)
 	if err != nil {
 		return
 	}
@@ -107,25 +331,116 @@ func fetch[Response any](c Client, method, resource string, queryParams url.Valu
 
 }
 
-func do(c Client, method, resource string, queryParams url.Values, resourcePlaceholders ...any) ([]byte, error) {
-	req, err := http.NewRequest(method, fmt.Sprintf("http://%s/%s", c.server, getResource(resource, resourcePlaceholders)), nil)
+// do sends the request, idempotent requests are retried on network errors and temporarily unavailable servers
+func do(ctx context.Context, c Client, method, resource string, queryParams url.Values, resourcePlaceholders ...any) ([]byte, error) {
+	path, err := getResource(resource, resourcePlaceholders)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("auth", c.user)
+	if v := c.negotiated(); v != nil && v.SupportsAPI(APIVersion) {
+		path = APIVersion + "/" + path
+	}
+	u := fmt.Sprintf("%s/%s", c.baseURL, path)
 	if queryParams != nil {
-		req.URL.RawQuery = queryParams.Encode()
+		u += "?" + queryParams.Encode()
+	}
+
+	retries := 0
+	if method == http.MethodGet || method == http.MethodDelete || method == http.MethodHead {
+		retries = c.retries
+	}
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := attemptDo(ctx, c, method, u)
+		if err == nil || attempt >= retries || !retryable(ctx, err) {
+			return data, err
+		}
+
+		wait := c.backoff << attempt
+		if wait > c.maxBackoff || wait <= 0 {
+			wait = c.maxBackoff
+		}
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfterSeconds > 0 {
+			wait = time.Duration(apiErr.RetryAfterSeconds) * time.Second
+			if wait > c.maxBackoff {
+				// leave waiting that long to the caller
+				return nil, err
+			}
+		}
+		wait = wait/2 + time.Duration(rand.Int64N(int64(wait/2)+1))
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w, last error: %w", ctx.Err(), err)
+		case <-time.After(wait):
+		}
 	}
+}
+
+func attemptDo(ctx context.Context, c Client, method, u string) ([]byte, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("auth", c.user)
 
 	res, err := c.cli.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	if res.StatusCode != 200 {
-		err = fmt.Errorf("did not get status code 200, got %d", res.StatusCode)
-		return nil, err
+		return nil, responseError(res)
 	}
 
 	defer res.Body.Close()
 	return io.ReadAll(res.Body)
 }
+
+// retryable reports if a failed request should be retried, the caller context being done is never retried
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable() || apiErr.Status == http.StatusBadGateway || apiErr.Status == http.StatusGatewayTimeout
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// responseError turns a failed response into an *APIError, falling back on the status code for servers that do not
+// return structured errors
+func responseError(res *http.Response) error {
+	var body []byte
+	if res.Body != nil {
+		defer res.Body.Close()
+		body, _ = io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	}
+
+	apiErr := &APIError{}
+	if json.Unmarshal(body, apiErr) != nil || apiErr.Code == "" {
+		apiErr = &APIError{Code: CodeOf(res.StatusCode), Message: strings.TrimSpace(string(body))}
+		if apiErr.Message == "" {
+			apiErr.Message = http.StatusText(res.StatusCode)
+		}
+	}
+	apiErr.Status = res.StatusCode
+	if apiErr.RetryAfterSeconds == 0 {
+		if s, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+			apiErr.RetryAfterSeconds = s
+		}
+	}
+	return apiErr
+}
@@ -2,7 +2,9 @@ package zdap
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/modfin/zdap/internal"
 	"github.com/modfin/zdap/internal/utils"
@@ -498,3 +500,169 @@ func TestClient_DestroyClone(t *testing.T) {
 		})
 	}
 }
+
+func TestClient_APIError(t *testing.T) {
+	tests := []struct {
+		status    int
+		header    http.Header
+		body      string
+		wantIs    error
+		wantCode  ErrorCode
+		wantRetry int
+	}{
+		{
+			status:   http.StatusNotFound,
+			body:     `{"status":404,"code":"not_found","message":"could not find resource postgres-1","resource":"postgres-1"}`,
+			wantIs:   ErrNotFound,
+			wantCode: CodeNotFound,
+		},
+		{
+			status:    http.StatusServiceUnavailable,
+			body:      `{"status":503,"code":"unavailable","message":"could not find available clone","retry_after_seconds":30}`,
+			wantIs:    ErrUnavailable,
+			wantCode:  CodeUnavailable,
+			wantRetry: 30,
+		},
+		{
+			status:    http.StatusServiceUnavailable,
+			header:    http.Header{"Retry-After": []string{"5"}},
+			body:      "Service Unavailable",
+			wantIs:    ErrUnavailable,
+			wantCode:  CodeUnavailable,
+			wantRetry: 5,
+		},
+		{
+			status:   http.StatusInternalServerError,
+			body:     `{"message":"Internal Server Error"}`,
+			wantIs:   ErrInternal,
+			wantCode: CodeInternal,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			tc := newTestClient(func(req *http.Request) *http.Response {
+				header := tt.header
+				if header == nil {
+					header = make(http.Header)
+				}
+				return &http.Response{
+					StatusCode: tt.status,
+					Body:       io.NopCloser(bytes.NewReader([]byte(tt.body))),
+					Header:     header,
+				}
+			})
+			_, err := New(testSever, t.Name(), WithHTTPClient(tc), WithRetries(0, 0, 0)).GetResourceSnaps("postgres-1")
+			if !errors.Is(err, tt.wantIs) {
+				t.Fatalf("GetResourceSnaps() error = %v, want %v", err, tt.wantIs)
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("GetResourceSnaps() error = %T, want *APIError", err)
+			}
+			if apiErr.Status != tt.status || apiErr.Code != tt.wantCode || apiErr.RetryAfterSeconds != tt.wantRetry {
+				t.Errorf("GetResourceSnaps() error = %+v", apiErr)
+			}
+		})
+	}
+}
+
+func TestClient_Retry(t *testing.T) {
+	var attempts int
+	tc := newTestClient(func(req *http.Request) *http.Response {
+		attempts++
+		if req.Header.Get("X-Test") != "yes" {
+			t.Errorf("got X-Test header: '%s', want 'yes'", req.Header.Get("X-Test"))
+		}
+		if attempts < 3 {
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: make(http.Header)}
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader([]byte(`{"address":"127.0.0.1"}`))),
+			Header:     make(http.Header),
+		}
+	})
+	cli := New(testSever, t.Name(), WithHTTPClient(tc), WithHeader("X-Test", "yes"), WithRetries(2, time.Millisecond, 10*time.Millisecond))
+
+	status, err := cli.StatusContext(context.Background())
+	if err != nil {
+		t.Fatalf("StatusContext() error = %v", err)
+	}
+	if attempts != 3 || status.Address != "127.0.0.1" {
+		t.Errorf("StatusContext() attempts = %d, status = %+v", attempts, status)
+	}
+
+	attempts = 0
+	_, err = cli.CloneSnapContext(context.Background(), "postgres-1", time.Now(), ClaimArgs{})
+	if !errors.Is(err, ErrUnavailable) || attempts != 1 {
+		t.Errorf("CloneSnapContext() should not be retried, attempts = %d, error = %v", attempts, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cli.StatusContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("StatusContext() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestClient_HTTPS(t *testing.T) {
+	tc := newTestClient(func(req *http.Request) *http.Response {
+		if req.URL.String() != "https://"+testSever+"/resources/a%2Fb" {
+			t.Errorf("got URL: '%s'", req.URL.String())
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader([]byte(`{}`))), Header: make(http.Header)}
+	})
+	_, err := New(testSever, t.Name(), WithHTTPClient(tc), WithHTTPS()).GetResourceSnaps("a/b")
+	if err != nil {
+		t.Errorf("GetResourceSnaps() error = %v", err)
+	}
+}
+
+func TestClient_Version(t *testing.T) {
+	tests := []struct {
+		version   string
+		wantPaths []string
+	}{
+		{
+			version:   `{"version":"v1.2.3","api_versions":["v1"],"features":["pooling"]}`,
+			wantPaths: []string{"/version", "/v1/status"},
+		},
+		{
+			wantPaths: []string{"/version", "/status"},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			var paths []string
+			tc := newTestClient(func(req *http.Request) *http.Response {
+				paths = append(paths, req.URL.Path)
+				body := `{}`
+				if req.URL.Path == "/version" {
+					if tt.version == "" {
+						return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(bytes.NewReader([]byte(`{"message":"Not Found"}`))), Header: make(http.Header)}
+					}
+					body = tt.version
+				}
+				return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader([]byte(body))), Header: make(http.Header)}
+			})
+			cli := NewClient(tc, t.Name(), testSever)
+			v, err := cli.Version()
+			if err != nil {
+				t.Fatalf("Version() error = %v", err)
+			}
+			if _, err = cli.Version(); err != nil {
+				t.Fatalf("Version() error = %v", err)
+			}
+			if _, err = cli.Status(); err != nil {
+				t.Fatalf("Status() error = %v", err)
+			}
+			if !reflect.DeepEqual(paths, tt.wantPaths) {
+				t.Errorf("got paths %v, want %v", paths, tt.wantPaths)
+			}
+			if v.Supports(FeaturePooling) != (tt.version != "") {
+				t.Errorf("Version() = %+v", v)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package zdap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/modfin/henry/slicez"
+	"github.com/modfin/zdap/internal/utils"
+)
+
+// Candidate is a snap of a resource on one of the servers of a cluster
+type Candidate struct {
+	Client   *Client
+	Status   *ServerStatus
+	Resource PublicResource
+	Snap     PublicSnap
+	Score    float64
+}
+
+// Strategy scores a candidate, the candidate with the highest score is chosen
+type Strategy func(c Candidate) float64
+
+// Heuristic favours servers with free disk and memory, few clones and low load, and recent snaps
+func Heuristic(c Candidate) float64 {
+	stat := c.Status
+	sum := math.Log2(float64(stat.FreeDisk) / float64(datasize.GB) / 100.0) // more disk is good
+	sum += math.Log2(float64(stat.FreeMem) / float64(datasize.GB))          // more ram is good
+	if stat.Clones > 0 {
+		sum -= math.Log2(float64(stat.Clones)) // fewer clones is good
+	}
+	if stat.Load15 > 0 {
+		sum -= math.Log2(stat.Load15) // load less than 1 is good
+	}
+	return sum - math.Log2(time.Since(c.Snap.CreatedAt).Hours()/24) // Higher score for recent snapshots
+}
+
+// PoolAvailability favours servers with pooled clones available for the resource, ties are broken by next
+func PoolAvailability(next Strategy) Strategy {
+	return func(c Candidate) float64 {
+		available := c.Status.ResourceDetails[c.Resource.Name].PooledClonesAvailable
+		return float64(available)*1000 + next(c)
+	}
+}
+
+// OwnerAffinity favours servers where the owner of the client already has clones of the resource, ties are broken
+// by next
+func OwnerAffinity(next Strategy) Strategy {
+	return func(c Candidate) float64 {
+		for _, s := range c.Resource.Snaps {
+			if len(s.Clones) > 0 {
+				return 1000 + next(c)
+			}
+		}
+		return next(c)
+	}
+}
+
+// Cluster fans out requests to several zdapd servers and chooses a server for new clones
+type Cluster struct {
+	clients  []*Client
+	strategy Strategy
+	logf     func(format string, args ...any)
+}
+
+type ClusterOption func(c *Cluster)
+
+// WithStrategy sets how servers are chosen, Heuristic is used by default
+func WithStrategy(strategy Strategy) ClusterOption {
+	return func(c *Cluster) {
+		c.strategy = strategy
+	}
+}
+
+// WithLogger logs why servers are skipped and how they are scored
+func WithLogger(logf func(format string, args ...any)) ClusterOption {
+	return func(c *Cluster) {
+		c.logf = logf
+	}
+}
+
+func NewCluster(clients []*Client, opts ...ClusterOption) *Cluster {
+	c := &Cluster{
+		clients:  clients,
+		strategy: Heuristic,
+		logf:     func(string, ...any) {},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *Cluster) Clients() []*Client {
+	return c.clients
+}
+
+// each calls fn concurrently for every client, the errors are joined and prefixed with the server
+func (c *Cluster) each(fn func(cli *Client) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(c.clients))
+	for i, cli := range c.clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := fn(cli)
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %w", cli.Server(), err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Status returns the status of every reachable server keyed by server, servers that could not be reached are
+// reported in the error
+func (c *Cluster) Status(ctx context.Context) (map[string]*ServerStatus, error) {
+	var mu sync.Mutex
+	statuses := map[string]*ServerStatus{}
+	err := c.each(func(cli *Client) error {
+		stat, err := cli.StatusContext(ctx)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		statuses[cli.Server()] = stat
+		mu.Unlock()
+		return nil
+	})
+	return statuses, err
+}
+
+// Resources returns the resources of all reachable servers, the snaps of a resource found on several servers are
+// merged and sorted by creation time
+func (c *Cluster) Resources(ctx context.Context) ([]PublicResource, error) {
+	var mu sync.Mutex
+	merged := map[string]*PublicResource{}
+	err := c.each(func(cli *Client) error {
+		resources, err := cli.GetResourcesContext(ctx)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, r := range resources {
+			m, ok := merged[r.Name]
+			if !ok {
+				r := r
+				merged[r.Name] = &r
+				continue
+			}
+			m.Snaps = append(m.Snaps, r.Snaps...)
+		}
+		return nil
+	})
+
+	var resources []PublicResource
+	for _, r := range merged {
+		sort.Slice(r.Snaps, func(i, j int) bool {
+			return r.Snaps[i].CreatedAt.Before(r.Snaps[j].CreatedAt)
+		})
+		resources = append(resources, *r)
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].Name < resources[j].Name
+	})
+	return resources, err
+}
+
+// Clones returns the clones of resource on all reachable servers, newest first
+func (c *Cluster) Clones(ctx context.Context, resource string) ([]PublicClone, error) {
+	var mu sync.Mutex
+	var clones []PublicClone
+	err := c.each(func(cli *Client) error {
+		cc, err := cli.GetClonesContext(ctx, resource)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		clones = append(clones, cc...)
+		mu.Unlock()
+		return nil
+	})
+	sort.Slice(clones, func(i, j int) bool {
+		return clones[i].SnappedAt.After(clones[j].SnappedAt)
+	})
+	return clones, err
+}
+
+// Candidates returns every snap of resource on the reachable servers scored by the strategy, best first. filter,
+// if not nil, limits the snaps considered.
+func (c *Cluster) Candidates(ctx context.Context, resource string, filter func(PublicSnap) bool) ([]Candidate, error) {
+	var mu sync.Mutex
+	var candidates []Candidate
+	err := c.each(func(cli *Client) error {
+		stat, err := cli.StatusContext(ctx)
+		if err != nil {
+			c.logf("%s - connect error: %v\n", cli.Server(), err)
+			return err
+		}
+		if !utils.StringSliceContains(stat.Resources, resource) {
+			c.logf("%s - '%s' not found\n", cli.Server(), resource)
+			return nil
+		}
+		res, err := cli.GetResourceSnapsContext(ctx, resource)
+		if err != nil {
+			c.logf("%s - error getting snaps, error: %v\n", cli.Server(), err)
+			return err
+		}
+		// deprecated snaps are never cloned, and a pinned snap is the only candidate of its server
+		snaps := slicez.Filter(res.Snaps, func(snap PublicSnap) bool {
+			return !snap.Deprecated && (filter == nil || filter(snap))
+		})
+		if pinned := slicez.Filter(snaps, func(snap PublicSnap) bool { return snap.Pinned }); len(pinned) > 0 {
+			snaps = pinned
+		}
+		var found []Candidate
+		for _, snap := range snaps {
+			cand := Candidate{Client: cli, Status: stat, Resource: res, Snap: snap}
+			cand.Score = c.strategy(cand)
+			found = append(found, cand)
+		}
+		if len(found) == 0 {
+			c.logf("%s - '%s' snapshot not found\n", cli.Server(), resource)
+			return nil
+		}
+		c.logf("%s - '%s' found (RAM: %d, Disk: %d, clones: %d, load: %f/%f/%f)\n", cli.Server(), resource, stat.FreeMem, stat.FreeDisk, stat.Clones, stat.Load1, stat.Load5, stat.Load15)
+		mu.Lock()
+		candidates = append(candidates, found...)
+		mu.Unlock()
+		return nil
+	})
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score // Highest score first
+	})
+	return candidates, err
+}
+
+// Choose returns the best candidate for a new clone of resource
+func (c *Cluster) Choose(ctx context.Context, resource string, filter func(PublicSnap) bool) (*Candidate, error) {
+	candidates, err := c.Candidates(ctx, resource, filter)
+	if len(candidates) == 0 {
+		if err != nil {
+			return nil, fmt.Errorf("no zdap server with '%s' resource could be found, %w", resource, err)
+		}
+		return nil, fmt.Errorf("no zdap server with '%s' resource could be found, %w", resource, ErrNotFound)
+	}
+	for _, cand := range candidates {
+		c.logf("%s - %s = %f\n", cand.Client.Server(), cand.Snap.Name, cand.Score)
+	}
+	return &candidates[0], nil
+}
+
+// Clone creates a clone of the best candidate of resource
+func (c *Cluster) Clone(ctx context.Context, resource string, filter func(PublicSnap) bool, claimArgs ClaimArgs) (*PublicClone, error) {
+	cand, err := c.Choose(ctx, resource, filter)
+	if err != nil {
+		return nil, err
+	}
+	c.logf("Creating a new clone on %s from %s\n", cand.Client.Server(), cand.Snap.Name)
+	clone, err := cand.Client.CloneSnapContext(ctx, resource, cand.Snap.CreatedAt, claimArgs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone '%s' resource on %s, %w", resource, cand.Client.Server(), err)
+	}
+	return clone, nil
+}
+
+// ServerAddress appends port to server if it has none
+func ServerAddress(server string, port int) string {
+	if strings.Contains(server, ":") {
+		return server
+	}
+	return fmt.Sprintf("%s:%d", server, port)
+}
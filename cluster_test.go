@@ -0,0 +1,159 @@
+package zdap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+)
+
+type fakeServer struct {
+	status   ServerStatus
+	resource PublicResource
+}
+
+func newTestCluster(t *testing.T, servers map[string]fakeServer, opts ...ClusterOption) *Cluster {
+	tc := newTestClient(func(req *http.Request) *http.Response {
+		s, ok := servers[req.URL.Host]
+		if !ok {
+			return &http.Response{StatusCode: http.StatusBadGateway, Header: make(http.Header)}
+		}
+		var body any
+		switch req.URL.Path {
+		case "/status":
+			body = s.status
+		case "/resources/" + s.resource.Name:
+			body = s.resource
+		default:
+			return &http.Response{StatusCode: http.StatusNotFound, Header: make(http.Header)}
+		}
+		b, _ := json.Marshal(body)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(b)), Header: make(http.Header)}
+	})
+	var clients []*Client
+	for server := range servers {
+		clients = append(clients, New(server, t.Name(), WithHTTPClient(tc), WithRetries(0, 0, 0)))
+	}
+	clients = append(clients, New("127.0.0.1:1", t.Name(), WithHTTPClient(tc), WithRetries(0, 0, 0)))
+	return NewCluster(clients, opts...)
+}
+
+func TestCluster_Choose(t *testing.T) {
+	snappedAt := time.Now().Add(-48 * time.Hour)
+	status := func(freeDisk datasize.ByteSize, pooled int) ServerStatus {
+		return ServerStatus{
+			Resources:       []string{"postgres-1"},
+			ResourceDetails: map[string]ServerResourceDetails{"postgres-1": {Name: "postgres-1", PooledClonesAvailable: pooled}},
+			FreeDisk:        uint64(freeDisk),
+			FreeMem:         uint64(8 * datasize.GB),
+			Clones:          4,
+			Load15:          1,
+		}
+	}
+	servers := map[string]fakeServer{
+		"10.0.0.1:43210": {
+			status:   status(500*datasize.GB, 0),
+			resource: PublicResource{Name: "postgres-1", Snaps: []PublicSnap{{Name: "a", CreatedAt: snappedAt}}},
+		},
+		"10.0.0.2:43210": {
+			status: status(100*datasize.GB, 2),
+			resource: PublicResource{Name: "postgres-1", Snaps: []PublicSnap{{Name: "b", CreatedAt: snappedAt, Clones: []PublicClone{
+				{Name: "b-clone", Resource: "postgres-1"},
+			}}}},
+		},
+		"10.0.0.3:43210": {
+			status:   ServerStatus{Resources: []string{"postgres-2"}},
+			resource: PublicResource{Name: "postgres-2"},
+		},
+	}
+
+	tests := []struct {
+		strategy Strategy
+		want     string
+	}{
+		{strategy: Heuristic, want: "10.0.0.1:43210"},
+		{strategy: PoolAvailability(Heuristic), want: "10.0.0.2:43210"},
+		{strategy: OwnerAffinity(Heuristic), want: "10.0.0.2:43210"},
+	}
+	for _, tt := range tests {
+		cluster := newTestCluster(t, servers, WithStrategy(tt.strategy))
+		cand, err := cluster.Choose(context.Background(), "postgres-1", nil)
+		if err != nil {
+			t.Fatalf("Choose() error = %v", err)
+		}
+		if cand.Client.Server() != tt.want {
+			t.Errorf("Choose() = %s, want %s", cand.Client.Server(), tt.want)
+		}
+	}
+
+	cluster := newTestCluster(t, servers)
+	cand, err := cluster.Choose(context.Background(), "postgres-1", func(s PublicSnap) bool { return s.Name == "b" })
+	if err != nil || cand.Client.Server() != "10.0.0.2:43210" {
+		t.Errorf("Choose() with filter = %v, %v", cand, err)
+	}
+
+	_, err = cluster.Choose(context.Background(), "postgres-3", nil)
+	if err == nil {
+		t.Errorf("Choose() of unknown resource should fail")
+	}
+
+	statuses, err := cluster.Status(context.Background())
+	if len(statuses) != 3 {
+		t.Errorf("Status() = %d statuses, want 3", len(statuses))
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadGateway {
+		t.Errorf("Status() error = %v, want the unreachable server reported", err)
+	}
+}
+
+func TestCluster_CandidatesPinned(t *testing.T) {
+	now := time.Now()
+	status := ServerStatus{Resources: []string{"postgres-1"}, FreeDisk: uint64(100 * datasize.GB), FreeMem: uint64(8 * datasize.GB)}
+	servers := map[string]fakeServer{
+		"10.0.0.1:43210": {status: status, resource: PublicResource{Name: "postgres-1", Snaps: []PublicSnap{
+			{Name: "old", CreatedAt: now.Add(-72 * time.Hour), Pinned: true},
+			{Name: "new", CreatedAt: now.Add(-time.Hour)},
+		}}},
+		"10.0.0.2:43210": {status: status, resource: PublicResource{Name: "postgres-1", Snaps: []PublicSnap{
+			{Name: "bad", CreatedAt: now.Add(-time.Hour), Deprecated: true},
+			{Name: "good", CreatedAt: now.Add(-48 * time.Hour)},
+		}}},
+	}
+	cands, _ := newTestCluster(t, servers).Candidates(context.Background(), "postgres-1", nil)
+	var names []string
+	for _, c := range cands {
+		names = append(names, c.Snap.Name)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"good", "old"}) {
+		t.Errorf("Candidates() = %v, want the pinned snap and the latest snap which is not deprecated", names)
+	}
+}
+
+func TestDefaultSnap(t *testing.T) {
+	now := time.Now()
+	snaps := []PublicSnap{
+		{Name: "a", CreatedAt: now.Add(-3 * time.Hour)},
+		{Name: "b", CreatedAt: now.Add(-2 * time.Hour)},
+		{Name: "c", CreatedAt: now.Add(-time.Hour), Deprecated: true},
+	}
+	if i := DefaultSnap(snaps); i != 1 {
+		t.Errorf("DefaultSnap() = %d, want the latest snap which is not deprecated", i)
+	}
+	snaps[0].Pinned = true
+	if i := DefaultSnap(snaps); i != 0 {
+		t.Errorf("DefaultSnap() = %d, want the pinned snap", i)
+	}
+	if i := DefaultSnap(snaps[2:]); i != -1 {
+		t.Errorf("DefaultSnap() = %d, want -1 when every snap is deprecated", i)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"sync"
 
 	"github.com/caarlos0/env/v11"
+	"github.com/modfin/zdap/internal/proxy"
 )
 
 type conf struct {
@@ -16,6 +17,35 @@ type conf struct {
 	ResourceFilter string   `env:"ZDAP_RESOURCE_FILTER"`
 	Servers        []string `env:"ZDAP_SERVERS"`
 	ResetAtHhMm    string   `env:"ZDAP_RESET_AT_HH_MM"`
+	// ResetGraceSeconds is how long connections to the previous clone are kept open after a reset
+	ResetGraceSeconds int `env:"ZDAP_RESET_GRACE_SECONDS" envDefault:"300"`
+	// FailoverAfter is the number of failed dials in a row before failing over to another server, 0 disables it
+	FailoverAfter int `env:"ZDAP_FAILOVER_AFTER" envDefault:"3"`
+
+	// TLS tunnel to the zdapd server, the values are either PEM data or paths to PEM files
+	TLSCert       string `env:"TLS_CERT"`
+	TLSKey        string `env:"TLS_KEY"`
+	TLSCA         string `env:"TLS_CA"`
+	TLSServerName string `env:"TLS_SERVER_NAME"`
+	// TLS makes the k8s proxy request a client certificate from the zdapd server, which requires its admin token
+	TLS        bool   `env:"ZDAP_TLS"`
+	AdminToken string `env:"ZDAP_ADMIN_TOKEN"`
+
+	// Postgres protocol aware proxying, PG_LOG_QUERIES and PG_READ_ONLY imply PG_PROTOCOL
+	PGProtocol   bool `env:"PG_PROTOCOL"`
+	PGLogQueries bool `env:"PG_LOG_QUERIES"`
+	PGReadOnly   bool `env:"PG_READ_ONLY"`
+}
+
+// postgres returns the postgres protocol options of the proxy, or nil if the proxy should be protocol agnostic
+func (c *conf) postgres() *proxy.Postgres {
+	if !c.PGProtocol && !c.PGLogQueries && !c.PGReadOnly {
+		return nil
+	}
+	return &proxy.Postgres{
+		LogQueries: c.PGLogQueries,
+		ReadOnly:   c.PGReadOnly,
+	}
 }
 
 var (
@@ -1,14 +1,27 @@
 package main
 
-import "time"
+import (
+	"time"
 
-func dockerProxy() *TCPProxy {
-	return &TCPProxy{
-		ListenPort:    Config().ListenPort,
-		TargetAddress: Config().TargetAddress,
-		Metric: &Metric{
+	"github.com/modfin/zdap/internal/certs"
+	"github.com/modfin/zdap/internal/proxy"
+)
+
+func dockerProxy() *proxy.TCPProxy {
+	cfg := Config()
+	p := &proxy.TCPProxy{
+		ListenPort:    cfg.ListenPort,
+		TargetAddress: cfg.TargetAddress,
+		Metric: &proxy.Metric{
 			CreatedAt: time.Now(),
 		},
-		useMetricServer: true,
+		MetricServer: true,
+		Postgres:     cfg.postgres(),
+	}
+	if cfg.TLSCert != "" {
+		tlsConfig, err := certs.ClientTLSConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSCA, cfg.TLSServerName)
+		check(err)
+		p.TargetTLSConfig = tlsConfig
 	}
+	return p
 }
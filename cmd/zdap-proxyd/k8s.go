@@ -2,23 +2,51 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
-	"math"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/c2h5oh/datasize"
 	"github.com/modfin/henry/slicez"
 	"github.com/modfin/zdap"
-	"github.com/modfin/zdap/internal/utils"
+	"github.com/modfin/zdap/internal/certs"
+	"github.com/modfin/zdap/internal/proxy"
 )
 
 type k8sp struct {
-	proxy *TCPProxy
-	clone *zdap.PublicClone
+	proxy *proxy.TCPProxy
+
+	mu        sync.Mutex
+	current   *backend
+	switching bool // a reset or failover is in progress
+	failures  int  // consecutive failed dials to current
+
+	// attach and destroy create and destroy clones on the zdap servers
+	attach  func(exclude string) (*zdap.PublicClone, error)
+	destroy func(clone *zdap.PublicClone) error
+}
+
+// destroyAttempts is how many times retire tries to destroy a clone, the delay between the attempts starts at
+// destroyRetryDelay and is doubled after each. The server of a clone that was failed over from may be unreachable for
+// a while, and zdapd never destroys clones that were handed out.
+var (
+	destroyAttempts   = 8
+	destroyRetryDelay = 5 * time.Second
+)
+
+// backend is a clone the proxy forwards new connections to, it keeps track of its open connections so that they
+// can be drained when the proxy switches to another clone
+type backend struct {
+	clone     *zdap.PublicClone
+	address   string
+	tlsConfig *tls.Config
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
 }
 
 func useK8sProxy() bool {
@@ -38,28 +66,45 @@ func k8sProxy() *k8sp {
 		log.Fatal("ERROR: ZDAP_SERVERS environment variable must be set\n")
 	}
 
-	return &k8sp{}
+	p := &k8sp{}
+	p.attach = p.attachNewClone
+	p.destroy = p.destroyClone
+	return p
 }
 
-func (p *k8sp) Start(ctx context.Context) {
+func (p *k8sp) Start(ctx context.Context) error {
 	cfg := Config()
 
 	log.Printf("Checking for an existing %s clone...\n", cfg.Resource)
-	p.clone = p.getExistingClone()
-	if p.clone == nil {
+	clone := p.getExistingClone()
+	if clone == nil {
 		log.Printf("Trying to create a new %s clone...\n", cfg.Resource)
-		p.clone = p.attachNewClone()
+		var err error
+		clone, err = p.attach("")
+		if err != nil {
+			return err
+		}
 	}
 
-	p.proxy = &TCPProxy{
-		ListenPort:    cfg.ListenPort,
-		TargetAddress: fmt.Sprintf("%s:%d", p.clone.Server, p.clone.Port),
+	b, err := p.newBackend(clone)
+	if err != nil {
+		return err
+	}
+	p.current = b
+	p.proxy = &proxy.TCPProxy{
+		ListenPort: cfg.ListenPort,
+		Dial:       p.dial,
+		Postgres:   cfg.postgres(),
+	}
+	err = p.proxy.Start(ctx)
+	if err != nil {
+		return err
 	}
-	p.proxy.Start(ctx)
 
 	if cfg.ResetAtHhMm != "" {
 		p.setupResetTimer(ctx, cfg.ResetAtHhMm)
 	}
+	return nil
 }
 
 func (p *k8sp) Stop() {
@@ -68,118 +113,192 @@ func (p *k8sp) Stop() {
 	}
 }
 
-func (p *k8sp) attachNewClone() *zdap.PublicClone {
-	zdapServerScore := func(stat *zdap.ServerStatus) float64 { // higher the better
-		disk := stat.FreeDisk
-		clones := stat.Clones
-		mem := stat.FreeMem
-		load := stat.Load15
-
-		sum := math.Log2(float64(disk) / float64(datasize.GB) / 100.0) // more disk is good
-		sum += math.Log2(float64(mem) / float64(datasize.GB))          // more ram is good
-		if clones > 0 {
-			sum -= math.Log2(float64(clones)) // fewer clones is good
-		}
-		if load > 0 {
-			sum -= math.Log2(load) // load less than 1 is good
-		}
-		return sum
+func (p *k8sp) newBackend(clone *zdap.PublicClone) (*backend, error) {
+	tlsConfig, err := p.targetTLSConfig(clone)
+	if err != nil {
+		return nil, err
 	}
+	return &backend{
+		clone:     clone,
+		address:   fmt.Sprintf("%s:%d", clone.Server, clone.Port),
+		tlsConfig: tlsConfig,
+		conns:     map[net.Conn]struct{}{},
+	}, nil
+}
 
-	cfg := Config()
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	type availableSnap struct {
-		zdap.PublicSnap
-		cli   *zdap.Client
-		score float64
-	}
-	var availableSnaps []availableSnap
-	for _, s := range cfg.Servers {
-		wg.Add(1)
-		go func(server string) {
-			defer wg.Done()
-			if !strings.Contains(server, ":") {
-				server = fmt.Sprintf("%s:%d", server, cfg.APIPort)
-			}
+func (b *backend) dial() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if b.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", b.address, b.tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", b.address, dialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tc := &trackedConn{Conn: conn, b: b}
+	b.mu.Lock()
+	b.conns[tc] = struct{}{}
+	b.mu.Unlock()
+	return tc, nil
+}
 
-			cli := zdap.NewClient(http.DefaultClient, cfg.CloneOwnerName, server)
-			stat, err := cli.Status()
-			if err != nil {
-				log.Printf("%s - connect error: %v\n", server, err)
-				return
-			}
-			if !utils.StringSliceContains(stat.Resources, cfg.Resource) {
-				log.Printf("%s - '%s' not found\n", server, cfg.Resource)
-				return
-			}
-			cs := zdapServerScore(stat)
-			res, err := cli.GetResourceSnaps(cfg.Resource)
-			if err != nil {
-				log.Printf("%s - error getting snaps, error: %v\n", server, err)
-				return
-			}
-			if cfg.ResourceFilter != "" {
-				log.Printf("%s - filter %d snapshots using '%s'\n", server, len(res.Snaps), cfg.ResourceFilter)
-				res.Snaps = slicez.Filter(res.Snaps, func(a zdap.PublicSnap) bool { return strings.Contains(a.Name, cfg.ResourceFilter) })
-			}
-			if len(res.Snaps) == 0 {
-				log.Printf("%s - '%s' snapshot not found\n", server, cfg.Resource)
-				return
-			}
-			log.Printf("%s - '%s' found with server score: %f (RAM: %d, Disk: %d, clones: %d, load: %f/%f/%f)\n", server, cfg.Resource, cs, stat.FreeMem, stat.FreeDisk, stat.Clones, stat.Load1, stat.Load5, stat.Load15)
-			mu.Lock()
-			for _, snap := range res.Snaps {
-				availableSnaps = append(availableSnaps, availableSnap{
-					PublicSnap: snap,
-					cli:        cli,
-					score:      cs - math.Log2(time.Since(snap.CreatedAt).Hours()/24), // Higher score for recent snapshots
-				})
-			}
-			mu.Unlock()
-		}(s)
+func (b *backend) active() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.conns)
+}
+
+// closeAll closes the connections still open to the backend
+func (b *backend) closeAll() {
+	b.mu.Lock()
+	var conns []net.Conn
+	for c := range b.conns {
+		conns = append(conns, c)
 	}
-	wg.Wait()
-	if len(availableSnaps) == 0 {
-		log.Fatalf("ERROR: no zdap server with '%s' resource could be found!\n", cfg.Resource)
-		return nil
+	b.mu.Unlock()
+	for _, c := range conns {
+		_ = c.Close()
 	}
-	availableSnaps = slicez.SortBy(availableSnaps, func(a, b availableSnap) bool {
-		return a.score > b.score // Highest score first
+}
+
+// trackedConn removes itself from its backend when closed
+type trackedConn struct {
+	net.Conn
+	b    *backend
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.b.mu.Lock()
+		delete(c.b.conns, c)
+		c.b.mu.Unlock()
 	})
-	for _, snap := range availableSnaps {
-		log.Printf("%s - %s = %f\n", snap.cli.Server(), snap.Name, snap.score)
+	return c.Conn.Close()
+}
+
+const dialTimeout = 10 * time.Second
+
+// dial connects new proxy connections to the current backend, and fails over to another server once the current
+// one has failed cfg.FailoverAfter dials in a row
+func (p *k8sp) dial() (net.Conn, error) {
+	p.mu.Lock()
+	b := p.current
+	p.mu.Unlock()
+
+	conn, err := b.dial()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current != b {
+		return conn, err
+	}
+	if err == nil {
+		p.failures = 0
+		return conn, nil
+	}
+	p.failures++
+	cfg := Config()
+	if cfg.FailoverAfter > 0 && p.failures >= cfg.FailoverAfter && !p.switching {
+		p.switching = true
+		go p.failover(b)
+	}
+	return nil, err
+}
+
+// switchTo makes next the backend of new connections and returns the previous one
+func (p *k8sp) switchTo(next *backend) *backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prev := p.current
+	p.current = next
+	p.failures = 0
+	return prev
+}
+
+func (p *k8sp) switchDone() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.switching = false
+}
+
+// retire waits up to grace for the open connections to b to finish, closes the remaining ones and destroys its clone
+func (p *k8sp) retire(b *backend, grace time.Duration) {
+	deadline := time.Now().Add(grace)
+	for b.active() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
 	}
+	if n := b.active(); n > 0 {
+		log.Printf("Grace period for clone %s on %s is over, closing %d open connections\n", b.clone.Name, b.clone.Server, n)
+		b.closeAll()
+	}
+	delay := destroyRetryDelay
+	for attempt := 1; p.destroy(b.clone) != nil; attempt++ {
+		if attempt == destroyAttempts {
+			log.Printf("ERROR: giving up destroying clone %s on %s after %d attempts, it must be destroyed by hand\n", b.clone.Name, b.clone.Server, attempt)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
 
-	snap := availableSnaps[0]
-	log.Printf("Creating a new clone on %s from %s\n", snap.cli.Server(), snap.Name)
-	clone, err := snap.cli.CloneSnap(cfg.Resource, snap.CreatedAt, zdap.ClaimArgs{})
+// targetTLSConfig requests a client certificate from the server of the clone, if tls is enabled
+func (p *k8sp) targetTLSConfig(clone *zdap.PublicClone) (*tls.Config, error) {
+	cfg := Config()
+	if !cfg.TLS {
+		return nil, nil
+	}
+	cli := zdap.New(fmt.Sprintf("%s:%d", clone.Server, cfg.APIPort), cfg.CloneOwnerName, zdap.WithAdminToken(cfg.AdminToken))
+	cert, err := cli.IssueCertificate()
 	if err != nil {
-		log.Fatalf("ERROR: failed to clone '%s' resource, error %v\n", cfg.Resource, err)
+		return nil, fmt.Errorf("could not get a client certificate from %s, %w", clone.Server, err)
+	}
+	return certs.ClientTLSConfig(cert.Certificate, cert.Key, cert.CA, cfg.TLSServerName)
+}
+
+// attachNewClone clones the best snapshot of the resource found on the servers, except on the exclude server
+func (p *k8sp) attachNewClone(exclude string) (*zdap.PublicClone, error) {
+	cfg := Config()
+	var clients []*zdap.Client
+	for _, s := range cfg.Servers {
+		server := zdap.ServerAddress(s, cfg.APIPort)
+		if host, _, _ := net.SplitHostPort(server); exclude != "" && host == exclude {
+			log.Printf("%s - excluded\n", server)
+			continue
+		}
+		clients = append(clients, zdap.NewClient(http.DefaultClient, cfg.CloneOwnerName, server))
 	}
 
-	return clone
+	var filter func(zdap.PublicSnap) bool
+	if cfg.ResourceFilter != "" {
+		log.Printf("Filtering snapshots using '%s'\n", cfg.ResourceFilter)
+		filter = func(a zdap.PublicSnap) bool { return strings.Contains(a.Name, cfg.ResourceFilter) }
+	}
+	cluster := zdap.NewCluster(clients, zdap.WithLogger(log.Printf))
+	return cluster.Clone(context.Background(), cfg.Resource, filter, zdap.ClaimArgs{})
 }
 
-func (p *k8sp) destroyClone(clone *zdap.PublicClone) {
-	log.Printf("Destroying clone %s on %s (this should cause all open proxy connections to the server to be dropped)...\n", clone.Name, clone.Server)
+func (p *k8sp) destroyClone(clone *zdap.PublicClone) error {
+	log.Printf("Destroying clone %s on %s...\n", clone.Name, clone.Server)
 	cfg := Config()
 	cli := zdap.NewClient(http.DefaultClient, cfg.CloneOwnerName, fmt.Sprintf("%s:%d", clone.Server, cfg.APIPort))
 	err := cli.DestroyClone(cfg.Resource, clone.CreatedAt)
 	if err != nil {
 		log.Printf("ERROR: failed to destroy clone %s on %s, error: %v\n", clone.Name, clone.Server, err)
-		return
+		return err
 	}
 	log.Printf("Clone %s on %s destroyed successfully\n", clone.Name, clone.Server)
+	return nil
 }
 
 func (p *k8sp) getExistingClone() *zdap.PublicClone {
 	cfg := Config()
 	var activeClones []zdap.PublicClone
 	for _, s := range cfg.Servers {
-		if !strings.Contains(s, ":") {
-			s = fmt.Sprintf("%s:%d", s, cfg.APIPort)
-		}
+		s = zdap.ServerAddress(s, cfg.APIPort)
 
 		c := zdap.NewClient(http.DefaultClient, cfg.CloneOwnerName, s)
 		clones, err := c.GetClones(cfg.Resource)
@@ -207,22 +326,68 @@ func (p *k8sp) getExistingClone() *zdap.PublicClone {
 	return &activeClones[0]
 }
 
+// reset moves new connections to a clone of the latest snapshot, connections to the previous clone are given
+// cfg.ResetGraceSeconds to finish in the background before it is destroyed
 func (p *k8sp) reset() {
-	log.Printf("Trying to reset ZDAP resource %s...\n", Config().Resource)
+	cfg := Config()
+	p.mu.Lock()
+	if p.switching {
+		p.mu.Unlock()
+		log.Printf("Skipping reset of ZDAP resource %s, a switch is already in progress\n", cfg.Resource)
+		return
+	}
+	p.switching = true
+	p.mu.Unlock()
+	defer p.switchDone()
+
+	log.Printf("Trying to reset ZDAP resource %s...\n", cfg.Resource)
 
 	// Crate a new clone from the latest snapshot
-	newClone := p.attachNewClone()
-	if newClone == nil {
+	newClone, err := p.attach("")
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		return
+	}
+	next, err := p.newBackend(newClone)
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		_ = p.destroy(newClone)
 		return
 	}
 
-	// New snap attached as a new clone, update proxy to point to the new clone
-	prevClone := p.clone
-	p.clone = newClone
-	p.proxy.TargetAddress = fmt.Sprintf("%s:%d", p.clone.Server, p.clone.Port)
+	prev := p.switchTo(next)
+	log.Printf("New connections are proxied to clone %s on %s, draining %d connections to %s\n", newClone.Name, newClone.Server, prev.active(), prev.clone.Name)
+	// the new clone may fail over while the previous one drains
+	go p.retire(prev, time.Duration(cfg.ResetGraceSeconds)*time.Second)
+}
+
+// failover moves new connections to a clone on another server after the server of failed stopped responding
+func (p *k8sp) failover(failed *backend) {
+	defer p.switchDone()
+	cfg := Config()
+	log.Printf("Clone %s on %s is unreachable, failing over to another server...\n", failed.clone.Name, failed.clone.Server)
 
-	// Destroy the old clone, this will disconnect all open proxy connections against the old clone
-	p.destroyClone(prevClone)
+	newClone, err := p.attach(failed.clone.Server)
+	if err != nil {
+		log.Printf("ERROR: failover of ZDAP resource %s failed, %v\n", cfg.Resource, err)
+		p.mu.Lock()
+		p.failures = 0
+		p.mu.Unlock()
+		return
+	}
+	next, err := p.newBackend(newClone)
+	if err != nil {
+		log.Printf("ERROR: failover of ZDAP resource %s failed, %v\n", cfg.Resource, err)
+		_ = p.destroy(newClone)
+		p.mu.Lock()
+		p.failures = 0
+		p.mu.Unlock()
+		return
+	}
+	prev := p.switchTo(next)
+	log.Printf("Failed over to clone %s on %s\n", newClone.Name, newClone.Server)
+	// connections to the unreachable clone are most likely dead already
+	go p.retire(prev, 0)
 }
 
 func (p *k8sp) setupResetTimer(ctx context.Context, atTimeStr string) {
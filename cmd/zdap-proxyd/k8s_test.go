@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/modfin/zdap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cloneServer answers every line with the name of the clone, and returns a clone served by it
+func cloneServer(t *testing.T, name string) *zdap.PublicClone {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				s := bufio.NewScanner(c)
+				for s.Scan() {
+					_, _ = fmt.Fprintln(c, name)
+				}
+			}()
+		}
+	}()
+	return &zdap.PublicClone{Name: name, Server: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port}
+}
+
+// deadClone returns a clone on a port nothing listens on
+func deadClone(t *testing.T, name string) *zdap.PublicClone {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+	return &zdap.PublicClone{Name: name, Server: "localhost", Port: port}
+}
+
+func ask(t *testing.T, r *bufio.Reader, conn net.Conn) (string, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := fmt.Fprintln(conn, "ping")
+	if err != nil {
+		return "", err
+	}
+	line, err := r.ReadString('\n')
+	if len(line) > 0 {
+		line = line[:len(line)-1]
+	}
+	return line, err
+}
+
+func testConfig(t *testing.T, graceSeconds, failoverAfter int) {
+	c := Config()
+	prev := *c
+	t.Cleanup(func() { *c = prev })
+	c.ResetGraceSeconds = graceSeconds
+	c.FailoverAfter = failoverAfter
+	c.TLS = false
+}
+
+func newTestProxy(t *testing.T, current *zdap.PublicClone, attach func(exclude string) (*zdap.PublicClone, error)) (*k8sp, chan string) {
+	destroyed := make(chan string, 10)
+	p := &k8sp{
+		attach:  attach,
+		destroy: func(clone *zdap.PublicClone) error {
+			destroyed <- clone.Name
+			return nil
+		},
+	}
+	b, err := p.newBackend(current)
+	require.NoError(t, err)
+	p.current = b
+	return p, destroyed
+}
+
+func TestK8sProxy_ResetDrainsInBackground(t *testing.T) {
+	testConfig(t, 1, 2)
+	prev, next := cloneServer(t, "prev"), cloneServer(t, "next")
+	p, destroyed := newTestProxy(t, prev, func(string) (*zdap.PublicClone, error) { return next, nil })
+
+	old, err := p.dial()
+	require.NoError(t, err)
+	defer old.Close()
+	oldReader := bufio.NewReader(old)
+	name, err := ask(t, oldReader, old)
+	require.NoError(t, err)
+	require.Equal(t, "prev", name)
+
+	start := time.Now()
+	p.reset()
+	assert.Less(t, time.Since(start), time.Second, "reset should not wait for the previous clone to drain")
+	p.mu.Lock()
+	assert.False(t, p.switching, "the switch should be done once new connections go to the new clone")
+	p.mu.Unlock()
+
+	conn, err := p.dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	name, err = ask(t, bufio.NewReader(conn), conn)
+	require.NoError(t, err)
+	assert.Equal(t, "next", name)
+
+	name, err = ask(t, oldReader, old)
+	require.NoError(t, err)
+	assert.Equal(t, "prev", name, "open connections to the previous clone should be kept during the grace period")
+
+	select {
+	case name = <-destroyed:
+		assert.Equal(t, "prev", name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the previous clone was not destroyed after the grace period")
+	}
+	_, err = ask(t, oldReader, old)
+	assert.Error(t, err, "connections still open after the grace period should be closed")
+}
+
+func TestK8sProxy_FailoverWhileDraining(t *testing.T) {
+	testConfig(t, 2, 2)
+	prev, dead, failover := cloneServer(t, "prev"), deadClone(t, "dead"), cloneServer(t, "failover")
+	excluded := make(chan string, 1)
+	p, destroyed := newTestProxy(t, prev, func(exclude string) (*zdap.PublicClone, error) {
+		if exclude == "" {
+			return dead, nil
+		}
+		excluded <- exclude
+		return failover, nil
+	})
+
+	old, err := p.dial()
+	require.NoError(t, err)
+	defer old.Close()
+
+	p.reset()
+
+	// the new clone is unreachable, failover must not wait for the previous clone to drain
+	for i := 0; i < 2; i++ {
+		_, err = p.dial()
+		assert.Error(t, err)
+	}
+	select {
+	case exclude := <-excluded:
+		assert.Equal(t, "localhost", exclude, "failover should exclude the server of the unreachable clone")
+	case <-time.After(time.Second):
+		t.Fatal("failover was not started while the previous clone was draining")
+	}
+
+	require.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.current.clone == failover && !p.switching
+	}, 5*time.Second, 10*time.Millisecond)
+	conn, err := p.dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	name, err := ask(t, bufio.NewReader(conn), conn)
+	require.NoError(t, err)
+	assert.Equal(t, "failover", name)
+
+	var names []string
+	for len(names) < 2 {
+		select {
+		case name := <-destroyed:
+			names = append(names, name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %v were destroyed", names)
+		}
+	}
+	assert.ElementsMatch(t, []string{"dead", "prev"}, names)
+}
+
+func TestK8sProxy_FailoverWithoutCertificate(t *testing.T) {
+	testConfig(t, 1, 2)
+	dead, failover := deadClone(t, "dead"), cloneServer(t, "failover")
+	p, destroyed := newTestProxy(t, dead, func(string) (*zdap.PublicClone, error) { return failover, nil })
+	Config().TLS = true
+	Config().APIPort = deadClone(t, "api").Port // no certificate can be issued for the failover clone
+
+	for i := 0; i < 2; i++ {
+		_, err := p.dial()
+		assert.Error(t, err)
+	}
+	select {
+	case name := <-destroyed:
+		assert.Equal(t, "failover", name, "the clone that could not be used should be destroyed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failover clone was not destroyed")
+	}
+	require.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return !p.switching
+	}, 5*time.Second, 10*time.Millisecond)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	assert.Equal(t, dead, p.current.clone)
+	assert.Equal(t, 0, p.failures, "a failed failover should start counting failures anew")
+}
+
+func TestK8sProxy_RetireRetriesDestroy(t *testing.T) {
+	attempts, delay := destroyAttempts, destroyRetryDelay
+	t.Cleanup(func() { destroyAttempts, destroyRetryDelay = attempts, delay })
+	destroyAttempts, destroyRetryDelay = 3, time.Millisecond
+
+	var calls int
+	p := &k8sp{destroy: func(*zdap.PublicClone) error {
+		calls++
+		if calls < 3 {
+			return errors.New("server unreachable")
+		}
+		return nil
+	}}
+	b := &backend{clone: deadClone(t, "prev"), conns: map[net.Conn]struct{}{}}
+	p.retire(b, 0)
+	assert.Equal(t, 3, calls, "destroying the clone should be retried until it succeeds")
+
+	calls = 0
+	p.destroy = func(*zdap.PublicClone) error {
+		calls++
+		return errors.New("server unreachable")
+	}
+	p.retire(b, 0)
+	assert.Equal(t, 3, calls, "destroying the clone should be given up after destroyAttempts")
+}
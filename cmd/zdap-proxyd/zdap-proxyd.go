@@ -18,7 +18,7 @@ func main() {
 	appCtx := context.Background()
 
 	var proxy interface {
-		Start(context.Context)
+		Start(context.Context) error
 		Stop()
 	}
 
@@ -28,7 +28,7 @@ func main() {
 		proxy = dockerProxy()
 	}
 
-	proxy.Start(appCtx)
+	check(proxy.Start(appCtx))
 
 	log.Println("Proxy started")
 
@@ -7,17 +7,12 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"math"
-	"net/http"
 	"os"
 	"reflect"
-	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/c2h5oh/datasize"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
 	"github.com/modfin/zdap"
@@ -46,86 +41,20 @@ func parsArgs(args []string) (servers []string, resource string, snap time.Time,
 }
 
 func findServerCandidate(resource string, user string, servers []string, favorPooled bool) (string, error) {
-	score := func(stat *zdap.ServerStatus) float64 { // higher the better
-		disk := stat.FreeDisk
-		clones := stat.Clones
-		mem := stat.FreeMem
-		load := stat.Load15
-
-		sum := math.Log2(float64(disk) / float64(datasize.GB) / 100.0) // more disk is good
-		sum += math.Log2(float64(mem) / float64(datasize.GB))          // more ram is good
-		if clones > 0 {
-			sum -= math.Log2(float64(clones)) // fewer clones is good
-		}
-		if load > 0 {
-			sum -= math.Log2(load) // load less than 1 is good
-		}
-		return sum
-	}
-
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	type availableSnap struct {
-		zdap.PublicSnap
-		cli   *zdap.Client
-		stat  *zdap.ServerStatus
-		svr   string
-		score float64
-	}
-	var availableSnaps []availableSnap
+	var clients []*zdap.Client
 	for _, s := range servers {
-		wg.Add(1)
-		go func(server string) {
-			defer wg.Done()
-
-			cli := zdap.NewClient(http.DefaultClient, user, server)
-			stat, err := cli.Status()
-			if err != nil {
-				log.Printf("%s - connect error: %v\n", server, err)
-				return
-			}
-			if !utils.StringSliceContains(stat.Resources, resource) {
-				log.Printf("%s - '%s' not found\n", server, resource)
-				return
-			}
-			cs := score(stat)
-			res, err := cli.GetResourceSnaps(resource)
-			if err != nil {
-				log.Printf("%s - error getting snaps, error: %v\n", server, err)
-				return
-			}
-			if len(res.Snaps) == 0 {
-				log.Printf("%s - '%s' snapshot not found\n", server, resource)
-				return
-			}
-			log.Printf("%s - '%s' found with server score: %f (RAM: %d, Disk: %d, clones: %d, load: %f/%f/%f)\n", server, resource, cs, stat.FreeMem, stat.FreeDisk, stat.Clones, stat.Load1, stat.Load5, stat.Load15)
-			mu.Lock()
-			for _, snap := range res.Snaps {
-				availableSnaps = append(availableSnaps, availableSnap{
-					PublicSnap: snap,
-					cli:        cli,
-					stat:       stat,
-					svr:        s,
-					score:      cs - math.Log2(time.Since(snap.CreatedAt).Hours()/24), // Higher score for recent snapshots
-				})
-			}
-			mu.Unlock()
-		}(s)
+		clients = append(clients, newClient(user, s))
 	}
-	wg.Wait()
-	if len(availableSnaps) == 0 {
-		log.Fatalf("ERROR: no zdap server with '%s' resource could be found!\n", resource)
-		return "", nil
+	strategy := zdap.Heuristic
+	if favorPooled {
+		strategy = zdap.PoolAvailability(zdap.Heuristic)
 	}
-	sort.Slice(availableSnaps, func(i, j int) bool {
-		a, b := availableSnaps[i], availableSnaps[j]
-
-		if favorPooled {
-			return a.stat.ResourceDetails[resource].PooledClonesAvailable > b.stat.ResourceDetails[resource].PooledClonesAvailable
-		}
-		return a.score > b.score // Highest score first
-	})
-	return availableSnaps[0].svr, nil
+	cluster := zdap.NewCluster(clients, zdap.WithStrategy(strategy), zdap.WithLogger(log.Printf))
+	candidate, err := cluster.Choose(context.Background(), resource, nil)
+	if err != nil {
+		return "", err
+	}
+	return candidate.Client.Server(), nil
 }
 
 func DestroyCloneCompletion(c *cli.Context) {
@@ -163,7 +92,7 @@ func destroyClone(args []string) error {
 
 	for _, s := range servers {
 		fmt.Printf("Destroying %s of %s @%s \n", plural, resource, s)
-		client := zdap.NewClient(http.DefaultClient, cfg.User, s)
+		client := newClient(cfg.User, s)
 		err = client.DestroyClone(resource, clone)
 		if err != nil {
 			fmt.Println("[Err]", err)
@@ -224,7 +153,7 @@ func ExpireClaimedResource(c *cli.Context) error {
 	}
 
 	for _, s := range servers {
-		client := zdap.NewClient(http.DefaultClient, cfg.User, s)
+		client := newClient(cfg.User, s)
 		err = client.ExpireClaim(resource, claimId)
 		if err != nil {
 			fmt.Println("[Err]", err)
@@ -286,7 +215,13 @@ func cloneResource(args []string, claimArgs zdap.ClaimArgs) (*zdap.PublicClone,
 			return nil, fmt.Errorf("could not find a suitable server, %w", err)
 		}
 	}
-	client := zdap.NewClient(http.DefaultClient, cfg.User, server)
+	client := newClient(cfg.User, server)
+	if claimArgs.ClaimPooled {
+		err = requireFeature(client, zdap.FeaturePooling)
+		if err != nil {
+			return nil, err
+		}
+	}
 	clone, err := client.CloneSnap(resource, snap, claimArgs)
 	if err != nil {
 		return nil, err
@@ -303,7 +238,7 @@ func findClone(servers []string, resource string, cloneName time.Time) (clone *z
 	clone = &zdap.PublicClone{}
 	for _, server := range servers {
 		var resources []zdap.PublicResource
-		resources, err = zdap.NewClient(http.DefaultClient, cfg.User, server).GetResources()
+		resources, err = newClient(cfg.User, server).GetResources()
 		if err != nil {
 			fmt.Printf("[Error connecting to %s] %v", server, err)
 		}
@@ -504,11 +439,25 @@ func AttachClone(c *cli.Context) error {
 	container := compose.Container{}
 	container.Image = proxyImageName
 	container.Ports = ports
-	container.Environment = []string{
+	environment := []string{
 		fmt.Sprintf("LISTEN_PORT=%d", port),
 		fmt.Sprintf("TARGET_ADDRESS=%s:%d", clone.Server, clone.Port),
 	}
 
+	if c.Bool("tls") {
+		server := fmt.Sprintf("%s:%d", clone.Server, clone.APIPort)
+		cert, err := zdap.New(server, cfg.User, zdap.WithAdminToken(c.String("admin-token"))).IssueCertificate()
+		if err != nil {
+			return fmt.Errorf("could not get a client certificate from %s, %w", clone.Server, err)
+		}
+		environment = append(environment,
+			fmt.Sprintf("TLS_CERT=%s", cert.Certificate),
+			fmt.Sprintf("TLS_KEY=%s", cert.Key),
+			fmt.Sprintf("TLS_CA=%s", cert.CA),
+		)
+	}
+	container.Environment = environment
+
 	labels := []string{
 		fmt.Sprintf("zdap.resource=%s", clone.Resource),
 		fmt.Sprintf("zdap.clone=%s", clone.CreatedAt.Format(utils.TimestampFormat)),
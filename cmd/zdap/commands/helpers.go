@@ -3,13 +3,54 @@ package commands
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/modfin/zdap"
 	"github.com/modfin/zdap/internal/compose"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
+var clients sync.Map
+
+// newClient returns a client for server. The first time a server is used its version is negotiated, and a warning is
+// printed if it does not speak the api of this zdap.
+func newClient(user, server string) *zdap.Client {
+	key := user + "@" + server
+	if cli, ok := clients.Load(key); ok {
+		return cli.(*zdap.Client)
+	}
+	cli := zdap.NewClient(http.DefaultClient, user, server)
+	v, err := cli.Version()
+	if err == nil {
+		warnVersion(server, v)
+	}
+	clients.Store(key, cli)
+	return cli
+}
+
+func warnVersion(server string, v *zdap.ServerVersion) {
+	switch {
+	case len(v.APIVersions) == 0:
+		fmt.Fprintf(os.Stderr, "[Warning] zdapd at %s is older than this zdap (%s), some commands may not work\n", server, zdap.Version)
+	case !v.SupportsAPI(zdap.APIVersion):
+		fmt.Fprintf(os.Stderr, "[Warning] zdapd at %s (%s) supports api %v, but this zdap (%s) uses api %s\n", server, v.Version, v.APIVersions, zdap.Version, zdap.APIVersion)
+	}
+}
+
+// requireFeature fails if the server is known not to support feature, servers that predate versioning are assumed
+// to support it
+func requireFeature(cli *zdap.Client, feature string) error {
+	v, err := cli.Version()
+	if err != nil || len(v.APIVersions) == 0 || v.Supports(feature) {
+		return nil
+	}
+	return fmt.Errorf("zdapd at %s (%s) does not support %s", cli.Server(), v.Version, feature)
+}
+
 func ensureConfig() (string, error) {
 	conffile := os.Getenv("ZDAP_CONF")
 	if conffile == "" {
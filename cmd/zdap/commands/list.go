@@ -6,7 +6,6 @@ import (
 	"github.com/modfin/zdap"
 	"github.com/modfin/zdap/internal/utils"
 	"github.com/urfave/cli/v2"
-	"net/http"
 	"strings"
 	"time"
 )
@@ -33,7 +32,7 @@ func ListResourceData(all bool, verbose bool) ([]zdap.PublicResource, error) {
 
 	var allResources []zdap.PublicResource
 	for _, s := range cfg.Servers {
-		client := zdap.NewClient(http.DefaultClient, cfg.User, s)
+		client := newClient(cfg.User, s)
 		resources, err := client.GetResources()
 		if err != nil {
 			if verbose {
@@ -61,7 +60,7 @@ func ListResources(c *cli.Context) error {
 	}
 
 	for _, s := range cfg.Servers {
-		client := zdap.NewClient(http.DefaultClient, cfg.User, s)
+		client := newClient(cfg.User, s)
 		resources, err := client.GetResources()
 		if err != nil {
 			fmt.Printf("@%s [COULD NOT CONNECT, %v]\n", s, err)
@@ -104,7 +103,7 @@ func ResourceListCompletion(c *cli.Context) {
 
 	m := map[string]struct{}{}
 	for _, s := range cfg.Servers {
-		client := zdap.NewClient(http.DefaultClient, cfg.User, s)
+		client := newClient(cfg.User, s)
 		resources, err := client.GetResources()
 		if err != nil {
 			continue
@@ -138,7 +137,7 @@ func ListSnaps(c *cli.Context) error {
 	}
 
 	for _, s := range cfg.Servers {
-		client := zdap.NewClient(http.DefaultClient, cfg.User, s)
+		client := newClient(cfg.User, s)
 		resources, err := client.GetResources()
 		if err != nil {
 			fmt.Printf("@%s [COULD NOT CONNECT, %v]\n", s, err)
@@ -204,7 +203,7 @@ func ListClones(c *cli.Context) error {
 	//}
 
 	for _, s := range cfg.Servers {
-		client := zdap.NewClient(http.DefaultClient, cfg.User, s)
+		client := newClient(cfg.User, s)
 		resources, err := client.GetResources()
 		if err != nil {
 			fmt.Printf("@%s [COULD NOT CONNECT, %v]\n", s, err)
@@ -301,7 +300,7 @@ func ListOrigins(c *cli.Context) error {
 	verbose := c.Bool("verbose")
 
 	for _, s := range cfg.Servers {
-		c := zdap.NewClient(http.DefaultClient, cfg.User, s)
+		c := newClient(cfg.User, s)
 		stat, err := c.Status()
 		if err != nil {
 			fmt.Printf("@%s [COULD NOT CONNECT]\n", s)
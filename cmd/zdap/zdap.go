@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"github.com/modfin/zdap"
 	"github.com/modfin/zdap/cmd/zdap/commands"
 	"github.com/urfave/cli/v2"
 	"os"
@@ -10,7 +11,8 @@ import (
 func main() {
 
 	cliapp := &cli.App{
-		Flags: []cli.Flag{},
+		Version: zdap.Version,
+		Flags:   []cli.Flag{},
 		Commands: []*cli.Command{
 			{
 				Name:   "auto-complete",
@@ -81,6 +83,15 @@ func main() {
 						Name:  "force",
 						Usage: "will attach to the override, even if there is no original service present in docker compose file",
 					},
+					&cli.BoolFlag{
+						Name:  "tls",
+						Usage: "tunnel the connection to the clone over tls, using a client certificate issued by the origin",
+					},
+					&cli.StringFlag{
+						Name:    "admin-token",
+						Usage:   "the admin token of the origin, which is required to be issued a client certificate with --tls",
+						EnvVars: []string{"ZDAP_ADMIN_TOKEN"},
+					},
 				},
 				Action:       commands.AttachClone,
 				BashComplete: commands.AttachCloneCompletion,
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/modfin/zdap/internal/config"
+	"github.com/modfin/zdap/internal/secrets"
+	"github.com/urfave/cli/v2"
+)
+
+// openSecrets creates the secret store of zdapd, the encrypted store is only used if both its file and key file are
+// configured
+func openSecrets(cfg *config.Config) (*secrets.Store, error) {
+	var encrypted *secrets.EncryptedStore
+	if cfg.SecretsStore != "" || cfg.SecretsKeyFile != "" {
+		var err error
+		encrypted, err = openEncrypted(cfg, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return secrets.NewStore(cfg.SecretsDir, encrypted), nil
+}
+
+func openEncrypted(cfg *config.Config, create bool) (*secrets.EncryptedStore, error) {
+	if cfg.SecretsStore == "" || cfg.SecretsKeyFile == "" {
+		return nil, errors.New("both --secrets-store and --secrets-key-file must be set to use the encrypted secret store")
+	}
+	return secrets.OpenEncryptedStore(cfg.SecretsStore, cfg.SecretsKeyFile, create)
+}
+
+func secretCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "secret",
+		Usage: "manages the encrypted secret store, secrets are referenced from resources as ${secret:<name>}",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "set",
+				Usage:     "sets a secret to the first line read from stdin, the key file is created if it does not exist",
+				ArgsUsage: "<name>",
+				Action: func(c *cli.Context) error {
+					name := c.Args().First()
+					if c.Args().Len() != 1 {
+						return errors.New("the name of the secret must be provided")
+					}
+					store, err := openEncrypted(config.Get(), true)
+					if err != nil {
+						return err
+					}
+					value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+					if err != nil && value == "" {
+						return fmt.Errorf("could not read secret from stdin, %w", err)
+					}
+					return store.Set(name, strings.TrimRight(value, "\r\n"))
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "lists the names of the secrets in the store",
+				Action: func(c *cli.Context) error {
+					store, err := openEncrypted(config.Get(), false)
+					if err != nil {
+						return err
+					}
+					names, err := store.Names()
+					if err != nil {
+						return err
+					}
+					fmt.Printf("== Secrets ==\n%s\n", strings.Join(names, "\n"))
+					return nil
+				},
+			},
+			{
+				Name:      "remove",
+				Usage:     "removes a secret from the store",
+				ArgsUsage: "<name>",
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 1 {
+						return errors.New("the name of the secret must be provided")
+					}
+					store, err := openEncrypted(config.Get(), false)
+					if err != nil {
+						return err
+					}
+					return store.Remove(c.Args().First())
+				},
+			},
+		},
+	}
+}
@@ -4,12 +4,24 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/c2h5oh/datasize"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+	"github.com/modfin/henry/slicez"
+	"github.com/modfin/zdap"
+	"github.com/modfin/zdap/internal"
 	"github.com/modfin/zdap/internal/api"
+	"github.com/modfin/zdap/internal/certs"
 	"github.com/modfin/zdap/internal/config"
 	"github.com/modfin/zdap/internal/core"
+	"github.com/modfin/zdap/internal/health"
+	"github.com/modfin/zdap/internal/ports"
+	"github.com/modfin/zdap/internal/proxy"
+	"github.com/modfin/zdap/internal/reconcile"
+	"github.com/modfin/zdap/internal/retrieval"
+	"github.com/modfin/zdap/internal/secrets"
+	"github.com/modfin/zdap/internal/servermodel"
 	"github.com/modfin/zdap/internal/utils"
 	"github.com/modfin/zdap/internal/zfs"
 	"github.com/urfave/cli/v2"
@@ -28,6 +40,10 @@ func main() {
 
 	load := func(c *cli.Context) error {
 		cfg := config.FromCli(c)
+		switch c.Args().First() {
+		case "validate", "secret": // must not depend on docker or zfs
+			return nil
+		}
 
 		configDir := cfg.ConfigDir
 		z = zfs.NewZFS(cfg.ZPool)
@@ -36,14 +52,84 @@ func main() {
 			return err
 		}
 
-		app, err = core.NewCore(configDir, cfg.NetworkAddress, cfg.APIPort, docker, z)
+		proxies := proxy.NewManager(time.Duration(cfg.ProxyDrainSeconds) * time.Second)
+		minPort, maxPort, err := ports.ParseRange(cfg.PortRange)
+		if err != nil {
+			return err
+		}
+		registry, err := ports.NewRegistry(minPort, maxPort, cfg.StablePorts)
+		if err != nil {
+			return err
+		}
+		var authority *certs.Authority
+		if cfg.TLSDir != "" {
+			authority, err = certs.LoadOrCreate(cfg.TLSDir)
+			if err != nil {
+				return err
+			}
+			tlsConfig, err := authority.ServerTLSConfig([]string{cfg.NetworkAddress})
+			if err != nil {
+				return err
+			}
+			proxies.EnableTLS(tlsConfig, cfg.TLSRequired)
+		}
+		store, err := openSecrets(cfg)
+		if err != nil {
+			return err
+		}
+		ownerLimits := internal.OwnerLimits{Clones: cfg.OwnerMaxClones, CPUs: cfg.OwnerMaxCPUs}
+		if cfg.OwnerMaxMemory != "" {
+			ownerLimits.Memory, err = datasize.ParseString(cfg.OwnerMaxMemory)
+			if err != nil {
+				return fmt.Errorf("could not parse owner max memory, %w", err)
+			}
+		}
+		fix, err := reconcile.ParsePolicy(cfg.ReconcileFix)
+		if err != nil {
+			return fmt.Errorf("could not parse reconcile fix, %w", err)
+		}
+		app, err = core.NewCore(configDir, cfg.NetworkAddress, cfg.APIPort, docker, z, proxies, registry, authority, store, retrieval.New(cfg.CacheDir, store), cfg.BuildSlots, ownerLimits,
+			health.Config{Interval: cfg.HealthInterval, Failures: cfg.HealthFailures}, reconcile.Config{Interval: cfg.ReconcileInterval, Fix: fix})
 		if err != nil {
 			return err
 		}
 		return nil
 	}
 
+	// snapCommand changes the snap given as <resource> <created at> and prints it
+	snapCommand := func(name string, usage string, flags []cli.Flag, change func(c *cli.Context, dss *zfs.Dataset, resource string, at time.Time) (*zdap.PublicSnap, error)) *cli.Command {
+		return &cli.Command{
+			Name:      name,
+			Usage:     usage,
+			ArgsUsage: "<resource> <created at>",
+			Flags:     flags,
+			Action: func(c *cli.Context) error {
+				if c.Args().Len() != 2 {
+					return errors.New("a resource and the creation time of one of its snaps must be provided")
+				}
+				at, err := time.Parse(utils.TimestampFormat, c.Args().Get(1))
+				if err != nil {
+					return fmt.Errorf("invalid snap time '%s', %w", c.Args().Get(1), err)
+				}
+
+				dss, err := z.Open()
+				if err != nil {
+					return err
+				}
+				defer dss.Close()
+
+				snap, err := change(c, dss, c.Args().First(), at)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s @ %s%s\n", snap.Resource, snap.CreatedAt.In(time.UTC).Format(utils.TimestampFormat), snapMarks(*snap))
+				return nil
+			},
+		}
+	}
+
 	cliapp := &cli.App{
+		Version: zdap.Version,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:  "zpool",
@@ -61,6 +147,78 @@ func main() {
 				Name:  "api-port",
 				Usage: "The port used to open a http api server, can also be set by env API_PORT=...",
 			},
+			&cli.IntFlag{
+				Name:  "proxy-drain-seconds",
+				Usage: "The time open connections to a clone are given to finish before the clone is destroyed, can also be set by env PROXY_DRAIN_SECONDS=...",
+			},
+			&cli.StringFlag{
+				Name:  "port-range",
+				Usage: "The range of ports, <min>-<max>, that clones are exposed on, can also be set by env PORT_RANGE=...",
+			},
+			&cli.BoolFlag{
+				Name:  "stable-ports",
+				Usage: "Keep exposing an owners clones of a resource on the same port when they are recreated, can also be set by env STABLE_PORTS=...",
+			},
+			&cli.StringFlag{
+				Name:  "tls-dir",
+				Usage: "The dir where the certificate authority is stored, enables tls tunneling to clones when set, can also be set by env TLS_DIR=...",
+			},
+			&cli.BoolFlag{
+				Name:  "tls-required",
+				Usage: "Reject clone connections that are not tunneled over tls, can also be set by env TLS_REQUIRED=...",
+			},
+			&cli.StringFlag{
+				Name:  "admin-token",
+				Usage: "The token admin requests must send in the admin-token header, admin requests are rejected if unset, can also be set by env ADMIN_TOKEN=...",
+			},
+			&cli.StringFlag{
+				Name:  "cache-dir",
+				Usage: "The dir where artifacts downloaded by the retrieval drivers are cached, can also be set by env CACHE_DIR=...",
+			},
+			&cli.IntFlag{
+				Name:  "build-slots",
+				Usage: "The total weight of the base builds that may run at once, can also be set by env BUILD_SLOTS=...",
+			},
+			&cli.IntFlag{
+				Name:  "owner-max-clones",
+				Usage: "The number of clones each owner may have, unlimited if 0, can also be set by env OWNER_MAX_CLONES=...",
+			},
+			&cli.Float64Flag{
+				Name:  "owner-max-cpus",
+				Usage: "The cpus the clones of each owner may use together, unlimited if 0, can also be set by env OWNER_MAX_CPUS=...",
+			},
+			&cli.StringFlag{
+				Name:  "owner-max-memory",
+				Usage: "The memory the clones of each owner may use together, e.g. 16GB, can also be set by env OWNER_MAX_MEMORY=...",
+			},
+			&cli.DurationFlag{
+				Name:  "health-interval",
+				Usage: "How often the health of the clones is checked, 0 disables it, can also be set by env HEALTH_INTERVAL=...",
+			},
+			&cli.IntFlag{
+				Name:  "health-failures",
+				Usage: "The failed health checks in a row after which a clone is repaired, can also be set by env HEALTH_FAILURES=...",
+			},
+			&cli.DurationFlag{
+				Name:  "reconcile-interval",
+				Usage: "How often orphaned datasets, containers and proxies are looked for, 0 disables it, can also be set by env RECONCILE_INTERVAL=...",
+			},
+			&cli.StringFlag{
+				Name:  "reconcile-fix",
+				Usage: "The kinds of drift the reconciler fixes rather than reports, all or none, can also be set by env RECONCILE_FIX=...",
+			},
+			&cli.StringFlag{
+				Name:  "secrets-dir",
+				Usage: "A dir of files holding secrets, named after the secret, can also be set by env SECRETS_DIR=...",
+			},
+			&cli.StringFlag{
+				Name:  "secrets-store",
+				Usage: "The file of the encrypted secret store, can also be set by env SECRETS_STORE=...",
+			},
+			&cli.StringFlag{
+				Name:  "secrets-key-file",
+				Usage: "The file holding the key of the encrypted secret store, can also be set by env SECRETS_KEY_FILE=...",
+			},
 		},
 		Commands: []*cli.Command{
 			{
@@ -70,6 +228,84 @@ func main() {
 					return api.Start(config.Get(), app, z)
 				},
 			},
+			{
+				Name:  "validate",
+				Usage: "validates the resource config, exits non-zero if any resource is invalid",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config-dir",
+						Usage: "The dir where all the resource config is stored, defaults to the config dir of zdapd",
+					},
+					&cli.BoolFlag{
+						Name:  "resolve-secrets",
+						Usage: "resolve secret references with the configured secrets, they are only checked for syntax otherwise",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					dir := config.Get().ConfigDir
+					if c.IsSet("config-dir") {
+						dir = c.String("config-dir")
+					}
+					if dir == "" {
+						return cli.Exit("a config dir must be provided", 2)
+					}
+					var store *secrets.Store
+					if c.Bool("resolve-secrets") {
+						store, err = openSecrets(config.Get())
+						if err != nil {
+							return err
+						}
+					}
+					resources, err := core.ValidateConfig(dir, store)
+					if err != nil {
+						return cli.Exit(store.Redact(err.Error()), 1)
+					}
+					fmt.Printf("%s: %d resource(s) are valid\n", dir, len(resources))
+					return nil
+				},
+			},
+			secretCommand(),
+			{
+				Name:  "doctor",
+				Usage: "looks for drift between the datasets, containers and proxies of the clones, exits non-zero if any is left",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "fix",
+						Usage: "the kinds of drift to fix, comma separated, or all. It is only reported otherwise",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					fix, err := reconcile.ParsePolicy(c.String("fix"))
+					if err != nil {
+						return cli.Exit(err.Error(), 2)
+					}
+					findings, err := app.Reconcile(fix)
+					if err != nil {
+						return err
+					}
+					var left int
+					for _, f := range findings {
+						status := "found"
+						switch {
+						case f.Fixed:
+							status = "fixed"
+						case f.Err != nil:
+							status = fmt.Sprintf("not fixed, %v", f.Err)
+						}
+						if !f.Fixed {
+							left++
+						}
+						fmt.Printf("%-21s %s - %s [%s]\n", f.Kind, f.Name, f.Detail, status)
+					}
+					if left > 0 {
+						return cli.Exit(fmt.Sprintf("%d of %d problem(s) are left", left, len(findings)), 1)
+					}
+					if len(findings) == 0 {
+						fmt.Println("no problems found")
+					}
+					return nil
+				},
+			},
 			{
 				Name:  "create",
 				Usage: "create things",
@@ -133,13 +369,13 @@ func main() {
 								if err != nil {
 									return err
 								}
-								if len(snaps) == 0 {
+								i := zdap.DefaultSnap(slicez.Map(snaps, func(s servermodel.ServerInternalSnapshot) zdap.PublicSnap {
+									return s.PublicSnap
+								}))
+								if i < 0 {
 									return errors.New("there seems to be no snaps available for resource")
 								}
-								sort.Slice(snaps, func(i, j int) bool {
-									return snaps[i].CreatedAt.After(snaps[j].CreatedAt)
-								})
-								from = &snaps[0].CreatedAt
+								from = &snaps[i].CreatedAt
 							}
 
 							clone, err := app.CloneResource(dss, c.String("owner"), resource, *from)
@@ -154,6 +390,29 @@ func main() {
 					},
 				},
 			},
+			{
+				Name:  "snap",
+				Usage: "pins and deprecates snaps",
+				Subcommands: []*cli.Command{
+					snapCommand("pin", "pins a snap as the default snap of its resource, which new clones are made from", nil,
+						func(c *cli.Context, dss *zfs.Dataset, resource string, at time.Time) (*zdap.PublicSnap, error) {
+							return app.PinSnap(dss, resource, at)
+						}),
+					snapCommand("unpin", "unpins a snap, the latest snap becomes the default snap again", nil,
+						func(c *cli.Context, dss *zfs.Dataset, resource string, at time.Time) (*zdap.PublicSnap, error) {
+							return app.UnpinSnap(dss, resource, at)
+						}),
+					snapCommand("deprecate", "hides a snap from new clones, existing clones are kept",
+						[]cli.Flag{&cli.StringFlag{Name: "reason", Usage: "why the snap is deprecated"}},
+						func(c *cli.Context, dss *zfs.Dataset, resource string, at time.Time) (*zdap.PublicSnap, error) {
+							return app.DeprecateSnap(dss, resource, at, c.String("reason"))
+						}),
+					snapCommand("undeprecate", "makes a deprecated snap available to new clones again", nil,
+						func(c *cli.Context, dss *zfs.Dataset, resource string, at time.Time) (*zdap.PublicSnap, error) {
+							return app.UndeprecateSnap(dss, resource, at)
+						}),
+				},
+			},
 			{
 				Name:  "list",
 				Usage: "lists things",
@@ -195,7 +454,7 @@ func main() {
 										ochar = "└"
 									}
 
-									fmt.Printf("%s @ %s\n", ochar, snap.CreatedAt.In(time.UTC).Format(utils.TimestampFormat))
+									fmt.Printf("%s @ %s%s\n", ochar, snap.CreatedAt.In(time.UTC).Format(utils.TimestampFormat), snapMarks(snap.PublicSnap))
 								}
 								return nil
 							}
@@ -462,3 +721,14 @@ func destroyClone(clone string, docker *client.Client, z *zfs.ZFS) error {
 	}
 	return z.Destroy(clone)
 }
+
+// snapMarks describes whether the snap is pinned or deprecated
+func snapMarks(snap zdap.PublicSnap) string {
+	switch {
+	case snap.Deprecated:
+		return " (deprecated, " + snap.DeprecationReason + ")"
+	case snap.Pinned:
+		return " (pinned)"
+	}
+	return ""
+}
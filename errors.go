@@ -0,0 +1,135 @@
+package zdap
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type ErrorCode string
+
+const (
+	CodeInvalid      ErrorCode = "invalid_request"
+	CodeUnauthorized ErrorCode = "unauthorized"
+	CodeNotFound     ErrorCode = "not_found"
+	CodeConflict     ErrorCode = "conflict"
+	CodeUnavailable  ErrorCode = "unavailable"
+	CodeInternal     ErrorCode = "internal"
+)
+
+// Sentinel errors matching the code of an *APIError, e.g. errors.Is(err, zdap.ErrNotFound)
+var (
+	ErrInvalid      = errors.New("invalid request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrUnavailable  = errors.New("unavailable")
+	ErrInternal     = errors.New("internal error")
+)
+
+var codes = map[ErrorCode]struct {
+	status   int
+	sentinel error
+}{
+	CodeInvalid:      {http.StatusUnprocessableEntity, ErrInvalid},
+	CodeUnauthorized: {http.StatusUnauthorized, ErrUnauthorized},
+	CodeNotFound:     {http.StatusNotFound, ErrNotFound},
+	CodeConflict:     {http.StatusConflict, ErrConflict},
+	CodeUnavailable:  {http.StatusServiceUnavailable, ErrUnavailable},
+	CodeInternal:     {http.StatusInternalServerError, ErrInternal},
+}
+
+// APIError is the error body returned by the zdapd api, and the error returned by Client for failed requests
+type APIError struct {
+	Status   int       `json:"status"`
+	Code     ErrorCode `json:"code"`
+	Message  string    `json:"message"`
+	Resource string    `json:"resource,omitempty"`
+	Snap     string    `json:"snap,omitempty"`
+	Clone    string    `json:"clone,omitempty"`
+	// RetryAfterSeconds is set when the request may succeed if retried later
+	RetryAfterSeconds int `json:"retry_after_seconds,omitempty"`
+}
+
+func NewError(code ErrorCode, format string, args ...any) *APIError {
+	return &APIError{
+		Status:  StatusOf(code),
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *APIError) WithResource(resource string) *APIError {
+	e.Resource = resource
+	return e
+}
+
+func (e *APIError) WithSnap(snap string) *APIError {
+	e.Snap = snap
+	return e
+}
+
+func (e *APIError) WithClone(clone string) *APIError {
+	e.Clone = clone
+	return e
+}
+
+func (e *APIError) WithRetryAfter(d time.Duration) *APIError {
+	e.RetryAfterSeconds = int(d.Round(time.Second) / time.Second)
+	return e
+}
+
+func (e *APIError) Error() string {
+	var ids []string
+	for _, kv := range [][2]string{{"resource", e.Resource}, {"snap", e.Snap}, {"clone", e.Clone}} {
+		if kv[1] != "" {
+			ids = append(ids, kv[0]+"="+kv[1])
+		}
+	}
+	msg := fmt.Sprintf("%s (%d %s)", e.Message, e.Status, e.Code)
+	if len(ids) > 0 {
+		msg += " [" + strings.Join(ids, " ") + "]"
+	}
+	return msg
+}
+
+// Unwrap returns the sentinel error of the code
+func (e *APIError) Unwrap() error {
+	if c, ok := codes[e.Code]; ok {
+		return c.sentinel
+	}
+	return nil
+}
+
+// Retryable reports if the request may succeed if it is retried later
+func (e *APIError) Retryable() bool {
+	return e.Code == CodeUnavailable || e.RetryAfterSeconds > 0
+}
+
+// StatusOf returns the http status of an error code
+func StatusOf(code ErrorCode) int {
+	if c, ok := codes[code]; ok {
+		return c.status
+	}
+	return http.StatusInternalServerError
+}
+
+// CodeOf returns the error code of a http status
+func CodeOf(status int) ErrorCode {
+	for code, c := range codes {
+		if c.status == status {
+			return code
+		}
+	}
+	switch {
+	case status == http.StatusBadRequest:
+		return CodeInvalid
+	case status == http.StatusForbidden:
+		return CodeUnauthorized
+	case status == http.StatusTooManyRequests || status == http.StatusGatewayTimeout:
+		return CodeUnavailable
+	}
+	return CodeInternal
+}
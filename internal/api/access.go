@@ -0,0 +1,35 @@
+package api
+
+import (
+	"crypto/subtle"
+
+	"github.com/labstack/echo/v4"
+	"github.com/modfin/zdap"
+	"github.com/modfin/zdap/internal/config"
+)
+
+// access decides which requests may use the admin routes, e.g. issuing client certificates. The auth header only
+// names the user, so only the admin token authenticates a request.
+type access struct {
+	adminToken string
+}
+
+func newAccess(cfg *config.Config) access {
+	return access{adminToken: cfg.AdminToken}
+}
+
+// isAdmin reports if the request carries the admin token, no request is an admin request if no token is configured
+func (a access) isAdmin(c echo.Context) bool {
+	token := c.Request().Header.Get(zdap.AdminTokenHeader)
+	return a.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) == 1
+}
+
+// requireAdmin rejects requests that are not admin requests
+func (a access) requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !a.isAdmin(c) {
+			return zdap.NewError(zdap.CodeUnauthorized, "the request must carry the admin token in the %s header", zdap.AdminTokenHeader)
+		}
+		return next(c)
+	}
+}
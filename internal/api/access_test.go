@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/modfin/zdap"
+	"github.com/modfin/zdap/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccess(t *testing.T) {
+	request := func(token string) echo.Context {
+		req := httptest.NewRequest("POST", "/certificates", nil)
+		if token != "" {
+			req.Header.Set(zdap.AdminTokenHeader, token)
+		}
+		return echo.New().NewContext(req, httptest.NewRecorder())
+	}
+
+	acc := newAccess(&config.Config{AdminToken: "secret"})
+	assert.True(t, acc.isAdmin(request("secret")))
+	assert.False(t, acc.isAdmin(request("wrong")))
+	assert.False(t, acc.isAdmin(request("")))
+
+	open := newAccess(&config.Config{})
+	assert.False(t, open.isAdmin(request("")), "no request is an admin request without a configured token")
+}
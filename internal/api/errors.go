@@ -0,0 +1,63 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/modfin/zdap"
+	"github.com/modfin/zdap/internal/secrets"
+)
+
+// errorHandler answers every failed request with a zdap.APIError, errors that are not an APIError are reported as
+// internal errors. Secrets are redacted from the messages.
+func errorHandler(store *secrets.Store) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		handleError(store, err, c)
+	}
+}
+
+func handleError(store *secrets.Store, err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	var apiErr *zdap.APIError
+	var httpErr *echo.HTTPError
+	switch {
+	case errors.As(err, &apiErr):
+	case errors.As(err, &httpErr):
+		apiErr = zdap.NewError(zdap.CodeOf(httpErr.Code), "%v", httpErr.Message)
+		apiErr.Status = httpErr.Code
+	default:
+		apiErr = zdap.NewError(zdap.CodeInternal, "%s", err.Error())
+	}
+	if apiErr.Status == 0 {
+		apiErr.Status = zdap.StatusOf(apiErr.Code)
+	}
+	redacted := *apiErr
+	redacted.Message = store.Redact(apiErr.Message)
+	apiErr = &redacted
+
+	if apiErr.Status >= http.StatusInternalServerError {
+		fmt.Printf("[API] %s %s failed, %s\n", c.Request().Method, c.Request().URL.Path, store.Redact(err.Error()))
+	}
+	if apiErr.RetryAfterSeconds > 0 {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(apiErr.RetryAfterSeconds))
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(apiErr.Status)
+	} else {
+		err = c.JSON(apiErr.Status, apiErr)
+	}
+	if err != nil {
+		fmt.Printf("[API] could not write error response, %v\n", err)
+	}
+}
+
+func invalidTime(name, value string, err error) *zdap.APIError {
+	return zdap.NewError(zdap.CodeInvalid, "could not parse %s '%s', %v", name, value, err)
+}
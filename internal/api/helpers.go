@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/modfin/zdap"
+	"github.com/modfin/zdap/internal"
 	"github.com/modfin/zdap/internal/core"
 	"github.com/modfin/zdap/internal/servermodel"
 	"github.com/modfin/zdap/internal/utils"
@@ -17,17 +18,23 @@ func getStatus(dss *zfs.Dataset, app *core.Core) (zdap.ServerStatus, error) {
 	return app.ServerStatus(dss)
 }
 
+// publicResource returns what clients may see of a resource, the config of the containers is never exposed and
+// secrets are redacted from the rest
+func publicResource(r internal.Resource, app *core.Core) zdap.PublicResource {
+	redact := app.Secrets().Redact
+	return zdap.PublicResource{
+		Name:      r.Name,
+		Alias:     redact(r.Alias),
+		ClonePool: r.ClonePool,
+		Build:     app.BuildStatus(r.Name),
+	}
+}
+
 func getResources(dss *zfs.Dataset, owner string, app *core.Core) ([]servermodel.ServerInternalResource, error) {
 	var err error
 	var resources []servermodel.ServerInternalResource
 	for _, r := range app.GetResources() {
-		res := servermodel.ServerInternalResource{
-			PublicResource: zdap.PublicResource{
-				Name:      r.Name,
-				Alias:     r.Alias,
-				ClonePool: r.ClonePool,
-			},
-		}
+		res := servermodel.ServerInternalResource{PublicResource: publicResource(r, app)}
 		res.Snaps, err = getSnaps(dss, owner, r.Name, app)
 		if err != nil {
 			return nil, err
@@ -45,19 +52,14 @@ func getResource(dss *zfs.Dataset, owner string, resource string, app *core.Core
 		if r.Name != resource {
 			continue
 		}
-		res := servermodel.ServerInternalResource{
-			PublicResource: zdap.PublicResource{
-				Name:  r.Name,
-				Alias: r.Alias,
-			},
-		}
+		res := servermodel.ServerInternalResource{PublicResource: publicResource(r, app)}
 		res.Snaps, err = getSnaps(dss, owner, r.Name, app)
 		if err != nil {
 			return nil, err
 		}
 		return &res, nil
 	}
-	return nil, fmt.Errorf("could not find resource")
+	return nil, zdap.NewError(zdap.CodeNotFound, "could not find resource %s", resource).WithResource(resource)
 }
 func getSnap(dss *zfs.Dataset, owner string, createdAt time.Time, resource string, app *core.Core) (*servermodel.ServerInternalSnapshot, error) {
 	ss, err := app.GetResourceSnaps(dss, resource)
@@ -71,9 +73,13 @@ func getSnap(dss *zfs.Dataset, owner string, createdAt time.Time, resource strin
 		t.Clones, err = getClones(dss, owner, t.CreatedAt, resource, app)
 		return &t, err
 	}
-	return nil, fmt.Errorf("could not find snap %s@%s", resource, createdAt.Format(utils.TimestampFormat))
+	return nil, zdap.NewError(zdap.CodeNotFound, "could not find snap %s@%s", resource, createdAt.Format(utils.TimestampFormat)).
+		WithResource(resource).WithSnap(createdAt.Format(utils.TimestampFormat))
 }
 func getSnaps(dss *zfs.Dataset, owner string, resource string, app *core.Core) ([]servermodel.ServerInternalSnapshot, error) {
+	if !utils.StringSliceContains(app.GetResourcesNames(), resource) {
+		return nil, zdap.NewError(zdap.CodeNotFound, "could not find resource %s", resource).WithResource(resource)
+	}
 	ss, err := app.GetResourceSnaps(dss, resource)
 	if err != nil {
 		return nil, err
@@ -106,7 +112,8 @@ func getClone(dss *zfs.Dataset, owner string, clone time.Time, snap time.Time, r
 		}
 		return &t, nil
 	}
-	return nil, fmt.Errorf("could not find clone %s@%s -> %s", resource, snap.Format(utils.TimestampFormat), clone.Format(utils.TimestampFormat))
+	return nil, zdap.NewError(zdap.CodeNotFound, "could not find clone %s@%s -> %s", resource, snap.Format(utils.TimestampFormat), clone.Format(utils.TimestampFormat)).
+		WithResource(resource).WithSnap(snap.Format(utils.TimestampFormat)).WithClone(clone.Format(utils.TimestampFormat))
 }
 
 func getClones(dss *zfs.Dataset, owner string, snap time.Time, resource string, app *core.Core) ([]servermodel.ServerInternalClone, error) {
@@ -124,6 +131,10 @@ func getClones(dss *zfs.Dataset, owner string, snap time.Time, resource string,
 		return clones[i].CreatedAt.Before(clones[j].CreatedAt)
 	})
 	for i, c := range clones {
+		if c.Port != 0 {
+			continue
+		}
+		// clones created before the port was stored on the dataset are only reachable through their proxy container
 		c.Port, err = getPortClone(c.Name, app)
 		if err != nil {
 			return nil, err
@@ -1,7 +1,6 @@
 package api
 
 import (
-	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -9,6 +8,8 @@ import (
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/modfin/henry/slicez"
+	"github.com/modfin/zdap"
 	"github.com/modfin/zdap/internal"
 	"github.com/modfin/zdap/internal/config"
 	"github.com/modfin/zdap/internal/core"
@@ -19,22 +20,60 @@ import (
 
 func Start(cfg *config.Config, app *core.Core, z *zfs.ZFS) error {
 	e := echo.New()
+	e.HTTPErrorHandler = errorHandler(app.Secrets())
 
 	e.Use(middleware.Logger())
 	e.Use(middleware.RemoveTrailingSlash())
+	routes(e, app, z, newAccess(cfg))
 
+	fmt.Println("== Loaded Resources ==")
+	for _, r := range app.GetResourcesNames() {
+		fmt.Println(" -", r)
+	}
+	fmt.Println("== Starting Cron ==")
+	fmt.Println(app.Start())
+	go reloadOnSignal(app)
+
+	fmt.Println("== Starting API Server ==")
+	return e.Start(fmt.Sprintf(":%d", cfg.APIPort))
+}
+
+// routes registers the api, every route must be documented in openapi.json. The api is served both under
+// /<zdap.APIVersion> and at the root for clients that predate versioning.
+func routes(e *echo.Echo, app *core.Core, z *zfs.ZFS, acc access) {
+	e.GET("/openapi.json", func(c echo.Context) error {
+		return c.JSONBlob(http.StatusOK, zdap.OpenAPI)
+	})
+
+	public := map[string]bool{
+		"/openapi.json":                    true,
+		"/version":                         true,
+		"/" + zdap.APIVersion + "/version": true,
+	}
 	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
+			if public[c.Path()] {
+				return next(c)
+			}
 			auth := c.Request().Header.Get("auth")
 			if len(auth) == 0 {
-				fmt.Println(c.Request().Header)
-				return errors.New("auth header must be supplied")
+				return zdap.NewError(zdap.CodeUnauthorized, "auth header must be supplied")
 			}
 			c.Set("owner", auth)
 			return next(c)
 		}
 	})
 
+	for _, prefix := range []string{"", "/" + zdap.APIVersion} {
+		apiRoutes(e.Group(prefix), app, z, acc)
+	}
+}
+
+func apiRoutes(e *echo.Group, app *core.Core, z *zfs.ZFS, acc access) {
+	e.GET("/version", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, app.ServerVersion())
+	})
+
 	e.GET("/status", func(c echo.Context) error {
 		dss, err := z.Open()
 		if err != nil {
@@ -49,6 +88,10 @@ func Start(cfg *config.Config, app *core.Core, z *zfs.ZFS) error {
 		return c.JSON(http.StatusOK, res)
 	})
 
+	e.GET("/builds", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, app.BuildQueue())
+	})
+
 	e.GET("/resources", func(c echo.Context) error {
 		dss, err := z.Open()
 		if err != nil {
@@ -133,7 +176,7 @@ func Start(cfg *config.Config, app *core.Core, z *zfs.ZFS) error {
 		}
 		at, err := time.Parse(utils.TimestampFormat, c.Param("time"))
 		if err != nil {
-			return err
+			return invalidTime("clone time", c.Param("time"), err)
 		}
 
 		for _, snap := range snaps {
@@ -147,7 +190,33 @@ func Start(cfg *config.Config, app *core.Core, z *zfs.ZFS) error {
 				}
 			}
 		}
-		return errors.New("could not find clone to destroy")
+		return zdap.NewError(zdap.CodeNotFound, "could not find clone to destroy").WithResource(c.Param("resource"))
+	})
+
+	e.GET("/resources/:resource/clones/:time/health", func(c echo.Context) error {
+		dss, err := z.Open()
+		if err != nil {
+			return err
+		}
+		defer dss.Close()
+
+		snaps, err := getSnaps(dss, c.Get("owner").(string), c.Param("resource"), app)
+		if err != nil {
+			return err
+		}
+		at, err := time.Parse(utils.TimestampFormat, c.Param("time"))
+		if err != nil {
+			return invalidTime("clone time", c.Param("time"), err)
+		}
+
+		for _, snap := range snaps {
+			for _, clone := range snap.Clones {
+				if clone.CreatedAt.Equal(at) {
+					return c.JSON(http.StatusOK, app.CloneHealth(clone.PublicClone))
+				}
+			}
+		}
+		return zdap.NewError(zdap.CodeNotFound, "could not find clone").WithResource(c.Param("resource"))
 	})
 
 	e.GET("/resources/:resource/snaps", func(c echo.Context) error {
@@ -177,13 +246,13 @@ func Start(cfg *config.Config, app *core.Core, z *zfs.ZFS) error {
 		if err != nil {
 			return err
 		}
-		var max time.Time
-		for _, s := range snaps {
-			if s.CreatedAt.After(max) {
-				max = s.CreatedAt
-			}
+		i := zdap.DefaultSnap(slicez.Map(snaps, func(s servermodel.ServerInternalSnapshot) zdap.PublicSnap {
+			return s.PublicSnap
+		}))
+		if i < 0 {
+			return zdap.NewError(zdap.CodeNotFound, "resource %s has no snap which can be cloned", resource).WithResource(resource)
 		}
-		clone, err := app.CloneResource(dss, c.Get("owner").(string), resource, max)
+		clone, err := app.CloneResource(dss, c.Get("owner").(string), resource, snaps[i].CreatedAt)
 		if err != nil {
 			return err
 		}
@@ -194,7 +263,7 @@ func Start(cfg *config.Config, app *core.Core, z *zfs.ZFS) error {
 		resource := c.Param("resource")
 		at, err := time.Parse(utils.TimestampFormat, c.Param("createdAt"))
 		if err != nil {
-			return err
+			return invalidTime("snap time", c.Param("createdAt"), err)
 		}
 
 		dss, err := z.Open()
@@ -213,7 +282,7 @@ func Start(cfg *config.Config, app *core.Core, z *zfs.ZFS) error {
 	e.GET("/resources/:resource/snaps/:createdAt", func(c echo.Context) error {
 		at, err := time.Parse(utils.TimestampFormat, c.Param("createdAt"))
 		if err != nil {
-			return err
+			return invalidTime("snap time", c.Param("createdAt"), err)
 		}
 
 		dss, err := z.Open()
@@ -229,21 +298,34 @@ func Start(cfg *config.Config, app *core.Core, z *zfs.ZFS) error {
 		return c.JSON(http.StatusOK, res)
 	})
 
+	e.POST("/resources/:resource/snaps/:createdAt/pin", snapHandler(app, z, func(dss *zfs.Dataset, c echo.Context, resource string, at time.Time) (*zdap.PublicSnap, error) {
+		return app.PinSnap(dss, resource, at)
+	}), acc.requireAdmin)
+	e.DELETE("/resources/:resource/snaps/:createdAt/pin", snapHandler(app, z, func(dss *zfs.Dataset, c echo.Context, resource string, at time.Time) (*zdap.PublicSnap, error) {
+		return app.UnpinSnap(dss, resource, at)
+	}), acc.requireAdmin)
+	e.POST("/resources/:resource/snaps/:createdAt/deprecation", snapHandler(app, z, func(dss *zfs.Dataset, c echo.Context, resource string, at time.Time) (*zdap.PublicSnap, error) {
+		return app.DeprecateSnap(dss, resource, at, c.QueryParam("reason"))
+	}), acc.requireAdmin)
+	e.DELETE("/resources/:resource/snaps/:createdAt/deprecation", snapHandler(app, z, func(dss *zfs.Dataset, c echo.Context, resource string, at time.Time) (*zdap.PublicSnap, error) {
+		return app.UndeprecateSnap(dss, resource, at)
+	}), acc.requireAdmin)
+
 	e.POST("/resources/:resource/claim", func(c echo.Context) error {
 		resource := c.Param("resource")
 		timeoutStr := c.QueryParam("ttl")
 		timeout := internal.DefaultClaimTimeoutSeconds * time.Second
 		if timeoutStr != "" {
 			t, err := strconv.ParseInt(timeoutStr, 10, 64)
-			if err == nil {
-				timeout = time.Duration(t) * time.Second
+			if err != nil || t <= 0 {
+				return zdap.NewError(zdap.CodeInvalid, "ttl must be a positive number of seconds, got '%s'", timeoutStr).WithResource(resource)
 			}
+			timeout = time.Duration(t) * time.Second
 		}
 
 		clone, err := app.ClaimPooledClone(resource, timeout, c.Get("owner").(string))
 		if err != nil {
-			fmt.Println(err.Error())
-			return c.JSON(http.StatusInternalServerError, err)
+			return err
 		}
 		return c.JSON(http.StatusOK, clone)
 	})
@@ -255,13 +337,42 @@ func Start(cfg *config.Config, app *core.Core, z *zfs.ZFS) error {
 		return app.ExpirePooledClone(resource, claimId)
 	})
 
-	fmt.Println("== Loaded Resources ==")
-	for _, r := range app.GetResourcesNames() {
-		fmt.Println(" -", r)
-	}
-	fmt.Println("== Starting Cron ==")
-	fmt.Println(app.Start())
+	e.POST("/admin/reload", func(c echo.Context) error {
+		res, err := reload(app)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, res)
+	}, acc.requireAdmin)
 
-	fmt.Println("== Starting API Server ==")
-	return e.Start(fmt.Sprintf(":%d", cfg.APIPort))
+	e.POST("/certificates", func(c echo.Context) error {
+		cert, err := app.IssueCertificate(c.Get("owner").(string))
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, cert)
+	}, acc.requireAdmin)
+
+}
+
+// snapHandler handles requests changing the snap of the resource and createdAt params, and responds with the snap
+func snapHandler(app *core.Core, z *zfs.ZFS, change func(dss *zfs.Dataset, c echo.Context, resource string, at time.Time) (*zdap.PublicSnap, error)) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		at, err := time.Parse(utils.TimestampFormat, c.Param("createdAt"))
+		if err != nil {
+			return invalidTime("snap time", c.Param("createdAt"), err)
+		}
+
+		dss, err := z.Open()
+		if err != nil {
+			return err
+		}
+		defer dss.Close()
+
+		snap, err := change(dss, c, c.Param("resource"), at)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, snap)
+	}
 }
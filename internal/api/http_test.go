@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/modfin/zdap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoutes_OpenAPI(t *testing.T) {
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal(zdap.OpenAPI, &doc))
+
+	var documented []string
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+		}
+	}
+
+	e := echo.New()
+	routes(e, nil, nil, access{})
+	param := regexp.MustCompile(`:(\w+)`)
+	var served []string
+	for _, r := range e.Routes() {
+		served = append(served, r.Method+" "+param.ReplaceAllString(r.Path, "{$1}"))
+	}
+
+	sort.Strings(documented)
+	sort.Strings(served)
+	assert.Equal(t, documented, served, "the routes served must match the operations in openapi.json")
+}
+
+func TestRoutes_Admin(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = errorHandler(nil)
+	routes(e, nil, nil, access{adminToken: "secret"})
+
+	snap := "/resources/users/snaps/2024-01-31T13:37:00Z"
+	admin := []string{
+		"POST /admin/reload",
+		"POST /certificates",
+		"POST " + snap + "/pin",
+		"DELETE " + snap + "/pin",
+		"POST " + snap + "/deprecation",
+		"DELETE " + snap + "/deprecation",
+	}
+	for _, route := range admin {
+		method, path, _ := strings.Cut(route, " ")
+		for _, prefix := range []string{"", "/" + zdap.APIVersion} {
+			for _, token := range []string{"", "wrong"} {
+				req := httptest.NewRequest(method, prefix+path, nil)
+				req.Header.Set("auth", "user@host")
+				req.Header.Set(zdap.AdminTokenHeader, token)
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+				assert.Equal(t, http.StatusUnauthorized, rec.Code, "%s %s with token %q", method, prefix+path, token)
+			}
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/modfin/zdap"
+	"github.com/modfin/zdap/internal/core"
+)
+
+// reload reloads the resource config, invalid config is reported as an invalid request
+func reload(app *core.Core) (zdap.ReloadResult, error) {
+	res, err := app.Reload()
+	var verrs core.ValidationErrors
+	if errors.As(err, &verrs) {
+		return res, zdap.NewError(zdap.CodeInvalid, "%s", app.Secrets().Redact(verrs.Error()))
+	}
+	if err != nil {
+		return res, fmt.Errorf("could not reload resources, %w", err)
+	}
+	fmt.Printf("[API] Reloaded resources, added: %v, removed: %v, updated: %v\n", res.Added, res.Removed, res.Updated)
+	return res, nil
+}
+
+// reloadOnSignal reloads the resource config every time zdapd receives SIGHUP
+func reloadOnSignal(app *core.Core) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		fmt.Println("[API] Received SIGHUP, reloading resources")
+		_, err := reload(app)
+		if err != nil {
+			fmt.Println("[API] Error: could not reload resources,", app.Secrets().Redact(err.Error()))
+		}
+	}
+}
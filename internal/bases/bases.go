@@ -1,48 +1,241 @@
 package bases
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/modfin/henry/slicez"
+	"github.com/modfin/zdap"
 	"github.com/modfin/zdap/internal"
+	"github.com/modfin/zdap/internal/retrieval"
+	"github.com/modfin/zdap/internal/secrets"
+	"github.com/modfin/zdap/internal/servermodel"
 	"github.com/modfin/zdap/internal/zfs"
 )
 
-var baseCreationMutex sync.Mutex
+// The phases of creating a base, reported in the build status and to the scripts as ZDAP_PHASE
+const (
+	PhasePrepare   = "prepare" // creating the dataset of the base
+	PhaseRetrieval = "retrieval"
+	PhaseRestore   = "restore"
+	PhaseHealthy   = "healthy" // waiting for the base container to become healthy
+	PhaseCreation  = "creation"
+	PhaseUpdate    = "update"
+	PhaseVerify    = "verify"
+	PhaseSnap      = "snap" // stopping the base container and snapping the base
+)
+
+// CreateBaseAndSnap creates a base of the resource and snaps it, failed attempts are cleaned up and retried as
+// configured by the resource. The progress is recorded in the build status of the resource, see Status.
+func CreateBaseAndSnap(resourcePath string, r *internal.Resource, docker *client.Client, z *zfs.ZFS, secrets *secrets.Store, retriever *retrieval.Retriever, snapCompletedCallback func()) error {
+	attempts := max(r.Retry.Attempts, 1)
+	started := time.Now()
+	for attempt := 1; ; attempt++ {
+		setStatus(z, r.Name, func(s *zdap.BuildStatus) {
+			s.State, s.Phase, s.Error = zdap.BuildRunning, PhasePrepare, ""
+			s.Attempt, s.Attempts = attempt, attempts
+			s.StartedAt, s.FinishedAt, s.NextAttemptAt = started, nil, nil
+		})
+		phase := func(phase string) {
+			setStatus(z, r.Name, func(s *zdap.BuildStatus) { s.Phase = phase })
+		}
+
+		err := createBaseAndSnap(resourcePath, r, docker, z, secrets, retriever, phase)
+		now := time.Now()
+		if err == nil {
+			setStatus(z, r.Name, func(s *zdap.BuildStatus) {
+				s.State, s.Phase = zdap.BuildSucceeded, ""
+				s.FinishedAt, s.LastSuccessAt = &now, &now
+				s.ConsecutiveFailures = 0
+			})
+			if snapCompletedCallback != nil {
+				snapCompletedCallback()
+			}
+			return nil
+		}
+
+		msg := secrets.Redact(err.Error())
+		if attempt >= attempts {
+			setStatus(z, r.Name, func(s *zdap.BuildStatus) {
+				s.State, s.Error = zdap.BuildFailed, msg
+				s.FinishedAt = &now
+				s.ConsecutiveFailures++
+			})
+			return err
+		}
+		wait := retryBackoff(r.Retry, attempt)
+		next := now.Add(wait)
+		fmt.Printf("Attempt %d of %d to create a base of %s failed, retrying in %v, %s\n", attempt, attempts, r.Name, wait, msg)
+		setStatus(z, r.Name, func(s *zdap.BuildStatus) {
+			s.State, s.Error = zdap.BuildRetrying, msg
+			s.NextAttemptAt = &next
+		})
+		time.Sleep(wait)
+	}
+}
+
+// retryBackoff returns the wait after the failed attempt, the backoff is doubled for every attempt after the first
+func retryBackoff(rt internal.Retry, attempt int) time.Duration {
+	wait, limit := rt.Backoff, rt.MaxBackoff
+	if wait <= 0 {
+		wait = internal.DefaultRetryBackoff
+	}
+	if limit <= 0 {
+		limit = internal.DefaultRetryMaxBackoff
+	}
+	for i := 1; i < attempt && wait < limit; i++ {
+		wait *= 2
+	}
+	return min(wait, limit)
+}
 
-func CreateBaseAndSnap(resourcePath string, r *internal.Resource, docker *client.Client, z *zfs.ZFS, snapCompletedCallback func()) error {
-	baseCreationMutex.Lock()
-	defer baseCreationMutex.Unlock()
+// BuildTimeout returns how long an attempt at creating a base of r may take, the sum of the timeouts of its phases
+func BuildTimeout(r *internal.Resource) time.Duration {
+	var timeout time.Duration
+	for _, phase := range []string{PhaseRetrieval, PhaseRestore, PhaseHealthy, PhaseCreation, PhaseUpdate, PhaseVerify} {
+		timeout += phaseTimeout(r, phase)
+	}
+	return timeout
+}
 
-	runScript := func(script string, args ...string) (string, error) {
-		cmd := exec.Command(script, args...)
-		var out bytes.Buffer
-		cmd.Stdout = &out
-		cmd.Stderr = os.Stderr
-		err := cmd.Run()
-		return out.String(), err
+// phaseTimeout returns how long the phase may run, the phases without a timeout of their own default to the script timeout
+func phaseTimeout(r *internal.Resource, phase string) time.Duration {
+	var timeout time.Duration
+	switch phase {
+	case PhaseRetrieval:
+		timeout = r.Timeouts.Retrieval
+	case PhaseRestore:
+		timeout = r.Timeouts.Restore
+	case PhaseCreation:
+		timeout = r.Timeouts.Creation
+	case PhaseUpdate:
+		timeout = r.Timeouts.Update
+	case PhaseVerify:
+		timeout = r.Timeouts.Verify
+	case PhaseHealthy:
+		if r.Timeouts.Healthy > 0 {
+			return r.Timeouts.Healthy
+		}
+		return internal.DefaultHealthyTimeout
+	}
+	if timeout > 0 {
+		return timeout
 	}
+	if r.ScriptTimeout > 0 {
+		return r.ScriptTimeout
+	}
+	return internal.DefaultScriptTimeout
+}
 
+// createBaseAndSnap makes one attempt at creating a base. If it fails the base container and the dataset are removed,
+// unless the dataset has been promoted and older bases depend on it.
+func createBaseAndSnap(resourcePath string, r *internal.Resource, docker *client.Client, z *zfs.ZFS, secrets *secrets.Store, retriever *retrieval.Retriever, phase func(string)) (err error) {
 	t := time.Now()
 	name := z.NewDatasetBaseName(r.Name, t)
 
-	path, err := z.CreateDataset(name, r.Name, t, r.BaseZfsProperties())
+	previous, err := latestSnap(z, r.Name)
+	if err != nil {
+		return err
+	}
+	workDir, err := os.MkdirTemp("", name+"-")
+	if err != nil {
+		return fmt.Errorf("could not create work dir, %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	var containerID string
+	var datasetCreated, promoted bool
+	defer func() {
+		if err != nil {
+			cleanupBase(docker, z, name, containerID, datasetCreated && !promoted)
+		}
+	}()
+
+	// incremental bases are cloned from the latest snap and brought up to date by the update script, sharing the blocks
+	// that did not change with the bases before them
+	incremental := r.Update != "" && previous != nil
+	var path string
+	if incremental {
+		fmt.Println("Cloning", previous.Name, "to", name)
+		path, err = z.CloneBase(previous.Name, name, r.Name, t, r.BaseZfsProperties())
+	} else {
+		path, err = z.CreateDataset(name, r.Name, t, r.BaseZfsProperties())
+	}
+	// a dataset that failed half way through being created is cleaned up as well
+	datasetCreated = true
 	if err != nil {
 		return err
 	}
 
 	ctx := context.Background()
+	env := append([]string{}, r.ScriptEnv...)
+	env = append(env,
+		envVar(EnvResource, r.Name),
+		envVar(EnvConfigDir, resourcePath),
+		envVar(EnvWorkDir, workDir),
+		envVar(EnvDataset, name),
+		envVar(EnvDatasetPath, path),
+		envVar(EnvDBPort, strconv.Itoa(r.Docker.Port)),
+		envVar(EnvTimestamp, t.Format(zfs.TimestampFormat)),
+	)
+	if previous != nil {
+		env = append(env, envVar(EnvPreviousSnap, previous.CreatedAt.Format(zfs.TimestampFormat)), envVar(EnvPreviousMetadata, previous.Metadata))
+	}
+
+	retrieve := func(env []string) (ScriptResult, error) {
+		phase(PhaseRetrieval)
+		timeout := phaseTimeout(r, PhaseRetrieval)
+		if r.Source.Driver != "" {
+			fmt.Println("Retrieving data with the", r.Source.Driver, "driver")
+			rctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			res, err := retriever.Retrieve(rctx, r.Name, r.Source, workDir)
+			return ScriptResult(res), err
+		}
+		fmt.Println("Retrieving data")
+		retrieval := script{path: filepath.Join(resourcePath, r.Retrieval), env: slicez.Concat(env, []string{envVar(EnvPhase, PhaseRetrieval)}), timeout: timeout, secrets: secrets}
+		return retrieval.run(ctx)
+	}
+
+	mounts := []mount.Mount{
+		{
+			Type:   mount.TypeBind,
+			Source: path,
+			Target: r.Docker.Volume,
+		},
+	}
+	// the restore drivers need the data before the base container is created, the physical driver restores it into the
+	// dataset and the others mount it in the container
+	var retrieved ScriptResult
+	if r.Restore.Driver != "" && !incremental {
+		retrieved, err = retrieve(env)
+		if err != nil {
+			return err
+		}
+		if r.Restore.Driver == internal.RestorePhysical {
+			phase(PhaseRestore)
+			fmt.Println("Restoring physical backup", retrieved.File)
+			rctx, cancel := context.WithTimeout(ctx, phaseTimeout(r, PhaseRestore))
+			err = restorePhysical(rctx, retrieved.File, path, r.Restore)
+			cancel()
+			if err != nil {
+				return err
+			}
+		} else {
+			mounts = append(mounts, restoreMount(retrieved.File))
+		}
+	}
+
+	phase(PhaseHealthy)
 	resp, err := docker.ContainerCreate(ctx, &container.Config{
 		Image:      r.Docker.Image,
 		Entrypoint: r.BaseEntrypoint(),
@@ -61,50 +254,80 @@ func CreateBaseAndSnap(resourcePath string, r *internal.Resource, docker *client
 			Name:              "unless-stopped",
 			MaximumRetryCount: 0,
 		},
-		ShmSize: r.Docker.Shm,
-		Mounts: []mount.Mount{
-			{
-				Type:   mount.TypeBind,
-				Source: path,
-				Target: r.Docker.Volume,
-			},
-		},
+		ShmSize:   r.Docker.Shm,
+		Mounts:    mounts,
+		Resources: ContainerResources(r.BaseLimits()),
 	}, nil, nil, name)
 	if err != nil {
 		return err
 	}
+	containerID = resp.ID
 
 	err = docker.ContainerStart(ctx, resp.ID, container.StartOptions{})
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("Waiting for container", name, "to become healthy")
-	for {
-		t, err := docker.ContainerInspect(context.Background(), resp.ID)
+	err = WaitHealthy(ctx, docker, name, phaseTimeout(r, PhaseHealthy))
+	if err != nil {
+		return err
+	}
+	env = append(env, envVar(EnvContainerID, resp.ID), envVar(EnvContainerName, name))
+
+	var updated ScriptResult
+	switch {
+	case incremental:
+		phase(PhaseUpdate)
+		fmt.Print("Updating database...")
+		update := script{path: filepath.Join(resourcePath, r.Update), timeout: phaseTimeout(r, PhaseUpdate), secrets: secrets,
+			env: slicez.Concat(env, []string{envVar(EnvPhase, PhaseUpdate)})}
+		updated, err = update.run(ctx, name)
+		if err == nil {
+			fmt.Println(" done")
+		}
+	case r.Restore.Driver == "":
+		retrieved, err = retrieve(env)
+	case r.Restore.Driver == internal.RestorePgRestore || r.Restore.Driver == internal.RestorePsql:
+		phase(PhaseRestore)
+		fmt.Println("Restoring", retrieved.File, "with", r.Restore.Driver)
+		rctx, cancel := context.WithTimeout(ctx, phaseTimeout(r, PhaseRestore))
+		err = restoreLogical(rctx, docker, resp.ID, retrieved.File, r.Restore, secrets)
+		cancel()
+	}
+	if err != nil {
+		return err
+	}
+
+	var created ScriptResult
+	if r.Creation != "" && !incremental {
+		phase(PhaseCreation)
+		fmt.Print("Creating database...")
+		creation := script{path: filepath.Join(resourcePath, r.Creation), timeout: phaseTimeout(r, PhaseCreation), secrets: secrets,
+			env: slicez.Concat(env, []string{envVar(EnvPhase, PhaseCreation), envVar(EnvFile, retrieved.File), envVar(EnvMetadata, metadataJSON(retrieved.Metadata))})}
+		created, err = creation.run(ctx, retrieved.File, name)
 		if err != nil {
 			return err
 		}
-		if t.State.Health != nil && strings.ToLower(t.State.Health.Status) == "healthy" {
-			break
-		}
-		time.Sleep(time.Second)
+		fmt.Println(" done")
 	}
-	fmt.Println("Container", name, "is healthy")
 
-	fmt.Println("Retrieving data")
-	file, err := runScript(filepath.Join(resourcePath, r.Retrieval))
+	err = verifyBase(ctx, resourcePath, r, docker, resp.ID, name, env, secrets, phase)
 	if err != nil {
 		return err
 	}
 
-	fmt.Print("Creating database...")
-	defer fmt.Println(" done")
-	_, err = runScript(filepath.Join(resourcePath, r.Creation), file, name)
-	if err != nil {
-		return err
+	// an incremental base keeps the metadata of the snap it was cloned from, unless the update script replaces it
+	metadata := map[string]string{}
+	if incremental {
+		metadata = parseMetadata(previous.Metadata)
+	}
+	for _, m := range []map[string]string{retrieved.Metadata, created.Metadata, updated.Metadata} {
+		for k, v := range m {
+			metadata[k] = v
+		}
 	}
 
+	phase(PhaseSnap)
 	d := 60 // seconds
 	err = docker.ContainerStop(context.Background(), resp.ID, container.StopOptions{Timeout: &d})
 	if err != nil {
@@ -123,15 +346,89 @@ func CreateBaseAndSnap(resourcePath string, r *internal.Resource, docker *client
 	if err != nil {
 		return err
 	}
+	containerID = ""
+
+	if r.Verify.MaxShrink > 0 && previous != nil {
+		phase(PhaseVerify)
+		err = verifySize(z, previous.Name, name, r.Verify.MaxShrink)
+		if err != nil {
+			return err
+		}
+	}
+	if incremental {
+		promoted = true
+		err = z.PromoteBase(name)
+		if err != nil {
+			return err
+		}
+	}
+	return z.SnapDataset(name, r.Name, t, metadataJSON(metadata))
+}
 
-	err = z.SnapDataset(name, r.Name, t)
+// verifyBase runs the sql checks and the verify script of the resource against the running base container
+func verifyBase(ctx context.Context, resourcePath string, r *internal.Resource, docker *client.Client, containerID string, name string, env []string, secrets *secrets.Store, phase func(string)) error {
+	v := r.Verify
+	if len(verifyChecks(v)) == 0 && v.Script == "" {
+		return nil
+	}
+	phase(PhaseVerify)
+	ctx, cancel := context.WithTimeout(ctx, phaseTimeout(r, PhaseVerify))
+	defer cancel()
+	err := verifySQL(ctx, docker, containerID, v, secrets)
 	if err != nil {
 		return err
 	}
-	if snapCompletedCallback != nil {
-		snapCompletedCallback()
+	if v.Script == "" {
+		return nil
+	}
+	fmt.Print("Verifying database...")
+	verify := script{path: filepath.Join(resourcePath, v.Script), timeout: phaseTimeout(r, PhaseVerify), secrets: secrets,
+		env: slicez.Concat(env, []string{envVar(EnvPhase, PhaseVerify)})}
+	_, err = verify.run(ctx, name)
+	if err != nil {
+		return fmt.Errorf("verification failed, %w", err)
+	}
+	fmt.Println(" done")
+	return nil
+}
+
+// cleanupBase removes what a failed attempt at creating the base name left behind
+func cleanupBase(docker *client.Client, z *zfs.ZFS, name string, containerID string, destroyDataset bool) {
+	fmt.Println("Cleaning up failed base", name)
+	if containerID != "" {
+		err := docker.ContainerRemove(context.Background(), containerID, container.RemoveOptions{Force: true})
+		if err != nil {
+			fmt.Println("could not remove container", name, err)
+		}
+	}
+	if !destroyDataset {
+		fmt.Println("Keeping dataset", name, "since older bases depend on it")
+		return
+	}
+	err := z.Destroy(name)
+	if err != nil && !strings.Contains(err.Error(), "not exist") {
+		fmt.Println("could not destroy dataset", name, err)
+	}
+}
+
+// latestSnap returns the latest snap of resource which is not deprecated, nil if it has none
+func latestSnap(z *zfs.ZFS, resource string) (*servermodel.ServerInternalSnapshot, error) {
+	dss, err := z.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer dss.Close()
+	snaps, err := z.ListSnaps(dss)
+	if err != nil {
+		return nil, fmt.Errorf("could not list snaps, %w", err)
+	}
+	var latest *servermodel.ServerInternalSnapshot
+	for i, s := range snaps {
+		if s.Resource == resource && !s.Deprecated && (latest == nil || s.CreatedAt.After(latest.CreatedAt)) {
+			latest = &snaps[i]
+		}
 	}
-	return err
+	return latest, nil
 }
 
 const networkName = "zdap_proxy_net"
@@ -149,6 +446,28 @@ func findNetwork(cli *client.Client) (*network.Summary, error) {
 	return nil, nil
 }
 
+// NetworkMembers returns the names of the containers connected to the network of the clones, by container id
+func NetworkMembers(cli *client.Client) (map[string]string, error) {
+	net, err := findNetwork(cli)
+	if err != nil || net == nil {
+		return nil, err
+	}
+	res, err := cli.NetworkInspect(context.Background(), net.ID, network.InspectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	members := map[string]string{}
+	for id, e := range res.Containers {
+		members[id] = e.Name
+	}
+	return members, nil
+}
+
+// DisconnectNetwork removes the container id from the network of the clones
+func DisconnectNetwork(cli *client.Client, id string) error {
+	return cli.NetworkDisconnect(context.Background(), networkName, id, true)
+}
+
 func EnsureNetwork(cli *client.Client) (*network.Summary, error) {
 
 	net, err := findNetwork(cli)
@@ -171,6 +490,47 @@ func EnsureNetwork(cli *client.Client) (*network.Summary, error) {
 	return findNetwork(cli)
 }
 
+// ContainerAddress returns the address of a container on the zdap proxy network
+func ContainerAddress(cli *client.Client, containerName string, port int) (string, error) {
+	c, err := cli.ContainerInspect(context.Background(), containerName)
+	if err != nil {
+		return "", err
+	}
+	if c.NetworkSettings == nil {
+		return "", fmt.Errorf("container %s has no network settings", containerName)
+	}
+	endpoint, ok := c.NetworkSettings.Networks[networkName]
+	if !ok || endpoint.IPAddress == "" {
+		return "", fmt.Errorf("container %s is not attached to %s", containerName, networkName)
+	}
+	return fmt.Sprintf("%s:%d", endpoint.IPAddress, port), nil
+}
+
+// WaitHealthy waits for the healthcheck of the container name to pass
+func WaitHealthy(ctx context.Context, docker *client.Client, name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	fmt.Println("Waiting for container", name, "to become healthy")
+	for {
+		t, err := docker.ContainerInspect(ctx, name)
+		if err != nil {
+			return err
+		}
+		if t.State.Health != nil && strings.ToLower(t.State.Health.Status) == "healthy" {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("container %s did not become healthy within %v", name, timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	fmt.Println("Container", name, "is healthy")
+	return nil
+}
+
 func DestroyClone(cloneName string, docker *client.Client, z *zfs.ZFS) error {
 
 	fmt.Println("Destroying clone", cloneName)
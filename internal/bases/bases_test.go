@@ -0,0 +1,65 @@
+package bases
+
+import (
+	"testing"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/modfin/zdap"
+	"github.com/modfin/zdap/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_retryBackoff(t *testing.T) {
+	rt := internal.Retry{Attempts: 5, Backoff: 10 * time.Second, MaxBackoff: 30 * time.Second}
+	assert.Equal(t, 10*time.Second, retryBackoff(rt, 1))
+	assert.Equal(t, 20*time.Second, retryBackoff(rt, 2))
+	assert.Equal(t, 30*time.Second, retryBackoff(rt, 3))
+	assert.Equal(t, 30*time.Second, retryBackoff(rt, 4))
+	assert.Equal(t, internal.DefaultRetryBackoff, retryBackoff(internal.Retry{}, 1))
+	assert.Equal(t, internal.DefaultRetryMaxBackoff, retryBackoff(internal.Retry{}, 10))
+}
+
+func Test_phaseTimeout(t *testing.T) {
+	r := &internal.Resource{Timeouts: internal.Timeouts{Retrieval: time.Minute}}
+	assert.Equal(t, time.Minute, phaseTimeout(r, PhaseRetrieval))
+	assert.Equal(t, internal.DefaultScriptTimeout, phaseTimeout(r, PhaseCreation))
+	assert.Equal(t, internal.DefaultHealthyTimeout, phaseTimeout(r, PhaseHealthy))
+
+	r.ScriptTimeout = time.Hour
+	assert.Equal(t, time.Hour, phaseTimeout(r, PhaseRestore))
+	assert.Equal(t, internal.DefaultHealthyTimeout, phaseTimeout(r, PhaseHealthy), "the healthcheck is not a script")
+}
+
+func TestStatus(t *testing.T) {
+	assert.Nil(t, Status(nil, "status-test"))
+
+	setStatus(nil, "status-test", func(s *zdap.BuildStatus) { s.State, s.Phase = zdap.BuildRunning, PhaseRetrieval })
+	s := Status(nil, "status-test")
+	assert.Equal(t, zdap.BuildRunning, s.State)
+	assert.Equal(t, PhaseRetrieval, s.Phase)
+
+	s.State = zdap.BuildFailed
+	assert.Equal(t, zdap.BuildRunning, Status(nil, "status-test").State, "the status must be returned as a copy")
+}
+
+func TestContainerResources(t *testing.T) {
+	r := internal.Resource{
+		Limits:        internal.Limits{CPUs: 2, Memory: 4 * datasize.GB, Pids: 500},
+		RestoreParams: internal.ContainerParams{Limits: internal.Limits{CPUs: 8, BlkioWeight: 900}},
+	}
+	res := ContainerResources(r.BaseLimits())
+	assert.Equal(t, int64(8e9), res.NanoCPUs)
+	assert.Equal(t, int64(4<<30), res.Memory)
+	assert.Equal(t, res.Memory, res.MemorySwap)
+	assert.Equal(t, int64(500), *res.PidsLimit)
+	assert.Equal(t, uint16(900), res.BlkioWeight)
+
+	res = ContainerResources(r.CloneLimits())
+	assert.Equal(t, int64(2e9), res.NanoCPUs)
+	assert.Equal(t, uint16(0), res.BlkioWeight)
+
+	res = ContainerResources(internal.Limits{})
+	assert.Nil(t, res.PidsLimit)
+	assert.Zero(t, res.Memory)
+}
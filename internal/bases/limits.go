@@ -0,0 +1,21 @@
+package bases
+
+import (
+	"github.com/docker/docker/api/types/container"
+	"github.com/modfin/zdap/internal"
+)
+
+// ContainerResources returns the docker resources of a container limited by l. Swap is not allowed beyond the memory
+// limit, so that a container over its limit is killed rather than slowing down the host.
+func ContainerResources(l internal.Limits) container.Resources {
+	res := container.Resources{
+		NanoCPUs:    int64(l.CPUs * 1e9),
+		Memory:      int64(l.Memory.Bytes()),
+		MemorySwap:  int64(l.Memory.Bytes()),
+		BlkioWeight: l.BlkioWeight,
+	}
+	if l.Pids > 0 {
+		res.PidsLimit = &l.Pids
+	}
+	return res
+}
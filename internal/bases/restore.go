@@ -0,0 +1,414 @@
+package bases
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/modfin/zdap/internal"
+	"github.com/modfin/zdap/internal/secrets"
+)
+
+// restoreDir is where the dir of the retrieved file is mounted in the base container by the pg_restore and psql drivers
+const restoreDir = "/zdap-restore"
+
+const defaultRestoreUser = "postgres"
+const defaultRestoreDatabase = "postgres"
+
+// restoreMount mounts the dir of file read only in the base container
+func restoreMount(file string) mount.Mount {
+	return mount.Mount{Type: mount.TypeBind, Source: filepath.Dir(file), Target: restoreDir, ReadOnly: true}
+}
+
+// restoreLogical restores the dump file into the running base container with pg_restore or psql
+func restoreLogical(ctx context.Context, docker *client.Client, containerID string, file string, rs internal.Restore, secrets *secrets.Store) error {
+	out := secrets.Writer(os.Stdout)
+	defer out.Close()
+
+	setup := setupSQL(rs)
+	if setup != "" {
+		code, err := execInContainer(ctx, docker, containerID, []string{"psql", "-v", "ON_ERROR_STOP=1", "--quiet", "--username", restoreUser(rs), "--dbname", defaultRestoreDatabase}, setup, out)
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("could not create the roles and database to restore into, psql exited with %d", code)
+		}
+	}
+
+	code, err := execInContainer(ctx, docker, containerID, restoreCmd(rs, restoreDir+"/"+filepath.Base(file)), "", out)
+	if err != nil {
+		return err
+	}
+	if code != 0 && !rs.IgnoreErrors {
+		return fmt.Errorf("could not restore %s, %s exited with %d", file, rs.Driver, code)
+	}
+	if code != 0 {
+		fmt.Printf("%s exited with %d, ignoring the errors of the restore\n", rs.Driver, code)
+	}
+	return nil
+}
+
+func restoreUser(rs internal.Restore) string {
+	if rs.User == "" {
+		return defaultRestoreUser
+	}
+	return rs.User
+}
+
+func restoreDatabase(rs internal.Restore) string {
+	if rs.Database == "" {
+		return defaultRestoreDatabase
+	}
+	return rs.Database
+}
+
+// gunzipPipe decompresses the file $0 into the command "$@" and fails if either of them fails. The images may only
+// have a POSIX sh without pipefail, so the exit codes are collected through fd 3 while the output of the command goes
+// to the original stdout through fd 4.
+const gunzipPipe = `{ codes=$({ { gzip -dc "$0" || echo $? >&3; } | { "$@" || echo $? >&3; } >&4; } 3>&1); } 4>&1; set -- $codes; exit "${1:-0}"`
+
+// restoreCmd returns the command restoring the file at path in the container
+func restoreCmd(rs internal.Restore, path string) []string {
+	if rs.Driver == internal.RestorePgRestore {
+		jobs := rs.Jobs
+		if jobs == 0 {
+			jobs = runtime.NumCPU()
+		}
+		cmd := []string{"pg_restore", "--username", restoreUser(rs), "--dbname", restoreDatabase(rs), "--jobs", strconv.Itoa(jobs)}
+		if rs.NoOwner {
+			cmd = append(cmd, "--no-owner")
+		}
+		if !rs.IgnoreErrors {
+			cmd = append(cmd, "--exit-on-error")
+		}
+		return append(append(cmd, rs.Args...), path)
+	}
+
+	psql := []string{"psql", "--quiet", "--username", restoreUser(rs), "--dbname", restoreDatabase(rs)}
+	if !rs.IgnoreErrors {
+		psql = append(psql, "-v", "ON_ERROR_STOP=1")
+	}
+	psql = append(psql, rs.Args...)
+	if strings.HasSuffix(path, ".gz") {
+		return append([]string{"sh", "-c", gunzipPipe, path}, psql...)
+	}
+	return append(psql, "--file", path)
+}
+
+// setupSQL creates the roles and the database to restore into, if they don't exist
+func setupSQL(rs internal.Restore) string {
+	var b strings.Builder
+	for _, role := range rs.Roles {
+		fmt.Fprintf(&b, "DO $$BEGIN CREATE ROLE %s; EXCEPTION WHEN duplicate_object THEN NULL; END$$;\n", quoteIdent(role))
+	}
+	if db := restoreDatabase(rs); db != defaultRestoreDatabase {
+		fmt.Fprintf(&b, "SELECT %s WHERE NOT EXISTS (SELECT FROM pg_database WHERE datname = %s)\\gexec\n",
+			quoteLiteral("CREATE DATABASE "+quoteIdent(db)), quoteLiteral(db))
+	}
+	return b.String()
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func quoteLiteral(s string) string {
+	return `'` + strings.ReplaceAll(s, `'`, `''`) + `'`
+}
+
+// execInContainer runs cmd in the container and returns its exit code, the output is written to out
+func execInContainer(ctx context.Context, docker *client.Client, containerID string, cmd []string, stdin string, out io.Writer) (int, error) {
+	exec, err := docker.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		Cmd:          cmd,
+		AttachStdin:  stdin != "",
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not create exec of %s, %w", cmd[0], err)
+	}
+	attach, err := docker.ContainerExecAttach(ctx, exec.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("could not attach to exec of %s, %w", cmd[0], err)
+	}
+	defer attach.Close()
+
+	if stdin != "" {
+		go func() {
+			_, _ = io.WriteString(attach.Conn, stdin)
+			_ = attach.CloseWrite()
+		}()
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(out, out, attach.Reader)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		return 0, fmt.Errorf("%s did not finish, %w", cmd[0], ctx.Err())
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not read output of %s, %w", cmd[0], err)
+	}
+
+	inspect, err := docker.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return 0, fmt.Errorf("could not inspect exec of %s, %w", cmd[0], err)
+	}
+	return inspect.ExitCode, nil
+}
+
+// restorePhysical restores a physical backup into dataDir before the base container is started. The backup is a tar,
+// optionally gzipped, a dir holding the base.tar and pg_wal.tar of pg_basebackup --format=tar, or a plain copy of a
+// data dir.
+func restorePhysical(ctx context.Context, file string, dataDir string, rs internal.Restore) error {
+	uid, gid, err := parseOwner(rs.Owner)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return fmt.Errorf("could not read backup, %w", err)
+	}
+
+	switch {
+	case !info.IsDir():
+		err = extractTar(ctx, file, dataDir)
+	case findArchive(file, "base") != "":
+		err = extractTar(ctx, findArchive(file, "base"), dataDir)
+		if err == nil && findArchive(file, "pg_wal") != "" {
+			err = extractTar(ctx, findArchive(file, "pg_wal"), filepath.Join(dataDir, "pg_wal"))
+		}
+	default:
+		err = copyTree(ctx, file, dataDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the backup may be taken from a running server, which must not be mistaken for this one
+	for _, name := range []string{"postmaster.pid", "postmaster.opts"} {
+		err = os.Remove(filepath.Join(dataDir, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	err = filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+	if err != nil {
+		return fmt.Errorf("could not change owner of restored files, %w", err)
+	}
+	// postgres refuses to start unless the data dir is private
+	return os.Chmod(dataDir, 0700)
+}
+
+func parseOwner(owner string) (int, int, error) {
+	if owner == "" {
+		owner = internal.DefaultRestoreOwner
+	}
+	u, g, ok := strings.Cut(owner, ":")
+	uid, uerr := strconv.Atoi(u)
+	gid, gerr := strconv.Atoi(g)
+	if !ok || uerr != nil || gerr != nil || uid < 0 || gid < 0 {
+		return 0, 0, fmt.Errorf("owner must be written as <uid>:<gid>, got '%s'", owner)
+	}
+	return uid, gid, nil
+}
+
+// findArchive returns the path of name.tar or name.tar.gz in dir, or an empty string
+func findArchive(dir string, name string) string {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz"} {
+		path := filepath.Join(dir, name+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// extractTar extracts the tar, gzipped or not, at file into dir
+func extractTar(ctx context.Context, file string, dir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("could not open backup, %w", err)
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReaderSize(f, 1<<20)
+	if magic, _ := r.(*bufio.Reader).Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("could not read gzipped backup, %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	dir = filepath.Clean(dir)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		if ctx.Err() != nil {
+			return fmt.Errorf("could not extract %s, %w", file, ctx.Err())
+		}
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read %s, %w", file, err)
+		}
+		target := filepath.Join(dir, hdr.Name)
+		if !within(dir, target) {
+			return fmt.Errorf("%s contains '%s', which is outside of the data dir", file, hdr.Name)
+		}
+		// entries are never written through symlinks, which could point anywhere on the host
+		err = noSymlinkParents(dir, target)
+		if err == nil {
+			err = removeSymlink(target)
+		}
+		if err != nil {
+			return fmt.Errorf("could not extract '%s', %w", hdr.Name, err)
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode)
+		case tar.TypeReg:
+			err = writeFile(target, tr, mode)
+		case tar.TypeSymlink:
+			// symlinks are resolved relative to the dir of the link
+			if filepath.IsAbs(hdr.Linkname) || !within(dir, filepath.Join(filepath.Dir(target), hdr.Linkname)) {
+				return fmt.Errorf("%s contains the symlink '%s' to '%s', which is outside of the data dir", file, hdr.Name, hdr.Linkname)
+			}
+			err = os.Symlink(hdr.Linkname, target)
+		case tar.TypeLink:
+			source := filepath.Join(dir, hdr.Linkname)
+			if filepath.IsAbs(hdr.Linkname) || !within(dir, source) {
+				return fmt.Errorf("%s contains the hard link '%s' to '%s', which is outside of the data dir", file, hdr.Name, hdr.Linkname)
+			}
+			err = noSymlinkParents(dir, source)
+			if err == nil {
+				err = os.Link(source, target)
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not extract '%s', %w", hdr.Name, err)
+		}
+	}
+}
+
+// within reports if the clean path is dir or inside it
+func within(dir string, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// noSymlinkParents returns an error if any dir between dir and path is a symlink
+func noSymlinkParents(dir string, path string) error {
+	rel, err := filepath.Rel(dir, filepath.Dir(path))
+	if err != nil || rel == "." {
+		return err
+	}
+	parent := dir
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		parent = filepath.Join(parent, name)
+		info, err := os.Lstat(parent)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("'%s' is a symlink", parent)
+		}
+	}
+	return nil
+}
+
+// removeSymlink removes path if it is a symlink, so that it is replaced rather than followed
+func removeSymlink(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+func writeFile(path string, r io.Reader, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// copyTree copies the files, dirs and symlinks of src into dst
+func copyTree(ctx context.Context, src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("could not copy %s, %w", src, ctx.Err())
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return writeFile(target, f, info.Mode().Perm())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,189 @@
+package bases
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/modfin/zdap/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTar(t *testing.T, path string, gzipped bool, files map[string]string) {
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	var w io.Writer = f
+	if gzipped {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+	for name, content := range files {
+		assert.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(content))}))
+		_, err = tw.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+}
+
+func Test_restorePhysical(t *testing.T) {
+	owner := internal.Restore{Owner: fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())}
+	read := func(path string) string {
+		b, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		return string(b)
+	}
+
+	// pg_basebackup --format=tar --gzip writes base.tar.gz and pg_wal.tar.gz to a dir
+	backup := t.TempDir()
+	writeTar(t, filepath.Join(backup, "base.tar.gz"), true, map[string]string{"PG_VERSION": "15\n", "global/pg_control": "control", "postmaster.pid": "42"})
+	writeTar(t, filepath.Join(backup, "pg_wal.tar"), false, map[string]string{"000000010000000000000001": "wal"})
+	data := t.TempDir()
+	assert.NoError(t, restorePhysical(context.Background(), backup, data, owner))
+	assert.Equal(t, "15\n", read(filepath.Join(data, "PG_VERSION")))
+	assert.Equal(t, "wal", read(filepath.Join(data, "pg_wal", "000000010000000000000001")))
+	_, err := os.Stat(filepath.Join(data, "postmaster.pid"))
+	assert.True(t, os.IsNotExist(err), "the pid file of the source server must be removed")
+	info, err := os.Stat(data)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	// a plain copy of a data dir
+	plain := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(plain, "global"), 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(plain, "global", "pg_control"), []byte("control"), 0600))
+	data = t.TempDir()
+	assert.NoError(t, restorePhysical(context.Background(), plain, data, owner))
+	assert.Equal(t, "control", read(filepath.Join(data, "global", "pg_control")))
+
+	archive := filepath.Join(t.TempDir(), "evil.tar")
+	writeTar(t, archive, false, map[string]string{"../escaped": "x"})
+	assert.ErrorContains(t, restorePhysical(context.Background(), archive, t.TempDir(), owner), "outside of the data dir")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, restorePhysical(ctx, backup, t.TempDir(), owner), context.Canceled)
+}
+
+func Test_extractTar_links(t *testing.T) {
+	extract := func(entries ...tar.Header) (string, error) {
+		archive := filepath.Join(t.TempDir(), "backup.tar")
+		f, err := os.Create(archive)
+		assert.NoError(t, err)
+		tw := tar.NewWriter(f)
+		for _, hdr := range entries {
+			hdr.Mode = 0600
+			if hdr.Typeflag == tar.TypeReg {
+				hdr.Size = int64(len(hdr.Name))
+			}
+			assert.NoError(t, tw.WriteHeader(&hdr))
+			if hdr.Typeflag == tar.TypeReg {
+				_, err = tw.Write([]byte(hdr.Name))
+				assert.NoError(t, err)
+			}
+		}
+		assert.NoError(t, tw.Close())
+		assert.NoError(t, f.Close())
+		data := filepath.Join(t.TempDir(), "data")
+		return data, extractTar(context.Background(), archive, data)
+	}
+	reg := func(name string) tar.Header { return tar.Header{Name: name, Typeflag: tar.TypeReg} }
+	symlink := func(name, target string) tar.Header {
+		return tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target}
+	}
+	hardlink := func(name, target string) tar.Header {
+		return tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: target}
+	}
+
+	data, err := extract(reg("global/pg_control"), symlink("control", "global/pg_control"), symlink("global/self", "../global"), hardlink("copy", "global/pg_control"))
+	assert.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(data, "control"))
+	assert.NoError(t, err)
+	assert.Equal(t, "global/pg_control", string(b))
+	b, err = os.ReadFile(filepath.Join(data, "copy"))
+	assert.NoError(t, err)
+	assert.Equal(t, "global/pg_control", string(b))
+
+	_, err = extract(symlink("evil", "/etc"))
+	assert.ErrorContains(t, err, "outside of the data dir")
+	_, err = extract(symlink("global/evil", "../../outside"))
+	assert.ErrorContains(t, err, "outside of the data dir")
+	_, err = extract(hardlink("evil", "/etc/passwd"))
+	assert.ErrorContains(t, err, "outside of the data dir")
+	_, err = extract(hardlink("evil", "../outside"))
+	assert.ErrorContains(t, err, "outside of the data dir")
+
+	// symlinks inside the data dir are never followed when extracting
+	_, err = extract(symlink("here", "."), reg("here/file"))
+	assert.ErrorContains(t, err, "is a symlink")
+	_, err = extract(reg("PG_VERSION"), symlink("here", "."), hardlink("version", "here/PG_VERSION"))
+	assert.ErrorContains(t, err, "is a symlink")
+	data, err = extract(reg("a"), symlink("link", "a"), reg("link"))
+	assert.NoError(t, err)
+	info, err := os.Lstat(filepath.Join(data, "link"))
+	assert.NoError(t, err)
+	assert.True(t, info.Mode().IsRegular(), "a file replaces a symlink rather than being written through it")
+}
+
+func Test_restoreCmd(t *testing.T) {
+	rs := internal.Restore{Driver: internal.RestorePgRestore, Database: "users", Jobs: 8, NoOwner: true}
+	assert.Equal(t, []string{"pg_restore", "--username", "postgres", "--dbname", "users", "--jobs", "8", "--no-owner", "--exit-on-error", "/zdap-restore/users.dump"},
+		restoreCmd(rs, "/zdap-restore/users.dump"))
+
+	rs = internal.Restore{Driver: internal.RestorePsql, User: "admin", IgnoreErrors: true}
+	assert.Equal(t, []string{"psql", "--quiet", "--username", "admin", "--dbname", "postgres", "--file", "/zdap-restore/users.sql"},
+		restoreCmd(rs, "/zdap-restore/users.sql"))
+	assert.Equal(t, []string{"sh", "-c", gunzipPipe, "/zdap-restore/users.sql.gz", "psql", "--quiet", "--username", "admin", "--dbname", "postgres"},
+		restoreCmd(rs, "/zdap-restore/users.sql.gz"))
+}
+
+func Test_gunzipPipe(t *testing.T) {
+	dir := t.TempDir()
+	dump := filepath.Join(dir, "users.sql.gz")
+	f, err := os.Create(dump)
+	assert.NoError(t, err)
+	gz := gzip.NewWriter(f)
+	_, err = gz.Write([]byte("SELECT 1;\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+	assert.NoError(t, f.Close())
+	corrupt := filepath.Join(dir, "corrupt.sql.gz")
+	assert.NoError(t, os.WriteFile(corrupt, []byte("SELECT 1;\n"), 0600))
+
+	run := func(path string, psql ...string) (string, int) {
+		cmd := restoreCmd(internal.Restore{}, path)
+		out, err := exec.Command(cmd[0], append(cmd[1:4], psql...)...).Output()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return string(out), exitErr.ExitCode()
+		}
+		assert.NoError(t, err)
+		return string(out), 0
+	}
+
+	out, code := run(dump, "cat")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "SELECT 1;\n", out)
+
+	_, code = run(corrupt, "cat")
+	assert.NotEqual(t, 0, code, "a failing gzip must fail the restore")
+
+	_, code = run(dump, "sh", "-c", "cat >/dev/null; exit 3")
+	assert.Equal(t, 3, code, "a failing psql must fail the restore with its exit code")
+}
+
+func Test_setupSQL(t *testing.T) {
+	assert.Equal(t, "", setupSQL(internal.Restore{}))
+	assert.Equal(t, `DO $$BEGIN CREATE ROLE "app"; EXCEPTION WHEN duplicate_object THEN NULL; END$$;
+SELECT 'CREATE DATABASE "o''brien"' WHERE NOT EXISTS (SELECT FROM pg_database WHERE datname = 'o''brien')\gexec
+`, setupSQL(internal.Restore{Roles: []string{"app"}, Database: "o'brien"}))
+}
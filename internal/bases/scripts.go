@@ -0,0 +1,119 @@
+package bases
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/modfin/zdap/internal/secrets"
+)
+
+// The environment variables given to the retrieval and creation scripts, next to the script_env of the resource
+const (
+	EnvResource         = "ZDAP_RESOURCE"          // the name of the resource
+	EnvPhase            = "ZDAP_PHASE"             // retrieval, creation or update
+	EnvConfigDir        = "ZDAP_CONFIG_DIR"        // the dir of the resource config
+	EnvWorkDir          = "ZDAP_WORK_DIR"          // a temporary dir that is removed once the base is created
+	EnvDataset          = "ZDAP_DATASET"           // the name of the base dataset
+	EnvDatasetPath      = "ZDAP_DATASET_PATH"      // the mount path of the base dataset
+	EnvContainerID      = "ZDAP_CONTAINER_ID"      // the id of the container the base is restored into
+	EnvContainerName    = "ZDAP_CONTAINER_NAME"    // the name of the container the base is restored into
+	EnvDBPort           = "ZDAP_DB_PORT"           // the port of the database in the container
+	EnvTimestamp        = "ZDAP_TIMESTAMP"         // the creation time of the base
+	EnvPreviousSnap     = "ZDAP_PREVIOUS_SNAP"     // the creation time of the latest snap of the resource, if any
+	EnvPreviousMetadata = "ZDAP_PREVIOUS_METADATA" // the json metadata of the latest snap of the resource, if any
+	EnvFile             = "ZDAP_FILE"              // creation only, the file reported by the retrieval script
+	EnvMetadata         = "ZDAP_METADATA"          // creation only, the json metadata reported by the retrieval script
+)
+
+// ScriptResult is what a script may report by printing it as a json object on the last line of stdout. Scripts
+// that don't print json are assumed to print the path of the retrieved file, as before.
+type ScriptResult struct {
+	File     string            `json:"file,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// parseScriptOutput parses the stdout of a script
+func parseScriptOutput(stdout string) (ScriptResult, error) {
+	out := strings.TrimSpace(stdout)
+	last := out[strings.LastIndexByte(out, '\n')+1:]
+	if !strings.HasPrefix(last, "{") {
+		return ScriptResult{File: out}, nil
+	}
+	var res ScriptResult
+	err := json.Unmarshal([]byte(last), &res)
+	if err != nil {
+		return res, fmt.Errorf("could not parse json result of script, %w", err)
+	}
+	return res, nil
+}
+
+// script runs a retrieval or creation script
+type script struct {
+	path    string
+	env     []string
+	timeout time.Duration
+	secrets *secrets.Store
+}
+
+func (s script) run(ctx context.Context, args ...string) (ScriptResult, error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, s.path, args...)
+	cmd.Env = append(os.Environ(), s.env...)
+	// scripts tend to start children of their own, so the whole process group is killed on timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 10 * time.Second
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	stderr := s.secrets.Writer(os.Stderr) // scripts are given secrets, keep them out of the logs
+	defer stderr.Close()
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ScriptResult{}, fmt.Errorf("script %s timed out after %v", s.path, s.timeout)
+	}
+	if err != nil {
+		return ScriptResult{}, fmt.Errorf("script %s failed, %w", s.path, err)
+	}
+	return parseScriptOutput(out.String())
+}
+
+// envVar formats a KEY=value environment variable
+func envVar(key, value string) string {
+	return key + "=" + value
+}
+
+// parseMetadata parses metadata stored on a snap, metadata that can't be parsed is ignored
+func parseMetadata(s string) map[string]string {
+	metadata := map[string]string{}
+	if s != "" {
+		_ = json.Unmarshal([]byte(s), &metadata)
+	}
+	return metadata
+}
+
+// metadataJSON marshals metadata, empty metadata is an empty string
+func metadataJSON(metadata map[string]string) string {
+	if len(metadata) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(metadata)
+	return string(b)
+}
@@ -0,0 +1,65 @@
+package bases
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseScriptOutput(t *testing.T) {
+	tests := []struct {
+		stdout string
+		want   ScriptResult
+	}{
+		{stdout: "/tmp/dump.sql.gz\n", want: ScriptResult{File: "/tmp/dump.sql.gz"}},
+		{stdout: "downloading...\n{\"file\": \"/tmp/dump\", \"metadata\": {\"lsn\": \"0/1A\"}}\n", want: ScriptResult{File: "/tmp/dump", Metadata: map[string]string{"lsn": "0/1A"}}},
+		{stdout: "", want: ScriptResult{}},
+	}
+	for _, tt := range tests {
+		got, err := parseScriptOutput(tt.stdout)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, got)
+	}
+	_, err := parseScriptOutput("{\"file\": ")
+	assert.Error(t, err)
+}
+
+func writeScript(t *testing.T, body string) string {
+	path := filepath.Join(t.TempDir(), "script.sh")
+	assert.NoError(t, os.WriteFile(path, []byte("#!/usr/bin/env bash\n"+body), 0755))
+	return path
+}
+
+func Test_script_run(t *testing.T) {
+	s := script{
+		path: writeScript(t, `echo "{\"file\": \"$ZDAP_WORK_DIR/$1\", \"metadata\": {\"phase\": \"$ZDAP_PHASE\"}}"`),
+		env:  []string{envVar(EnvWorkDir, "/work"), envVar(EnvPhase, "retrieval")},
+	}
+	res, err := s.run(context.Background(), "dump")
+	assert.NoError(t, err)
+	assert.Equal(t, ScriptResult{File: "/work/dump", Metadata: map[string]string{"phase": "retrieval"}}, res)
+
+	_, err = script{path: writeScript(t, "exit 3")}.run(context.Background())
+	assert.ErrorContains(t, err, "exit status 3")
+}
+
+func Test_script_runTimeout(t *testing.T) {
+	// the child sleep keeps stdout open, it must be killed along with the script
+	s := script{path: writeScript(t, "sleep 30 & wait"), timeout: 200 * time.Millisecond}
+	start := time.Now()
+	_, err := s.run(context.Background())
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "timed out"), err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func Test_parseMetadata(t *testing.T) {
+	assert.Equal(t, map[string]string{}, parseMetadata(""))
+	assert.Equal(t, map[string]string{"lsn": "0/1A"}, parseMetadata(metadataJSON(map[string]string{"lsn": "0/1A"})))
+	assert.Equal(t, map[string]string{}, parseMetadata("not json"))
+}
@@ -0,0 +1,82 @@
+package bases
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/modfin/zdap"
+	"github.com/modfin/zdap/internal/zfs"
+)
+
+// the build status of every resource, persisted on the pool so that failures survive a restart of zdapd
+var statusMutex sync.Mutex
+var statuses = map[string]*zdap.BuildStatus{}
+
+// statusProp is the pool property holding the build status of resource, resource names are validated to be valid in
+// zfs property names
+func statusProp(resource string) string {
+	return zfs.PropBuild + ":" + resource
+}
+
+// Status returns the build status of the latest creation of a base of resource, nil if zdapd has never created one
+func Status(z *zfs.ZFS, resource string) *zdap.BuildStatus {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+
+	s := loadStatus(z, resource)
+	if s == nil {
+		return nil
+	}
+	cp := *s
+	return &cp
+}
+
+// PersistedStatus reads the build status of resource from the pool, bypassing the status kept by this process. It shows
+// the builds of other zdapd processes sharing the pool, e.g. zdapd create snap.
+func PersistedStatus(z *zfs.ZFS, resource string) *zdap.BuildStatus {
+	v, err := z.GetPoolUserProperty(statusProp(resource))
+	if err != nil || v == "" {
+		return nil
+	}
+	s := &zdap.BuildStatus{}
+	err = json.Unmarshal([]byte(v), s)
+	if err != nil {
+		fmt.Println("could not parse build status of", resource, err)
+		return nil
+	}
+	return s
+}
+
+// loadStatus returns the status of resource, read from the pool the first time it is asked for. statusMutex must be held.
+func loadStatus(z *zfs.ZFS, resource string) *zdap.BuildStatus {
+	s, ok := statuses[resource]
+	if ok || z == nil {
+		return s
+	}
+	s = PersistedStatus(z, resource)
+	statuses[resource] = s
+	return s
+}
+
+func setStatus(z *zfs.ZFS, resource string, update func(s *zdap.BuildStatus)) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+
+	s := loadStatus(z, resource)
+	if s == nil {
+		s = &zdap.BuildStatus{}
+		statuses[resource] = s
+	}
+	update(s)
+	if z == nil {
+		return
+	}
+	b, err := json.Marshal(s)
+	if err == nil {
+		err = z.SetPoolUserProperty(statusProp(resource), string(b))
+	}
+	if err != nil {
+		fmt.Println("could not persist build status of", resource, err)
+	}
+}
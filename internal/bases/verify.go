@@ -0,0 +1,113 @@
+package bases
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/client"
+	"github.com/modfin/zdap/internal"
+	"github.com/modfin/zdap/internal/secrets"
+	"github.com/modfin/zdap/internal/zfs"
+)
+
+// verifyCheck is a sql query which returns true if the base passes the check
+type verifyCheck struct {
+	name string
+	sql  string
+}
+
+// verifyChecks returns the sql checks of v, in the order they are run
+func verifyChecks(v internal.Verify) []verifyCheck {
+	var checks []verifyCheck
+	for _, t := range v.Tables {
+		checks = append(checks, verifyCheck{
+			name: fmt.Sprintf("table %s exists", t),
+			sql:  fmt.Sprintf("SELECT to_regclass(%s) IS NOT NULL", quoteLiteral(qualifiedIdent(t))),
+		})
+	}
+	tables := make([]string, 0, len(v.MinRows))
+	for t := range v.MinRows {
+		tables = append(tables, t)
+	}
+	sort.Strings(tables)
+	for _, t := range tables {
+		checks = append(checks, verifyCheck{
+			name: fmt.Sprintf("%s has at least %d rows", t, v.MinRows[t]),
+			sql:  fmt.Sprintf("SELECT count(*) >= %d FROM %s", v.MinRows[t], qualifiedIdent(t)),
+		})
+	}
+	for _, a := range v.Assertions {
+		checks = append(checks, verifyCheck{name: a, sql: a})
+	}
+	return checks
+}
+
+// qualifiedIdent quotes a table name, which may be qualified with its schema
+func qualifiedIdent(table string) string {
+	parts := strings.Split(table, ".")
+	for i, p := range parts {
+		parts[i] = quoteIdent(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// verifySQL runs the sql checks of v in the running base container
+func verifySQL(ctx context.Context, docker *client.Client, containerID string, v internal.Verify, secrets *secrets.Store) error {
+	user, database := v.User, v.Database
+	if user == "" {
+		user = defaultRestoreUser
+	}
+	if database == "" {
+		database = defaultRestoreDatabase
+	}
+	for _, check := range verifyChecks(v) {
+		var out bytes.Buffer
+		cmd := []string{"psql", "--no-psqlrc", "--tuples-only", "--no-align", "-v", "ON_ERROR_STOP=1", "--username", user, "--dbname", database, "--command", check.sql}
+		code, err := execInContainer(ctx, docker, containerID, cmd, "", &out)
+		if err != nil {
+			return fmt.Errorf("could not verify that %s, %w", check.name, err)
+		}
+		got := lastLine(secrets.Redact(out.String()))
+		if code != 0 {
+			return fmt.Errorf("could not verify that %s, psql exited with %d, %s", check.name, code, got)
+		}
+		if got != "t" {
+			return fmt.Errorf("verification failed, expected that %s", check.name)
+		}
+		fmt.Println("Verified that", check.name)
+	}
+	return nil
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// verifySize fails the base name if it is more than maxShrink percent smaller than the previous snap
+func verifySize(z *zfs.ZFS, previousSnap string, name string, maxShrink int) error {
+	previous, err := z.LogicalSize(previousSnap)
+	if err != nil {
+		return fmt.Errorf("could not get size of %s, %w", previousSnap, err)
+	}
+	current, err := z.LogicalSize(name)
+	if err != nil {
+		return fmt.Errorf("could not get size of %s, %w", name, err)
+	}
+	return checkShrink(previous, current, maxShrink)
+}
+
+func checkShrink(previous uint64, current uint64, maxShrink int) error {
+	if maxShrink <= 0 || previous == 0 || current >= previous {
+		return nil
+	}
+	shrink := (previous - current) * 100 / previous
+	if shrink > uint64(maxShrink) {
+		return fmt.Errorf("verification failed, the base is %d bytes, %d%% smaller than the %d bytes of the previous base, at most %d%% is allowed",
+			current, shrink, previous, maxShrink)
+	}
+	return nil
+}
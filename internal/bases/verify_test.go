@@ -0,0 +1,31 @@
+package bases
+
+import (
+	"testing"
+
+	"github.com/modfin/zdap/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_verifyChecks(t *testing.T) {
+	checks := verifyChecks(internal.Verify{
+		Tables:     []string{"public.users"},
+		MinRows:    map[string]int64{"orders": 10, "events": 0},
+		Assertions: []string{"SELECT max(created_at) > now() - interval '2 days' FROM orders"},
+	})
+	assert.Equal(t, []verifyCheck{
+		{name: "table public.users exists", sql: `SELECT to_regclass('"public"."users"') IS NOT NULL`},
+		{name: "events has at least 0 rows", sql: `SELECT count(*) >= 0 FROM "events"`},
+		{name: "orders has at least 10 rows", sql: `SELECT count(*) >= 10 FROM "orders"`},
+		{name: "SELECT max(created_at) > now() - interval '2 days' FROM orders", sql: "SELECT max(created_at) > now() - interval '2 days' FROM orders"},
+	}, checks)
+	assert.Empty(t, verifyChecks(internal.Verify{}))
+}
+
+func Test_checkShrink(t *testing.T) {
+	assert.NoError(t, checkShrink(1000, 800, 20))
+	assert.NoError(t, checkShrink(1000, 2000, 20))
+	assert.NoError(t, checkShrink(1000, 0, 0), "the size is not checked without max_shrink")
+	assert.ErrorContains(t, checkShrink(1000, 790, 20), "21% smaller")
+	assert.ErrorContains(t, checkShrink(1000, 0, 99), "100% smaller", "an empty base must be caught")
+}
@@ -13,16 +13,29 @@ import (
 	"time"
 )
 
+// claimRetryAfter is the retry hint given to clients when no pooled clone could be claimed
+const claimRetryAfter = 30 * time.Second
+
 type ClonePool struct {
-	resource        internal.Resource
-	cloneContext    *cloning.CloneContext
-	ClonesAvailable int
-	claimLock       sync.Mutex
-	gc              chan struct{}
+	name      string
+	claimLock sync.Mutex
+	gc        chan struct{}
+	stop      chan struct{}
+
+	mu           sync.RWMutex // guards the fields below, which change when resources are reloaded
+	resource     internal.Resource
+	cloneContext *cloning.CloneContext
+	available    int
 }
 
 func NewClonePool(resource internal.Resource, cloneContext *cloning.CloneContext) *ClonePool {
-	return &ClonePool{resource: resource, cloneContext: cloneContext, gc: make(chan struct{}, 1)}
+	return &ClonePool{
+		name:         resource.Name,
+		resource:     resource,
+		cloneContext: cloneContext,
+		gc:           make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+	}
 }
 
 func (c *ClonePool) Start() {
@@ -31,12 +44,53 @@ func (c *ClonePool) Start() {
 			select {
 			case <-time.After(time.Hour):
 			case <-c.gc:
+			case <-c.stop:
+				return
 			}
 			c.action()
 		}
 	}()
 }
 
+// Stop stops maintaining the pool, the clones in the pool are left as they are
+func (c *ClonePool) Stop() {
+	close(c.stop)
+}
+
+// Update replaces the resource config of the pool and resizes it, clones already in the pool are left as they are
+func (c *ClonePool) Update(resource internal.Resource, cloneContext *cloning.CloneContext) {
+	c.mu.Lock()
+	c.resource = resource
+	c.cloneContext = cloneContext
+	c.mu.Unlock()
+	c.TriggerGC()
+}
+
+// Available returns the number of clones that could be claimed the last time the pool was checked
+func (c *ClonePool) Available() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.available
+}
+
+func (c *ClonePool) addAvailable(n int) {
+	c.mu.Lock()
+	c.available += n
+	c.mu.Unlock()
+}
+
+func (c *ClonePool) config() internal.ClonePoolConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.resource.ClonePool
+}
+
+func (c *ClonePool) context() *cloning.CloneContext {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cloneContext
+}
+
 func (c *ClonePool) TriggerGC() {
 	select {
 	case c.gc <- struct{}{}:
@@ -46,7 +100,8 @@ func (c *ClonePool) TriggerGC() {
 
 func (c *ClonePool) action() {
 
-	dss, err := c.cloneContext.Z.Open()
+	config := c.config()
+	dss, err := c.context().Z.Open()
 	if err != nil {
 		fmt.Printf("error trying to open z, error: %s\n", err.Error())
 		return
@@ -59,7 +114,7 @@ func (c *ClonePool) action() {
 		return
 	}
 
-	if c.resource.ClonePool.ResetOnNewSnap {
+	if config.ResetOnNewSnap {
 		err = c.expireClonesFromOldSnaps(dss)
 		if err != nil {
 			fmt.Printf("could not expire old clones, error %s", err)
@@ -70,14 +125,14 @@ func (c *ClonePool) action() {
 	available := slicez.Filter(nonExpiredClones, func(clone servermodel.ServerInternalClone) bool {
 		return clone.ExpiresAt == nil && clone.Healthy
 	})
-	c.claimLock.Lock()
-	c.ClonesAvailable = len(available)
-	c.claimLock.Unlock()
+	c.mu.Lock()
+	c.available = len(available)
+	c.mu.Unlock()
 
 	nbrClones := len(nonExpiredClones)
-	clonesToAdd := c.resource.ClonePool.MinClones - len(available)
-	if nbrClones+clonesToAdd > c.resource.ClonePool.MaxClones {
-		clonesToAdd = c.resource.ClonePool.MaxClones - nbrClones
+	clonesToAdd := config.MinClones - len(available)
+	if nbrClones+clonesToAdd > config.MaxClones {
+		clonesToAdd = config.MaxClones - nbrClones
 	}
 
 	for i := 0; i < clonesToAdd; i++ {
@@ -87,9 +142,7 @@ func (c *ClonePool) action() {
 			continue
 		}
 		// may be off a tiny bit of time
-		c.claimLock.Lock()
-		c.ClonesAvailable++
-		c.claimLock.Unlock()
+		c.addAvailable(1)
 	}
 
 }
@@ -103,13 +156,13 @@ func (c *ClonePool) expireClonesFromOldSnaps(dss *zfs.Dataset) error {
 		return err
 	}
 
-	latestSnap, err := c.cloneContext.GetLatestResourceSnap(dss, c.resource.Name)
+	defaultSnap, err := c.context().GetDefaultResourceSnap(dss, c.name)
 	if err != nil {
 		return err
 	}
 
 	slicez.ForEach(pooledClones, func(a servermodel.ServerInternalClone) {
-		if a.SnappedAt != latestSnap.CreatedAt {
+		if a.SnappedAt != defaultSnap.CreatedAt {
 			err = c.expire(dss, a.Name)
 			if err != nil {
 				log.Errorf("Error when expiring clone %s", err)
@@ -134,22 +187,22 @@ func (c *ClonePool) getAvailableClones(dss *zfs.Dataset) ([]servermodel.ServerIn
 }
 
 func (c *ClonePool) addCloneToPool(dss *zfs.Dataset) (*zdap.PublicClone, error) {
-	snap, err := c.cloneContext.GetLatestResourceSnap(dss, c.resource.Name)
+	snap, err := c.context().GetDefaultResourceSnap(dss, c.name)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Infof("Adding clone to %s pool", c.resource.Name)
-	return c.cloneContext.CloneResourcePooled(dss, "zdapd", c.resource.Name, snap.CreatedAt)
+	log.Infof("Adding clone to %s pool", c.name)
+	return c.context().CloneResourcePooled(dss, "zdapd", c.name, snap.CreatedAt)
 }
 
 func (c *ClonePool) readPooled(dss *zfs.Dataset) ([]servermodel.ServerInternalClone, error) {
-	clones, err := c.cloneContext.Z.ListClones(dss)
+	clones, err := c.context().Z.ListClones(dss)
 	if err != nil {
 		return nil, fmt.Errorf("could not list clones")
 	}
 	return slicez.Filter(clones, func(clone servermodel.ServerInternalClone) bool {
-		return clone.ClonePooled && clone.Resource == c.resource.Name
+		return clone.ClonePooled && clone.Resource == c.name
 	}), nil
 }
 
@@ -160,7 +213,7 @@ func (c *ClonePool) pruneExpired(dss *zfs.Dataset, clones []servermodel.ServerIn
 	})
 
 	for _, e := range expired {
-		err := c.cloneContext.DestroyClone(dss, e.Name)
+		err := c.context().DestroyClone(dss, e.Name)
 		if err != nil {
 			fmt.Printf("could not destroy clone %s, error: %s", e.Name, err.Error())
 		}
@@ -172,7 +225,7 @@ func (c *ClonePool) pruneExpired(dss *zfs.Dataset, clones []servermodel.ServerIn
 }
 
 func (c *ClonePool) Expire(claimId string) error {
-	dss, err := c.cloneContext.Z.Open()
+	dss, err := c.context().Z.Open()
 	if err != nil {
 		return err
 	}
@@ -191,10 +244,10 @@ func (c *ClonePool) expire(dss *zfs.Dataset, claimId string) error {
 	})
 
 	if len(match) == 0 {
-		return fmt.Errorf("found no matching clones")
+		return zdap.NewError(zdap.CodeNotFound, "found no pooled clone for claim %s", claimId).WithResource(c.name).WithClone(claimId)
 	}
 
-	err = c.cloneContext.Z.SetUserProperty(*match[0].Dataset, zfs.PropExpires, time.Now().Format(zfs.TimestampFormat))
+	err = c.context().Z.SetUserProperty(*match[0].Dataset, zfs.PropExpires, time.Now().Format(zfs.TimestampFormat))
 	if err != nil {
 		return err
 	}
@@ -206,7 +259,7 @@ func (c *ClonePool) Claim(timeout time.Duration, owner string) (servermodel.Serv
 	c.claimLock.Lock()
 	defer c.claimLock.Unlock()
 
-	dss, err := c.cloneContext.Z.Open()
+	dss, err := c.context().Z.Open()
 	if err != nil {
 		return servermodel.ServerInternalClone{}, err
 	}
@@ -223,7 +276,7 @@ func (c *ClonePool) Claim(timeout time.Duration, owner string) (servermodel.Serv
 		}
 
 		// reset dataset and query new clones
-		updatedDss, err := c.cloneContext.Z.Open()
+		updatedDss, err := c.context().Z.Open()
 		if err != nil {
 			return servermodel.ServerInternalClone{}, err
 		}
@@ -233,27 +286,31 @@ func (c *ClonePool) Claim(timeout time.Duration, owner string) (servermodel.Serv
 	}
 
 	if claim == nil {
-		return servermodel.ServerInternalClone{}, fmt.Errorf("could not find available clone %w", err)
+		return servermodel.ServerInternalClone{}, zdap.NewError(zdap.CodeUnavailable, "could not find available clone, %v", err).
+			WithResource(c.name).WithRetryAfter(claimRetryAfter)
 	}
 
-	maxTimeout := time.Duration(c.resource.ClonePool.ClaimMaxTimeoutSeconds) * time.Second
+	maxTimeout := time.Duration(c.config().ClaimMaxTimeoutSeconds) * time.Second
 	if timeout > maxTimeout {
 		timeout = maxTimeout
 	}
 	expires := time.Now().Add(timeout)
-	err = c.cloneContext.Z.SetUserProperty(*claim.Dataset, zfs.PropExpires, expires.Format(zfs.TimestampFormat))
+	err = c.context().Z.SetUserProperty(*claim.Dataset, zfs.PropExpires, expires.Format(zfs.TimestampFormat))
 	c.triggerGCAfterDelay(timeout)
 	if err != nil {
 		return servermodel.ServerInternalClone{}, err
 	}
-	c.ClonesAvailable--
-	err = c.cloneContext.Z.SetUserProperty(*claim.Dataset, zfs.PropOwner, owner)
+	c.addAvailable(-1)
+	err = c.context().Z.SetUserProperty(*claim.Dataset, zfs.PropOwner, owner)
 	if err != nil {
 		return servermodel.ServerInternalClone{}, err
 	}
+	if c.context().Proxy != nil {
+		c.context().Proxy.SetOwner(claim.Name, owner)
+	}
 
-	claim.APIPort = c.cloneContext.ApiPort
-	claim.Server = c.cloneContext.NetworkAddress
+	claim.APIPort = c.context().ApiPort
+	claim.Server = c.context().NetworkAddress
 	c.TriggerGC()
 	return *claim, nil
 }
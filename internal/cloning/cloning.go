@@ -2,26 +2,24 @@ package cloning
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
 	"fmt"
-	"io"
-	"os"
 	"regexp"
-	"sort"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/go-connections/nat"
 	"github.com/modfin/henry/slicez"
 	"github.com/modfin/zdap"
 	"github.com/modfin/zdap/internal"
 	"github.com/modfin/zdap/internal/bases"
+	"github.com/modfin/zdap/internal/ports"
+	"github.com/modfin/zdap/internal/proxy"
 	"github.com/modfin/zdap/internal/servermodel"
-	"github.com/modfin/zdap/internal/utils"
 	"github.com/modfin/zdap/internal/zfs"
 )
 
@@ -29,6 +27,8 @@ type CloneContext struct {
 	Resource  *internal.Resource
 	Docker    *client.Client
 	Z         *zfs.ZFS
+	Proxy     *proxy.Manager
+	Ports     *ports.Registry
 	ConfigDir string
 
 	NetworkAddress string
@@ -50,9 +50,12 @@ func (c *CloneContext) CloneResourceHandlePooling(dss *zfs.Dataset, owner string
 		return nil, fmt.Errorf("could not find resource %s", resourceName)
 	}
 
-	snapName := c.Z.GetDatasetSnapNameAt(resourceName, at)
+	snapName, err := c.snapNameAt(dss, resourceName, at)
+	if err != nil {
+		return nil, err
+	}
 
-	clone, err := createClone(dss, owner, snapName, r, c.Docker, c.Z, pooled)
+	clone, err := createClone(dss, owner, snapName, r, c.Docker, c.Z, c.Proxy, c.Ports, pooled)
 	if err != nil {
 		return nil, err
 	}
@@ -62,12 +65,32 @@ func (c *CloneContext) CloneResourceHandlePooling(dss *zfs.Dataset, owner string
 	return clone, nil
 }
 
+// snapNameAt returns the name of the snap of resourceName created at, snaps moved to an incremental base are not named
+// after the base they were created as
+func (c *CloneContext) snapNameAt(dss *zfs.Dataset, resourceName string, at time.Time) (string, error) {
+	snaps, err := c.GetResourceSnaps(dss, resourceName)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range snaps {
+		if s.CreatedAt.Format(zfs.TimestampFormat) != at.Format(zfs.TimestampFormat) {
+			continue
+		}
+		if s.Deprecated {
+			return "", zdap.NewError(zdap.CodeConflict, "snap %s is deprecated and can not be cloned, %s", s.Name, s.DeprecationReason).
+				WithResource(resourceName).WithSnap(at.Format(zfs.TimestampFormat))
+		}
+		return s.Name, nil
+	}
+	return c.Z.GetDatasetSnapNameAt(resourceName, at), nil
+}
+
 func (c *CloneContext) GetResourceSnaps(dss *zfs.Dataset, resourceName string) ([]servermodel.ServerInternalSnapshot, error) {
 	snaps, err := c.Z.ListSnaps(dss)
 	if err != nil {
 		return nil, err
 	}
-	snapReg, err := regexp.Compile(fmt.Sprintf("^zdap-%s-base-[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}.[0-9]{2}.[0-9]{2}@snap$", resourceName))
+	snapReg, err := regexp.Compile(fmt.Sprintf("^zdap-%s-base-[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}.[0-9]{2}.[0-9]{2}@snap(-[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}.[0-9]{2}.[0-9]{2})?$", regexp.QuoteMeta(resourceName)))
 	if err != nil {
 		return nil, err
 	}
@@ -81,35 +104,24 @@ func (c *CloneContext) GetResourceSnaps(dss *zfs.Dataset, resourceName string) (
 	return rsnap, nil
 }
 
-func (c *CloneContext) GetLatestResourceSnap(dss *zfs.Dataset, resourceName string) (servermodel.ServerInternalSnapshot, error) {
+// GetDefaultResourceSnap returns the snap new clones of resourceName are made from, see zdap.DefaultSnap
+func (c *CloneContext) GetDefaultResourceSnap(dss *zfs.Dataset, resourceName string) (servermodel.ServerInternalSnapshot, error) {
 	snaps, err := c.GetResourceSnaps(dss, resourceName)
 	if err != nil || snaps == nil {
 		return servermodel.ServerInternalSnapshot{}, err
 	}
 
-	sort.Slice(snaps, func(i, j int) bool {
-		return snaps[j].CreatedAt.Before(snaps[i].CreatedAt)
-	})
-
-	if len(snaps) == 0 {
+	i := zdap.DefaultSnap(slicez.Map(snaps, func(s servermodel.ServerInternalSnapshot) zdap.PublicSnap {
+		return s.PublicSnap
+	}))
+	if i < 0 {
 		return servermodel.ServerInternalSnapshot{}, fmt.Errorf("unable to find snap for %s", resourceName)
 	}
 
-	return snaps[0], nil
+	return snaps[i], nil
 }
 
-func createClone(dss *zfs.Dataset, owner string, snap string, r *internal.Resource, docker *client.Client, z *zfs.ZFS, clonePooled bool) (*zdap.PublicClone, error) {
-	net, err := bases.EnsureNetwork(docker)
-	if err != nil {
-		return nil, err
-	}
-
-	networkConfig := &network.NetworkingConfig{
-		EndpointsConfig: map[string]*network.EndpointSettings{
-			net.Name: {},
-		},
-	}
-
+func createClone(dss *zfs.Dataset, owner string, snap string, r *internal.Resource, docker *client.Client, z *zfs.ZFS, proxies *proxy.Manager, registry *ports.Registry, clonePooled bool) (*zdap.PublicClone, error) {
 	snaps, err := z.ListSnaps(dss)
 	if err != nil {
 		return nil, err
@@ -122,32 +134,114 @@ func createClone(dss *zfs.Dataset, owner string, snap string, r *internal.Resour
 		}
 	}
 	if len(candidate) == 0 {
-		return nil, errors.New("could not find snap")
+		return nil, zdap.NewError(zdap.CodeNotFound, "could not find snap %s", snap).WithResource(r.Name).WithSnap(snap)
 	}
 
 	fmt.Println("Creating clone from", candidate)
 
-	port, err := utils.GetFreePort()
+	port, release, err := registry.Reserve(owner, r.Name, clonePooled, func() ([]zdap.PublicClone, error) {
+		return assignedPorts(z)
+	})
 	if err != nil {
 		return nil, err
 	}
 	cloneName, path, err := z.CloneDataset(owner, candidate, port, clonePooled, r.CloneZfsProperties())
+	release()
 	if err != nil {
 		return nil, err
 	}
 	fmt.Println(" - clone name", cloneName)
 
-	// Pull zdap-proxy image
-	proxyImageName := "modfin/zdap-proxy:latest"
-	reader, err := docker.ImagePull(context.Background(), proxyImageName, image.PullOptions{})
+	var cloneLimits *internal.Limits
+	limits := r.CloneLimits()
+	if !limits.IsZero() {
+		cloneLimits = &limits
+		b, err := json.Marshal(limits)
+		if err != nil {
+			return nil, err
+		}
+		err = z.SetUserProperties(cloneName, map[string]string{zfs.PropLimits: string(b)})
+		if err != nil {
+			return nil, fmt.Errorf("could not set limits of %s, %w", cloneName, err)
+		}
+	}
+
+	err = startContainer(docker, r, owner, cloneName, path)
 	if err != nil {
 		return nil, err
 	}
-	_, err = io.Copy(os.Stdout, reader)
+
+	fmt.Println(" - db container name", cloneName)
+
+	err = proxies.Add(cloneName, port, owner, CloneTarget(docker, cloneName, r.Docker.Port))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println(" - db proxy", fmt.Sprintf("tcp://0.0.0.0:%d", port))
+
+	dates := zfs.TimeReg.FindAll([]byte(cloneName), -1)
+	if len(dates) != 2 {
+		return nil, fmt.Errorf("did not find 2 snap dates in clone name, got %d", len(dates))
+	}
+	snappedAt, err := time.Parse(zfs.TimestampFormat, string(dates[0]))
+	if err != nil {
+		return nil, err
+	}
+	createdAt, err := time.Parse(zfs.TimestampFormat, string(dates[1]))
 	if err != nil {
 		return nil, err
 	}
 
+	// the clone is only handed out once its database is up, a clone that never comes up is destroyed
+	err = bases.WaitHealthy(context.Background(), docker, cloneName, HealthyTimeout(r))
+	if err != nil {
+		proxies.Remove(cloneName)
+		if derr := bases.DestroyClone(cloneName, docker, z); derr != nil {
+			fmt.Println("could not destroy unhealthy clone", cloneName, derr)
+		}
+		return nil, zdap.NewError(zdap.CodeUnavailable, "clone of %s did not become healthy, %v", r.Name, err).
+			WithResource(r.Name).WithClone(cloneName)
+	}
+	fmt.Printf("Setting healthy for %s\n", cloneName)
+	err = z.SetUserProperties(cloneName, map[string]string{zfs.PropHealthy: "true", zfs.PropReady: "true"})
+	if err != nil {
+		fmt.Printf("Error when setting healthy prop %s", err)
+		return nil, err
+	}
+
+	return &zdap.PublicClone{
+		Name:      cloneName,
+		Resource:  r.Name,
+		SnappedAt: snappedAt,
+		CreatedAt: createdAt,
+		Owner:     owner,
+		Port:      port,
+		Healthy:   true,
+		Limits:    cloneLimits,
+	}, nil
+}
+
+// HealthyTimeout returns how long the container of a clone of r may take to become healthy
+func HealthyTimeout(r *internal.Resource) time.Duration {
+	if r.Timeouts.Healthy > 0 {
+		return r.Timeouts.Healthy
+	}
+	return internal.DefaultHealthyTimeout
+}
+
+// startContainer creates and starts the container of the clone cloneName, with the clone dataset mounted from path
+func startContainer(docker *client.Client, r *internal.Resource, owner string, cloneName string, path string) error {
+	net, err := bases.EnsureNetwork(docker)
+	if err != nil {
+		return err
+	}
+
+	networkConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			net.Name: {},
+		},
+	}
+
 	resp, err := docker.ContainerCreate(context.Background(), &container.Config{
 		Image:      r.Docker.Image,
 		Entrypoint: r.CloneEntrypoint(),
@@ -171,7 +265,8 @@ func createClone(dss *zfs.Dataset, owner string, snap string, r *internal.Resour
 			Name:              "unless-stopped",
 			MaximumRetryCount: 0,
 		},
-		ShmSize: r.Docker.Shm,
+		ShmSize:   r.Docker.Shm,
+		Resources: bases.ContainerResources(r.CloneLimits()),
 		Mounts: []mount.Mount{
 			{
 				Type:   mount.TypeBind,
@@ -181,92 +276,45 @@ func createClone(dss *zfs.Dataset, owner string, snap string, r *internal.Resour
 		},
 	}, networkConfig, nil, cloneName)
 	if err != nil {
-		return nil, err
-	}
-	err = docker.ContainerStart(context.Background(), resp.ID, container.StartOptions{})
-	if err != nil {
-		return nil, err
-	}
-
-	fmt.Println(" - db container name", cloneName)
-
-	resp, err = docker.ContainerCreate(context.Background(), &container.Config{
-		Image: proxyImageName,
-		Env: []string{
-			fmt.Sprintf("LISTEN_PORT=%d", port),
-			fmt.Sprintf("TARGET_ADDRESS=%s:%d", cloneName, r.Docker.Port),
-		},
-		ExposedPorts: nat.PortSet{
-			nat.Port(fmt.Sprintf("%d/tcp", port)): struct{}{},
-			nat.Port(fmt.Sprintf("%d/udp", port)): struct{}{},
-		},
-		Labels:     map[string]string{"owner": owner},
-		Domainname: fmt.Sprintf("%s-proxy", cloneName),
-	}, &container.HostConfig{
-		RestartPolicy: container.RestartPolicy{
-			Name:              "unless-stopped",
-			MaximumRetryCount: 0,
-		},
-		PortBindings: nat.PortMap{
-			nat.Port(fmt.Sprintf("%d/tcp", port)): []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: fmt.Sprintf("%d/tcp", port)}},
-			nat.Port(fmt.Sprintf("%d/udp", port)): []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: fmt.Sprintf("%d/udp", port)}},
-		},
-	}, networkConfig, nil, fmt.Sprintf("%s-proxy", cloneName))
-	if err != nil {
-		return nil, err
-	}
-	err = docker.ContainerStart(context.Background(), resp.ID, container.StartOptions{})
-	if err != nil {
-		return nil, err
+		return err
 	}
-	fmt.Println(" - db proxy name", fmt.Sprintf("tcp://%s-proxy:%d", cloneName, port))
+	return docker.ContainerStart(context.Background(), resp.ID, container.StartOptions{})
+}
 
-	dates := zfs.TimeReg.FindAll([]byte(cloneName), -1)
-	if len(dates) != 2 {
-		return nil, fmt.Errorf("did not find 2 snap dates in clone name, got %d", len(dates))
-	}
-	snappedAt, err := time.Parse(zfs.TimestampFormat, string(dates[0]))
-	if err != nil {
-		return nil, err
+// RecreateContainer replaces the container of clone with a new one on the same dataset, keeping its data and port
+func RecreateContainer(docker *client.Client, z *zfs.ZFS, r *internal.Resource, clone zdap.PublicClone) error {
+	err := docker.ContainerRemove(context.Background(), clone.Name, container.RemoveOptions{Force: true})
+	if err != nil && !errdefs.IsNotFound(err) {
+		return fmt.Errorf("could not remove container %s, %w", clone.Name, err)
 	}
-	createdAt, err := time.Parse(zfs.TimestampFormat, string(dates[1]))
+	path, err := z.MountPath(clone.Name)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("could not find the mount of %s, %w", clone.Name, err)
 	}
+	return startContainer(docker, r, clone.Owner, clone.Name, path)
+}
 
-	dss2, err := z.Open()
+func assignedPorts(z *zfs.ZFS) ([]zdap.PublicClone, error) {
+	dss, err := z.Open()
 	if err != nil {
 		return nil, err
 	}
-	defer dss2.Close()
-
-	clones, err := z.ListClones(dss2)
+	defer dss.Close()
+	clones, err := z.ListClones(dss)
 	if err != nil {
 		return nil, err
 	}
+	return slicez.Map(clones, func(c servermodel.ServerInternalClone) zdap.PublicClone {
+		return c.PublicClone
+	}), nil
+}
 
-	matchingClones := slicez.Filter(clones, func(c servermodel.ServerInternalClone) bool {
-		return c.Name == cloneName
-	})
-	if len(matchingClones) > 0 {
-		fmt.Printf("Setting healthy for %s\n", cloneName)
-		m := matchingClones[0]
-		err := z.SetUserProperty(*m.Dataset, zfs.PropHealthy, "true")
-		if err != nil {
-			fmt.Printf("Error when setting healthy prop %s", err)
-			return nil, err
-		}
-		defer m.Dataset.Close()
+// CloneTarget resolves the address of a clone container on the zdap proxy network, it is resolved on every
+// connection since the container address may change when the container is restarted
+func CloneTarget(docker *client.Client, cloneName string, port int) func() (string, error) {
+	return func() (string, error) {
+		return bases.ContainerAddress(docker, cloneName, port)
 	}
-
-	return &zdap.PublicClone{
-		Name:      cloneName,
-		Resource:  r.Name,
-		SnappedAt: snappedAt,
-		CreatedAt: createdAt,
-		Owner:     owner,
-		Port:      port,
-	}, nil
 }
 
 func (c *CloneContext) DestroyClone(dss *zfs.Dataset, cloneName string) error {
@@ -282,8 +330,9 @@ func (c *CloneContext) DestroyClone(dss *zfs.Dataset, cloneName string) error {
 		}
 	}
 	if !contain {
-		return fmt.Errorf("clone, %s, does not exist", cloneName)
+		return zdap.NewError(zdap.CodeNotFound, "clone, %s, does not exist", cloneName).WithClone(cloneName)
 	}
 
+	<-c.Proxy.Remove(cloneName)
 	return bases.DestroyClone(cloneName, c.Docker, c.Z)
 }
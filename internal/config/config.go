@@ -3,6 +3,7 @@ package config
 import (
 	"log"
 	"sync"
+	"time"
 
 	"github.com/caarlos0/env"
 	"github.com/urfave/cli/v2"
@@ -14,6 +15,34 @@ type Config struct {
 	ConfigDir      string `env:"CONFIG_DIR"`
 
 	APIPort int `env:"API_PORT" envDefault:"43210"`
+
+	ProxyDrainSeconds int `env:"PROXY_DRAIN_SECONDS" envDefault:"10"`
+
+	PortRange   string `env:"PORT_RANGE" envDefault:"40000-49999"`
+	StablePorts bool   `env:"STABLE_PORTS"`
+
+	TLSDir      string `env:"TLS_DIR"`
+	TLSRequired bool   `env:"TLS_REQUIRED"`
+
+	AdminToken string `env:"ADMIN_TOKEN"`
+
+	CacheDir string `env:"CACHE_DIR" envDefault:"/var/cache/zdap"`
+
+	BuildSlots int `env:"BUILD_SLOTS" envDefault:"1"`
+
+	OwnerMaxClones int     `env:"OWNER_MAX_CLONES"`
+	OwnerMaxCPUs   float64 `env:"OWNER_MAX_CPUS"`
+	OwnerMaxMemory string  `env:"OWNER_MAX_MEMORY"`
+
+	HealthInterval time.Duration `env:"HEALTH_INTERVAL" envDefault:"30s"`
+	HealthFailures int           `env:"HEALTH_FAILURES" envDefault:"3"`
+
+	ReconcileInterval time.Duration `env:"RECONCILE_INTERVAL" envDefault:"10m"`
+	ReconcileFix      string        `env:"RECONCILE_FIX" envDefault:"orphan-container,missing-proxy,stale-network-member"`
+
+	SecretsDir     string `env:"SECRETS_DIR"`
+	SecretsStore   string `env:"SECRETS_STORE"`
+	SecretsKeyFile string `env:"SECRETS_KEY_FILE"`
 }
 
 var (
@@ -46,6 +75,60 @@ func FromCli(c *cli.Context) *Config {
 		if c.IsSet("api-port") {
 			cfg.APIPort = c.Int("api-port")
 		}
+		if c.IsSet("proxy-drain-seconds") {
+			cfg.ProxyDrainSeconds = c.Int("proxy-drain-seconds")
+		}
+		if c.IsSet("port-range") {
+			cfg.PortRange = c.String("port-range")
+		}
+		if c.IsSet("stable-ports") {
+			cfg.StablePorts = c.Bool("stable-ports")
+		}
+		if c.IsSet("tls-dir") {
+			cfg.TLSDir = c.String("tls-dir")
+		}
+		if c.IsSet("tls-required") {
+			cfg.TLSRequired = c.Bool("tls-required")
+		}
+		if c.IsSet("admin-token") {
+			cfg.AdminToken = c.String("admin-token")
+		}
+		if c.IsSet("cache-dir") {
+			cfg.CacheDir = c.String("cache-dir")
+		}
+		if c.IsSet("build-slots") {
+			cfg.BuildSlots = c.Int("build-slots")
+		}
+		if c.IsSet("owner-max-clones") {
+			cfg.OwnerMaxClones = c.Int("owner-max-clones")
+		}
+		if c.IsSet("owner-max-cpus") {
+			cfg.OwnerMaxCPUs = c.Float64("owner-max-cpus")
+		}
+		if c.IsSet("owner-max-memory") {
+			cfg.OwnerMaxMemory = c.String("owner-max-memory")
+		}
+		if c.IsSet("health-interval") {
+			cfg.HealthInterval = c.Duration("health-interval")
+		}
+		if c.IsSet("health-failures") {
+			cfg.HealthFailures = c.Int("health-failures")
+		}
+		if c.IsSet("reconcile-interval") {
+			cfg.ReconcileInterval = c.Duration("reconcile-interval")
+		}
+		if c.IsSet("reconcile-fix") {
+			cfg.ReconcileFix = c.String("reconcile-fix")
+		}
+		if c.IsSet("secrets-dir") {
+			cfg.SecretsDir = c.String("secrets-dir")
+		}
+		if c.IsSet("secrets-store") {
+			cfg.SecretsStore = c.String("secrets-store")
+		}
+		if c.IsSet("secrets-key-file") {
+			cfg.SecretsKeyFile = c.String("secrets-key-file")
+		}
 	})
 	return &cfg
 }
@@ -2,11 +2,14 @@ package core
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
@@ -16,15 +19,23 @@ import (
 	"github.com/modfin/zdap"
 	"github.com/modfin/zdap/internal"
 	"github.com/modfin/zdap/internal/bases"
+	"github.com/modfin/zdap/internal/certs"
 	"github.com/modfin/zdap/internal/clonepool"
 	"github.com/modfin/zdap/internal/cloning"
+	"github.com/modfin/zdap/internal/health"
+	"github.com/modfin/zdap/internal/ports"
+	"github.com/modfin/zdap/internal/proxy"
+	"github.com/modfin/zdap/internal/reconcile"
+	"github.com/modfin/zdap/internal/retrieval"
+	"github.com/modfin/zdap/internal/scheduler"
+	"github.com/modfin/zdap/internal/secrets"
 	"github.com/modfin/zdap/internal/servermodel"
+	"github.com/modfin/zdap/internal/utils"
 	"github.com/modfin/zdap/internal/zfs"
 	"github.com/patrickmn/go-cache"
 	"github.com/robfig/cron/v3"
 	cload "github.com/shirou/gopsutil/v3/load"
 	cmem "github.com/shirou/gopsutil/v3/mem"
-	"gopkg.in/yaml.v3"
 )
 
 type Core struct {
@@ -35,77 +46,330 @@ type Core struct {
 	networkAddress string
 	apiPort        int
 
-	cron      *cron.Cron
-	resources []internal.Resource
-	ttlCache  *cache.Cache
+	cron        *cron.Cron
+	cronEntries map[string]cron.EntryID
+	ttlCache    *cache.Cache
 
+	reloadMu sync.Mutex // serializes Start and Reload
+	started  bool
+
+	mu         sync.RWMutex // guards resources and clonePools, which are replaced on reload
+	resources  []internal.Resource
 	clonePools map[string]*clonepool.ClonePool
+
+	proxies       *proxy.Manager
+	proxySyncOnce sync.Once
+	healthOnce    sync.Once
+	reconcileOnce sync.Once
+	ports         *ports.Registry
+	authority     *certs.Authority
+	secrets       *secrets.Store
+	retriever     *retrieval.Retriever
+	builds        *scheduler.Scheduler
+	resourceLocks utils.KeyedMutex // serializes the builds and snaps of a resource
+	ownerLocks    utils.KeyedMutex // serializes checking the owner limits with creating or claiming the clone
+	ownerLimits   internal.OwnerLimits
+	health        *health.History
+	healthConfig  health.Config
+
+	reconcileConfig reconcile.Config
 }
 
-func NewCore(configDir string, networkAddress string, apiPort int, docker *client.Client, z *zfs.ZFS) (*Core, error) {
+const proxySyncInterval = 30 * time.Second
+
+func NewCore(configDir string, networkAddress string, apiPort int, docker *client.Client, z *zfs.ZFS, proxies *proxy.Manager, ports *ports.Registry, authority *certs.Authority, secrets *secrets.Store, retriever *retrieval.Retriever, buildSlots int, ownerLimits internal.OwnerLimits, healthConfig health.Config, reconcileConfig reconcile.Config) (*Core, error) {
 
 	c := &Core{
 		docker:         docker,
 		z:              z,
+		proxies:        proxies,
+		ports:          ports,
+		authority:      authority,
+		secrets:        secrets,
+		retriever:      retriever,
 		configDir:      configDir,
 		networkAddress: networkAddress,
 		apiPort:        apiPort,
 		ttlCache:       cache.New(10*time.Second, time.Minute),
+		cron:           cron.New(),
+		cronEntries:    map[string]cron.EntryID{},
+		ownerLimits:    ownerLimits,
+		health:         health.NewHistory(),
+		healthConfig:   healthConfig,
+
+		reconcileConfig: reconcileConfig,
 	}
-	err := c.reload()
-	return c, err
+	c.builds = scheduler.New(buildSlots, c.build)
+	resources, err := loadResources(configDir, secrets)
+	if err != nil {
+		return nil, err
+	}
+	c.resources = resources
+	return c, nil
 }
+
+// Start starts the clone pools and cron jobs of the loaded resources
 func (c *Core) Start() error {
-	var ids []cron.EntryID
-	c.clonePools = make(map[string]*clonepool.ClonePool)
-	for _, r := range c.resources {
-		r := r
-
-		var clonePool *clonepool.ClonePool
-		if r.ClonePool.MinClones != 0 {
-			cloneContext := cloning.CloneContext{
-				Resource:       &r,
-				Docker:         c.docker,
-				Z:              c.z,
-				ConfigDir:      c.configDir,
-				NetworkAddress: c.networkAddress,
-				ApiPort:        c.apiPort,
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	_, err := c.apply(c.GetResources())
+	if err != nil {
+		return err
+	}
+	c.started = true
+	c.cron.Start()
+	for _, r := range c.GetResources() {
+		if id, ok := c.cronEntries[r.Name]; ok {
+			fmt.Println("[CRON] Adding cron job", r.Name, "base resource,", r.Cron, ". Next exec at", c.cron.Entry(id).Next)
+		}
+	}
+
+	c.proxySyncOnce.Do(func() {
+		c.SyncProxies()
+		go func() {
+			for range time.Tick(proxySyncInterval) {
+				c.SyncProxies()
 			}
-			clonePool = clonepool.NewClonePool(r, &cloneContext)
-			clonePool.Start()
-			clonePool.TriggerGC() // initial trigger needed to collect up-to-date stats
-			c.clonePools[r.Name] = clonePool
-		}
-
-		if r.Cron != "" {
-			id, err := c.cron.AddFunc(r.Cron, func() {
-				fmt.Println("[CRON] Starting cron job to create", r.Name, "base resource")
-				err := bases.CreateBaseAndSnap(c.configDir, &r, c.docker, c.z, func() {
-					if clonePool != nil {
-						clonePool.TriggerGC()
-					}
-				})
-				if err != nil {
-					fmt.Println("[CRON] Error: could not run cronjob to create base,", err)
+		}()
+	})
+
+	if c.healthConfig.Interval > 0 {
+		c.healthOnce.Do(func() {
+			go func() {
+				for range time.Tick(c.healthConfig.Interval) {
+					c.CheckHealth()
 				}
-			})
+			}()
+		})
+	}
+	if c.reconcileConfig.Interval > 0 {
+		c.reconcileOnce.Do(func() {
+			go c.reconcileLoop()
+		})
+	}
+
+	return nil
+}
+
+// Reload reads the resources of the config dir again and applies the difference to the running cron jobs and clone
+// pools. Clones are left as they are, and nothing is changed if any of the resources are invalid.
+func (c *Core) Reload() (zdap.ReloadResult, error) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	resources, err := loadResources(c.configDir, c.secrets)
+	if err != nil {
+		return zdap.ReloadResult{}, err
+	}
+	if !c.started {
+		res := diffResources(c.GetResources(), resources)
+		c.mu.Lock()
+		c.resources = resources
+		c.mu.Unlock()
+		return res, nil
+	}
+	return c.apply(resources)
+}
+
+// diffResources returns the names of the resources that are added, removed or changed in next
+func diffResources(prev, next []internal.Resource) zdap.ReloadResult {
+	var res zdap.ReloadResult
+	old := map[string]internal.Resource{}
+	for _, r := range prev {
+		old[r.Name] = r
+	}
+	for _, r := range next {
+		o, ok := old[r.Name]
+		switch {
+		case !ok:
+			res.Added = append(res.Added, r.Name)
+		case !reflect.DeepEqual(o, r):
+			res.Updated = append(res.Updated, r.Name)
+		}
+		delete(old, r.Name)
+	}
+	for _, r := range prev {
+		if _, ok := old[r.Name]; ok {
+			res.Removed = append(res.Removed, r.Name)
+		}
+	}
+	return res
+}
+
+// apply makes the cron jobs and clone pools match resources, must be called with reloadMu held
+func (c *Core) apply(resources []internal.Resource) (zdap.ReloadResult, error) {
+	var prev []internal.Resource
+	if c.started {
+		prev = c.GetResources()
+	}
+	res := diffResources(prev, resources)
+
+	c.mu.Lock()
+	c.resources = resources
+	pools := c.clonePools
+	c.mu.Unlock()
+
+	next := map[string]internal.Resource{}
+	for _, r := range resources {
+		next[r.Name] = r
+	}
+	prevCron := map[string]string{}
+	for _, r := range prev {
+		prevCron[r.Name] = r.Cron
+	}
+
+	newPools := map[string]*clonepool.ClonePool{}
+	for name, pool := range pools {
+		if r, ok := next[name]; ok && r.ClonePool.MinClones != 0 {
+			pool.Update(r, c.cloneContext(r))
+			newPools[name] = pool
+			continue
+		}
+		fmt.Println("[CORE] Stopping clone pool of", name)
+		pool.Stop()
+	}
+	for _, r := range resources {
+		if _, ok := newPools[r.Name]; ok || r.ClonePool.MinClones == 0 {
+			continue
+		}
+		pool := clonepool.NewClonePool(r, c.cloneContext(r))
+		pool.Start()
+		pool.TriggerGC() // initial trigger needed to collect up-to-date stats
+		newPools[r.Name] = pool
+	}
+	c.mu.Lock()
+	c.clonePools = newPools
+	c.mu.Unlock()
+
+	for name, id := range c.cronEntries {
+		if r, ok := next[name]; ok && r.Cron == prevCron[name] {
+			continue
+		}
+		c.cron.Remove(id)
+		delete(c.cronEntries, name)
+	}
+	for _, r := range resources {
+		if _, ok := c.cronEntries[r.Name]; ok || r.Cron == "" {
+			continue
+		}
+		name := r.Name
+		id, err := c.cron.AddFunc(r.Cron, func() {
+			r := c.getResource(name)
+			if r == nil {
+				return
+			}
+			fmt.Println("[CRON] Starting cron job to create", name, "base resource")
+			err := c.enqueueBuild(r, scheduler.TriggerCron).Wait()
 			if err != nil {
-				return fmt.Errorf("could not create cron for '%s', %w", r.Cron, err)
+				fmt.Println("[CRON] Error: could not run cronjob to create base,", c.secrets.Redact(err.Error()))
 			}
-			ids = append(ids, id)
+		})
+		if err != nil {
+			return res, fmt.Errorf("could not create cron for '%s', %w", r.Cron, err)
+		}
+		c.cronEntries[name] = id
+		if c.started {
+			fmt.Println("[CRON] Adding cron job", name, "base resource,", r.Cron, ". Next exec at", c.cron.Entry(id).Next)
 		}
+	}
+
+	return res, nil
+}
 
+func (c *Core) cloneContext(r internal.Resource) *cloning.CloneContext {
+	return &cloning.CloneContext{
+		Resource:       &r,
+		Docker:         c.docker,
+		Z:              c.z,
+		Proxy:          c.proxies,
+		Ports:          c.ports,
+		ConfigDir:      c.configDir,
+		NetworkAddress: c.networkAddress,
+		ApiPort:        c.apiPort,
 	}
-	c.cron.Start()
-	for i, r := range c.resources {
-		next := time.Time{}
-		if i < len(ids) && ids != nil {
-			next = c.cron.Entry(ids[i]).Next
+}
+
+// Secrets returns the secrets the resources are resolved with, its Redact removes them from logs and responses
+func (c *Core) Secrets() *secrets.Store {
+	return c.secrets
+}
+
+// BuildStatus returns the status of the latest creation of a base of resource, nil if no base has been created
+func (c *Core) BuildStatus(resource string) *zdap.BuildStatus {
+	return bases.Status(c.z, resource)
+}
+
+func (c *Core) clonePool(resource string) *clonepool.ClonePool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.clonePools[resource]
+}
+
+// SyncProxies makes sure that every clone has a proxy listening on its port, clones that still have a legacy
+// zdap-proxy container are left alone. Proxies for clones that no longer exists are removed.
+func (c *Core) SyncProxies() {
+	dss, err := c.z.Open()
+	if err != nil {
+		fmt.Println("[PROXY] Error: could not open dataset,", err)
+		return
+	}
+	defer dss.Close()
+
+	clones, err := c.z.ListClones(dss)
+	if err != nil {
+		fmt.Println("[PROXY] Error: could not list clones,", err)
+		return
+	}
+
+	containers, err := c.docker.ContainerList(context.Background(), container.ListOptions{All: true})
+	if err != nil {
+		fmt.Println("[PROXY] Error: could not list containers,", err)
+		return
+	}
+	legacyProxies := map[string]bool{}
+	for _, con := range containers {
+		for _, name := range con.Names {
+			if strings.HasSuffix(name, "-proxy") {
+				legacyProxies[strings.TrimSuffix(strings.TrimPrefix(name, "/"), "-proxy")] = true
+			}
 		}
-		fmt.Println("[CRON] Adding cron job", r.Name, "base resource,", r.Cron, ". Next exec at", next)
 	}
 
-	return nil
+	c.syncProxies(clones, legacyProxies, time.Now())
+}
+
+// syncProxies adds the missing proxies for clones and removes those of clones that no longer exists. Expired clones
+// are being destroyed and their proxies drained, so they are not given a new one.
+func (c *Core) syncProxies(clones []servermodel.ServerInternalClone, legacyProxies map[string]bool, now time.Time) {
+	// clones sharing a port are routed to the one added last, so add them oldest first
+	clones = slicez.SortBy(clones, func(a, b servermodel.ServerInternalClone) bool {
+		return a.CreatedAt.Before(b.CreatedAt)
+	})
+	exists := map[string]bool{}
+	for _, clone := range clones {
+		exists[clone.Name] = true
+		if clone.Port == 0 || legacyProxies[clone.Name] || c.proxies.Has(clone.Name) {
+			continue
+		}
+		if clone.ExpiresAt != nil && clone.ExpiresAt.Before(now) {
+			continue // it is about to be destroyed
+		}
+		r := c.getResource(clone.Resource)
+		if r == nil {
+			continue
+		}
+		err := c.proxies.Add(clone.Name, clone.Port, clone.Owner, cloning.CloneTarget(c.docker, clone.Name, r.Docker.Port))
+		if err != nil {
+			fmt.Println("[PROXY] Error: could not add proxy,", err)
+		}
+	}
+
+	for _, name := range c.proxies.Names() {
+		if !exists[name] {
+			c.proxies.Remove(name)
+		}
+	}
 }
 
 func (c *Core) ExecAllCronjobs() {
@@ -119,35 +383,12 @@ func (c *Core) ExecAllCronjobs() {
 	c.cron.Start()
 }
 
-func (c *Core) reload() (err error) {
-	if c.cron != nil {
-		c.cron.Stop()
-		defer func() {
-			if err != nil {
-				return
-			}
-			err = c.Start()
-		}()
-	}
-	newCron := cron.New()
-
-	newResources, err := loadResources(c.configDir)
-	if err != nil {
-		return err
-	}
-
-	c.cron = newCron
-	c.resources = newResources
-
-	return nil
-}
-
-func loadResources(dir string) ([]internal.Resource, error) {
+func loadResources(dir string, store *secrets.Store) ([]internal.Resource, error) {
 
 	//fmt.Println("[CORE] Loading resource from", dir)
 	var paths []string
 	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if strings.HasSuffix(path, ".resource.yml") {
+		if strings.HasSuffix(path, ".resource.yml") || strings.HasSuffix(path, templateSuffix) {
 			paths = append(paths, path)
 		}
 		return nil
@@ -156,20 +397,34 @@ func loadResources(dir string) ([]internal.Resource, error) {
 		return nil, err
 	}
 
-	var resources []internal.Resource
+	var files []*resourceFile
+	var errs ValidationErrors
 	for _, path := range paths {
 		//fmt.Println("[CORE] Adding resource", path)
-		b, err := os.ReadFile(path)
-		if err != nil {
-			return nil, err
+		f, err := parseResourceFile(path)
+		var verrs ValidationErrors
+		if errors.As(err, &verrs) {
+			errs = append(errs, verrs...)
+			continue
 		}
-
-		var r internal.Resource
-		err = yaml.Unmarshal(b, &r)
 		if err != nil {
 			return nil, err
 		}
-		//TODO ensure uniq resource names for r.Name
+		files = append(files, f)
+	}
+	errs = append(errs, resolveTemplates(files, store)...)
+	files = slicez.Filter(files, func(f *resourceFile) bool {
+		return !f.template && !f.failed
+	})
+	errs = append(errs, validateResources(dir, files)...)
+	if len(errs) > 0 {
+		errs.sort()
+		return nil, errs
+	}
+
+	var resources []internal.Resource
+	for _, f := range files {
+		r := f.resource
 		if r.ClonePool.ClaimMaxTimeoutSeconds == 0 {
 			r.ClonePool.ClaimMaxTimeoutSeconds = internal.DefaultClaimMaxTimeoutSeconds
 		}
@@ -190,12 +445,16 @@ func (c *Core) ResourcesExists(resource string) bool {
 
 func (c *Core) GetResourcesNames() []string {
 	var l []string
-	for _, r := range c.resources {
+	for _, r := range c.GetResources() {
 		l = append(l, r.Name)
 	}
 	return l
 }
+
+// GetResources returns the loaded resources, the slice is replaced rather than modified on reload
 func (c *Core) GetResources() []internal.Resource {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.resources
 }
 
@@ -257,7 +516,7 @@ func (c *Core) GetResourceSnaps(dss *zfs.Dataset, resourceName string) ([]server
 	if err != nil {
 		return nil, err
 	}
-	snapReg, err := regexp.Compile(fmt.Sprintf("^zdap-%s-base-[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}.[0-9]{2}.[0-9]{2}@snap$", resourceName))
+	snapReg, err := regexp.Compile(fmt.Sprintf("^zdap-%s-base-[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}.[0-9]{2}.[0-9]{2}@snap(-[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}.[0-9]{2}.[0-9]{2})?$", regexp.QuoteMeta(resourceName)))
 	if err != nil {
 		return nil, err
 	}
@@ -272,7 +531,7 @@ func (c *Core) GetResourceSnaps(dss *zfs.Dataset, resourceName string) ([]server
 }
 
 func (c *Core) getResource(resourceName string) *internal.Resource {
-	for _, r := range c.resources {
+	for _, r := range c.GetResources() {
 		if r.Name == resourceName {
 			return &r
 		}
@@ -283,9 +542,11 @@ func (c *Core) getResource(resourceName string) *internal.Resource {
 func (c *Core) CreateBaseAndSnap(resourceName string, useExistingBase bool) error {
 	r := c.getResource(resourceName)
 	if r == nil {
-		return fmt.Errorf("could not find resource %s", resourceName)
+		return zdap.NewError(zdap.CodeNotFound, "could not find resource %s", resourceName).WithResource(resourceName)
 	}
 	if useExistingBase {
+		// a running build of the resource may still be writing to its base
+		defer c.resourceLocks.Lock(resourceName)()
 		dss, err := c.z.Open()
 		if err != nil {
 			return err
@@ -303,21 +564,40 @@ func (c *Core) CreateBaseAndSnap(resourceName string, useExistingBase bool) erro
 			return resourceRx.MatchString(b)
 		})
 		if len(resourceBases) == 0 {
-			return fmt.Errorf("no bases for resource '%s' found", resourceName)
+			return zdap.NewError(zdap.CodeNotFound, "no bases for resource '%s' found", resourceName).WithResource(resourceName)
 		}
 		latestBase := slicez.Reverse(slicez.Sort(resourceBases))[0]
 		t := time.Now()
 		fmt.Printf("snapping %s at %s\n", latestBase, t.Format(zfs.TimestampFormat))
-		return c.z.SnapDataset(latestBase, r.Name, t)
+		return c.z.SnapDataset(latestBase, r.Name, t, "")
 	}
-	return bases.CreateBaseAndSnap(c.configDir, r, c.docker, c.z, func() {
-		clonePool := c.clonePools[resourceName]
+	return c.enqueueBuild(r, scheduler.TriggerManual).Wait()
+}
+
+func (c *Core) enqueueBuild(r *internal.Resource, trigger string) *scheduler.Job {
+	return c.builds.Enqueue(r.Name, r.Build.Priority, r.Build.Weight, trigger)
+}
+
+// build creates a base of the resource, it is run by the build scheduler
+func (c *Core) build(resourceName string) error {
+	r := c.getResource(resourceName)
+	if r == nil {
+		return zdap.NewError(zdap.CodeNotFound, "could not find resource %s", resourceName).WithResource(resourceName)
+	}
+	defer c.resourceLocks.Lock(resourceName)()
+	return bases.CreateBaseAndSnap(c.configDir, r, c.docker, c.z, c.secrets, c.retriever, func() {
+		clonePool := c.clonePool(resourceName)
 		if clonePool != nil {
 			clonePool.TriggerGC()
 		}
 	})
 }
 
+// BuildQueue returns the running and queued builds of bases
+func (c *Core) BuildQueue() zdap.BuildQueue {
+	return c.builds.Status()
+}
+
 func (c *Core) CloneResource(dss *zfs.Dataset, owner string, resourceName string, at time.Time) (*zdap.PublicClone, error) {
 	return c.CloneResourceHandlePooling(dss, owner, resourceName, at, false)
 }
@@ -330,18 +610,16 @@ func (c *Core) CloneResourceHandlePooling(dss *zfs.Dataset, owner string, resour
 
 	r := c.getResource(resourceName)
 	if r == nil {
-		return nil, fmt.Errorf("could not find resource %s", resourceName)
+		return nil, zdap.NewError(zdap.CodeNotFound, "could not find resource %s", resourceName).WithResource(resourceName)
 	}
-	cc := cloning.CloneContext{
-		Resource:       r,
-		Docker:         c.docker,
-		Z:              c.z,
-		ConfigDir:      c.configDir,
-		NetworkAddress: c.networkAddress,
-		ApiPort:        c.apiPort,
+	if !pooled {
+		defer c.ownerLocks.Lock(owner)()
+		err := c.checkOwnerLimits(owner, *r)
+		if err != nil {
+			return nil, err
+		}
 	}
-
-	return cc.CloneResourceHandlePooling(dss, owner, resourceName, at, pooled)
+	return c.cloneContext(*r).CloneResourceHandlePooling(dss, owner, resourceName, at, pooled)
 }
 
 func (c *Core) DestroyClone(dss *zfs.Dataset, cloneName string) error {
@@ -349,18 +627,32 @@ func (c *Core) DestroyClone(dss *zfs.Dataset, cloneName string) error {
 	if err != nil {
 		return err
 	}
-	var contain bool
-	for _, c := range clones {
-		if c.Name == cloneName {
-			contain = true
+	var clone *servermodel.ServerInternalClone
+	for i := range clones {
+		if clones[i].Name == cloneName {
+			clone = &clones[i]
 			break
 		}
 	}
-	if !contain {
-		return fmt.Errorf("clone, %s, does not exist", cloneName)
+	if clone == nil {
+		return zdap.NewError(zdap.CodeNotFound, "clone, %s, does not exist", cloneName).WithClone(cloneName)
 	}
 
-	return bases.DestroyClone(cloneName, c.docker, c.z)
+	// the clone is unrouted right away, and destroyed once its open connections are drained. It is expired meanwhile,
+	// so that it is neither claimed nor repaired.
+	drained := c.proxies.Remove(cloneName)
+	err = c.z.SetUserProperty(*clone.Dataset, zfs.PropExpires, time.Now().Format(zfs.TimestampFormat))
+	if err != nil {
+		return fmt.Errorf("could not expire %s, %w", cloneName, err)
+	}
+	go func() {
+		<-drained
+		err := bases.DestroyClone(cloneName, c.docker, c.z)
+		if err != nil {
+			fmt.Println("[CORE] Error: could not destroy clone", cloneName, err)
+		}
+	}()
+	return nil
 }
 
 func (c *Core) ServerStatus(dss *zfs.Dataset) (zdap.ServerStatus, error) {
@@ -410,11 +702,11 @@ func (c *Core) ServerStatus(dss *zfs.Dataset) (zdap.ServerStatus, error) {
 	s.TotalMem = mem.Total
 
 	s.ResourceDetails = make(map[string]zdap.ServerResourceDetails)
-	for _, r := range c.resources {
+	for _, r := range c.GetResources() {
 		s.Resources = append(s.Resources, r.Name)
 		var available int
-		if pool, ok := c.clonePools[r.Name]; ok {
-			available = pool.ClonesAvailable
+		if pool := c.clonePool(r.Name); pool != nil {
+			available = pool.Available()
 		}
 
 		s.ResourceDetails[r.Name] = zdap.ServerResourceDetails{
@@ -427,15 +719,60 @@ func (c *Core) ServerStatus(dss *zfs.Dataset) (zdap.ServerStatus, error) {
 }
 
 func (c *Core) ClaimPooledClone(resource string, timeout time.Duration, owner string) (servermodel.ServerInternalClone, error) {
-	if pool, exists := c.clonePools[resource]; exists {
+	pool, r := c.clonePool(resource), c.getResource(resource)
+	if pool != nil && r != nil {
+		defer c.ownerLocks.Lock(owner)()
+		err := c.checkOwnerLimits(owner, *r)
+		if err != nil {
+			return servermodel.ServerInternalClone{}, err
+		}
 		return pool.Claim(timeout, owner)
 	}
-	return servermodel.ServerInternalClone{}, fmt.Errorf("no clone pool exists for resource '%s'", resource)
+	return servermodel.ServerInternalClone{}, zdap.NewError(zdap.CodeInvalid, "no clone pool exists for resource '%s'", resource).WithResource(resource)
 }
 
 func (c *Core) ExpirePooledClone(resource string, claimId string) error {
-	if pool, exists := c.clonePools[resource]; exists {
+	if pool := c.clonePool(resource); pool != nil {
 		return pool.Expire(claimId)
 	}
 	return nil
 }
+
+// ServerVersion returns the version of the server and the features it has enabled
+func (c *Core) ServerVersion() zdap.ServerVersion {
+	features := []string{zdap.FeatureClaimTTL, zdap.FeatureStructuredErrors, zdap.FeatureOpenAPI}
+	c.mu.RLock()
+	pooling := len(c.clonePools) > 0
+	c.mu.RUnlock()
+	if pooling {
+		features = append(features, zdap.FeaturePooling)
+	}
+	if c.authority != nil {
+		features = append(features, zdap.FeatureTLS)
+	}
+	if c.ports != nil && c.ports.Stable() {
+		features = append(features, zdap.FeatureStablePorts)
+	}
+	return zdap.ServerVersion{
+		Version:     zdap.Version,
+		APIVersions: []string{zdap.APIVersion},
+		Features:    features,
+	}
+}
+
+func (c *Core) IssueCertificate(owner string) (zdap.PublicCertificate, error) {
+	if c.authority == nil {
+		return zdap.PublicCertificate{}, zdap.NewError(zdap.CodeInvalid, "tls is not enabled on this server")
+	}
+	cert, key, expires, err := c.authority.Issue(owner, nil, false)
+	if err != nil {
+		return zdap.PublicCertificate{}, err
+	}
+	return zdap.PublicCertificate{
+		Owner:       owner,
+		Certificate: string(cert),
+		Key:         string(key),
+		CA:          string(c.authority.CertificatePEM()),
+		ExpiresAt:   expires,
+	}, nil
+}
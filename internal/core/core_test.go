@@ -1,15 +1,223 @@
 package core
 
 import (
+	"bufio"
+	"fmt"
+	"github.com/modfin/zdap"
+	"github.com/modfin/zdap/internal"
+	"github.com/modfin/zdap/internal/health"
+	"github.com/modfin/zdap/internal/proxy"
+	"github.com/modfin/zdap/internal/reconcile"
+	"github.com/modfin/zdap/internal/secrets"
+	"github.com/modfin/zdap/internal/servermodel"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func Test_loadResources(t *testing.T) {
-	rs, err := loadResources("./testdata/resources")
+	rs, err := loadResources("./testdata/resources", nil)
 	assert.NoError(t, err)
 	assert.Len(t, rs, 1)
 	assert.Equal(t, "postgres-dbname", rs[0].Name)
 	assert.Equal(t, 8, rs[0].ClonePool.MinClones)
 	assert.Equal(t, 16, rs[0].ClonePool.MaxClones)
 }
+
+func Test_loadResources_Invalid(t *testing.T) {
+	_, err := loadResources("./testdata/invalid", nil)
+	var errs ValidationErrors
+	assert.ErrorAs(t, err, &errs)
+
+	var got []string
+	for _, e := range errs {
+		got = append(got, fmt.Sprintf("%s:%d %s", filepath.Base(e.File), e.Line, e.Field))
+	}
+	assert.Equal(t, []string{
+		"a.resource.yml:2 docker.healthcheck",
+		"a.resource.yml:5 cron",
+		"a.resource.yml:6 retrieval",
+		"a.resource.yml:7 creation",
+		"a.resource.yml:9 clone_pool.min_clones",
+		"a.resource.yml:14 clone_params.zfs.1",
+		"a.resource.yml:16 clone_params.limits.memory",
+		"a.resource.yml:17 clone_params.limits.blkio_weight",
+		"a.resource.yml:19 limits.cpus",
+		"b.resource.yml:1 name",
+		"b.resource.yml:6 retrieval",
+		"b.resource.yml:7 creation",
+		"c.resource.yml:5 ",
+		"d.resource.yml:1 name",
+		"d.resource.yml:8 source.s3",
+		"d.resource.yml:9 source.s3.endpoint",
+		"d.resource.yml:11 source.sha256",
+		"d.resource.yml:12 creation",
+		"d.resource.yml:14 verify.min_rows",
+		"d.resource.yml:16 verify.script",
+		"d.resource.yml:17 verify.max_shrink",
+		"e.resource.yml:2 docker.volume",
+		"e.resource.yml:7 restore",
+		"e.resource.yml:10 restore.owner",
+		"e.resource.yml:11 update",
+		"e.resource.yml:13 timeouts.healthy",
+		"e.resource.yml:15 retry.attempts",
+		"e.resource.yml:17 build.weight",
+	}, got)
+	assert.Contains(t, err.Error(), "b.resource.yml:1: name: resource 'postgres-a' is already defined in testdata/invalid/a.resource.yml:1")
+}
+
+func TestCore_Reload(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0755))
+	}
+	resource := func(name, image string) string {
+		return fmt.Sprintf("name: %s\ndocker:\n  image: %s\n  port: 5432\n  healthcheck: pg_isready\nretrieval: ./script.sh\ncreation: ./script.sh\n", name, image)
+	}
+	write("script.sh", "#!/usr/bin/env bash\n")
+	write("a.resource.yml", resource("a", "postgres:15"))
+	write("b.resource.yml", resource("b", "postgres:15"))
+
+	c, err := NewCore(dir, "", 0, nil, nil, nil, nil, nil, nil, nil, 0, internal.OwnerLimits{}, health.Config{}, reconcile.Config{})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "b"}, c.GetResourcesNames())
+
+	write("a.resource.yml", resource("a", "postgres:16"))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "b.resource.yml")))
+	write("c.resource.yml", resource("c", "postgres:16"))
+
+	done := make(chan struct{})
+	go func() { // reloading must not race with handlers reading the resources
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c.ResourcesExists("a")
+		}
+	}()
+	res, err := c.Reload()
+	<-done
+	assert.NoError(t, err)
+	assert.Equal(t, zdap.ReloadResult{Added: []string{"c"}, Removed: []string{"b"}, Updated: []string{"a"}}, res)
+	assert.Equal(t, "postgres:16", c.getResource("a").Docker.Image)
+
+	write("d.resource.yml", resource("a", "postgres:16"))
+	_, err = c.Reload()
+	var errs ValidationErrors
+	assert.ErrorAs(t, err, &errs)
+	assert.ElementsMatch(t, []string{"a", "c"}, c.GetResourcesNames(), "invalid config must not be applied")
+}
+
+func Test_loadResources_Templates(t *testing.T) {
+	t.Setenv("ZDAP_TEST_USER", "zdap")
+	t.Setenv("ZDAP_TEST_DB", "events")
+	t.Setenv("ZDAP_SECRET_BACKUP_KEY", "s3cr3t-key")
+	store := secrets.NewStore("", nil)
+	rs, err := loadResources("./testdata/templates", store)
+	assert.NoError(t, err)
+	assert.Len(t, rs, 2)
+
+	byName := map[string]internal.Resource{}
+	for _, r := range rs {
+		byName[r.Name] = r
+	}
+	users, events := byName["users"], byName["events"]
+	assert.Equal(t, "postgres:15.3-bullseye", users.Docker.Image)
+	assert.Equal(t, "45 4 * * *", users.Cron)
+	assert.Equal(t, []string{"POSTGRES_PASSWORD=qwerty", "POSTGRES_DB=users", "PGUSER=zdap", "LITERAL=${ZDAP_TEST_USER}"}, []string(users.BaseEnv()))
+	assert.Equal(t, map[string]string{"recordsize": "8k"}, users.CloneZfsProperties())
+	assert.Equal(t, []string{"BACKUP_KEY=s3cr3t-key"}, users.ScriptEnv)
+	assert.Equal(t, "BACKUP_KEY=[REDACTED]", store.Redact(users.ScriptEnv[0]))
+
+	assert.Equal(t, "postgres:16", events.Docker.Image)
+	assert.Equal(t, 5432, events.Docker.Port)
+	assert.Equal(t, "15 2 * * *", events.Cron)
+	assert.Equal(t, []string{"POSTGRES_PASSWORD=qwerty", "POSTGRES_DB=events"}, []string(events.BaseEnv()))
+
+	_, err = loadResources("./testdata/templates", nil)
+	assert.NoError(t, err, "secret references are not resolved without a store")
+
+	os.Unsetenv("ZDAP_TEST_DB")
+	os.Unsetenv("ZDAP_SECRET_BACKUP_KEY")
+	_, err = loadResources("./testdata/templates", store)
+	assert.ErrorContains(t, err, "testdata/templates/events.resource.yml:7: restore_params: environment variable 'ZDAP_TEST_DB'")
+	assert.ErrorContains(t, err, "testdata/templates/users.resource.yml:9: script_env: could not find secret 'backup-key'")
+}
+
+func Test_loadResources_TemplateCycle(t *testing.T) {
+	_, err := loadResources("./testdata/cycle", nil)
+	var errs ValidationErrors
+	assert.ErrorAs(t, err, &errs)
+
+	var got []string
+	for _, e := range errs {
+		got = append(got, fmt.Sprintf("%s:%d %s", filepath.Base(e.File), e.Line, e.Message))
+	}
+	assert.Equal(t, []string{
+		"a.template.yml:2 'b' could not be resolved",
+		"b.template.yml:2 templates form a cycle, a -> b -> a",
+		"c.resource.yml:2 'b' could not be resolved",
+		"d.resource.yml:2 there is no template or resource named 'e'",
+	}, got)
+}
+
+func TestCore_SyncProxiesDuringDrain(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "script.sh"), []byte("#!/usr/bin/env bash\n"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.resource.yml"), []byte("name: a\ndocker:\n  image: postgres:15\n  port: 5432\n  healthcheck: pg_isready\nretrieval: ./script.sh\ncreation: ./script.sh\n"), 0755))
+	proxies := proxy.NewManager(time.Minute)
+	defer proxies.Close()
+	c, err := NewCore(dir, "", 0, nil, nil, proxies, nil, nil, nil, nil, 0, internal.OwnerLimits{}, health.Config{}, reconcile.Config{})
+	require.NoError(t, err)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	freePort := func() int {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		return l.Addr().(*net.TCPAddr).Port
+	}
+
+	now := time.Now()
+	expired := servermodel.ServerInternalClone{PublicClone: zdap.PublicClone{Name: "a-1", Resource: "a", Owner: "owner", Port: freePort(), CreatedAt: now.Add(-time.Hour), ExpiresAt: &now}}
+	live := servermodel.ServerInternalClone{PublicClone: zdap.PublicClone{Name: "a-2", Resource: "a", Owner: "owner", Port: freePort(), CreatedAt: now.Add(-time.Minute)}}
+
+	require.NoError(t, proxies.Add(expired.Name, expired.Port, expired.Owner, func() (string, error) { return target.Addr().String(), nil }))
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", expired.Port))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintln(conn, "ping")
+	require.NoError(t, err)
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+
+	drained := proxies.Remove(expired.Name) // the clone is being destroyed, its open connection keeps the drain going
+	c.syncProxies([]servermodel.ServerInternalClone{expired, live}, map[string]bool{}, now.Add(time.Second))
+
+	assert.False(t, proxies.Has(expired.Name), "a sync during the drain must not add a new proxy for the expired clone")
+	assert.True(t, proxies.Has(live.Name))
+	_, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", expired.Port))
+	assert.Error(t, err, "the port of the expired clone must not accept new connections")
+	select {
+	case <-drained:
+		t.Error("the open connection should still be draining")
+	default:
+	}
+}
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/modfin/zdap"
+	"github.com/modfin/zdap/internal/cloning"
+	"github.com/modfin/zdap/internal/health"
+	"github.com/modfin/zdap/internal/servermodel"
+	"github.com/modfin/zdap/internal/zfs"
+)
+
+// CheckHealth checks the containers of all clones, keeps their zdap:healthy up to date and repairs the clones that
+// failed c.healthConfig.Failures checks in a row
+func (c *Core) CheckHealth() {
+	dss, err := c.z.Open()
+	if err != nil {
+		fmt.Println("[HEALTH] Error: could not open dataset,", err)
+		return
+	}
+	defer dss.Close()
+
+	clones, err := c.z.ListClones(dss)
+	if err != nil {
+		fmt.Println("[HEALTH] Error: could not list clones,", err)
+		return
+	}
+
+	exists := map[string]bool{}
+	now := time.Now()
+	for _, clone := range clones {
+		exists[clone.Name] = true
+		if clone.ExpiresAt != nil && clone.ExpiresAt.Before(now) {
+			continue // it is about to be destroyed
+		}
+		r := c.getResource(clone.Resource)
+		if !clone.Healthy && r != nil && now.Sub(clone.CreatedAt) < cloning.HealthyTimeout(r) {
+			continue // it is still being created
+		}
+		c.checkClone(clone)
+	}
+	c.health.Retain(exists)
+}
+
+func (c *Core) checkClone(clone servermodel.ServerInternalClone) {
+	var s *types.ContainerState
+	info, err := c.docker.ContainerInspect(context.Background(), clone.Name)
+	switch {
+	case errdefs.IsNotFound(err):
+	case err != nil:
+		fmt.Println("[HEALTH] Error: could not inspect", clone.Name, err)
+		return
+	default:
+		s = info.State
+	}
+
+	state, detail := health.State(s)
+	h := c.health.Record(clone.Name, zdap.HealthCheck{At: time.Now(), State: state, Error: detail})
+	if h.Healthy != clone.Healthy {
+		fmt.Printf("[HEALTH] %s is %s %s\n", clone.Name, state, detail)
+		err = c.z.SetUserProperty(*clone.Dataset, zfs.PropHealthy, strconv.FormatBool(h.Healthy))
+		if err != nil {
+			fmt.Println("[HEALTH] Error: could not set healthy of", clone.Name, err)
+		}
+		if pool := c.clonePool(clone.Resource); pool != nil && clone.ClonePooled {
+			pool.TriggerGC()
+		}
+	}
+	if h.Healthy || h.ConsecutiveFailures < c.healthConfig.Failures {
+		return
+	}
+
+	repair, err := c.repairClone(clone, state, h)
+	if err != nil {
+		fmt.Printf("[HEALTH] Error: could not repair %s, %v\n", clone.Name, err)
+	} else {
+		fmt.Printf("[HEALTH] %s was %s\n", clone.Name, repair)
+	}
+	c.health.Repaired(clone.Name, repair, err)
+}
+
+// repairClone replaces a broken pooled clone which is not claimed, and restarts other clones. A clone whose container
+// is missing, or which is still broken after a restart, gets a new container.
+func (c *Core) repairClone(clone servermodel.ServerInternalClone, state string, h zdap.CloneHealth) (string, error) {
+	if pool := c.clonePool(clone.Resource); pool != nil && clone.ClonePooled && clone.ExpiresAt == nil {
+		return zdap.RepairReplaced, pool.Expire(clone.Name)
+	}
+	if state != zdap.CloneMissing && !health.Restarted(h) {
+		timeout := 10
+		return zdap.RepairRestarted, c.docker.ContainerRestart(context.Background(), clone.Name, container.StopOptions{Timeout: &timeout})
+	}
+	r := c.getResource(clone.Resource)
+	if r == nil {
+		return zdap.RepairRecreated, fmt.Errorf("resource %s does not exist", clone.Resource)
+	}
+	return zdap.RepairRecreated, cloning.RecreateContainer(c.docker, c.z, r, clone.PublicClone)
+}
+
+// CloneHealth returns the health of clone, with the checks of the health monitor since zdapd started
+func (c *Core) CloneHealth(clone zdap.PublicClone) zdap.CloneHealth {
+	if h := c.health.Get(clone.Name); h != nil {
+		return *h
+	}
+	return zdap.CloneHealth{Clone: clone.Name, Healthy: clone.Healthy, History: []zdap.HealthCheck{}}
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/modfin/zdap"
+	"github.com/modfin/zdap/internal"
+)
+
+// checkOwnerLimits fails if owner would exceed the owner limits of the server with another clone of r. The caller
+// must hold the owner lock until the clone is created or claimed, so that concurrent requests can not exceed the
+// limits together.
+func (c *Core) checkOwnerLimits(owner string, r internal.Resource) error {
+	if c.ownerLimits == (internal.OwnerLimits{}) {
+		return nil
+	}
+	// the clones are listed from a fresh dataset, one opened before the lock was taken may miss clones
+	dss, err := c.z.Open()
+	if err != nil {
+		return err
+	}
+	defer dss.Close()
+	clones, err := c.z.ListClones(dss)
+	if err != nil {
+		return fmt.Errorf("could not list clones, %w", err)
+	}
+	public := make([]zdap.PublicClone, 0, len(clones))
+	for _, cl := range clones {
+		public = append(public, cl.PublicClone)
+	}
+	return ownerLimitsExceeded(public, owner, c.ownerLimits, r.CloneLimits(), time.Now())
+}
+
+// ownerLimitsExceeded returns a conflict if the clones of owner, together with a new clone limited by l, exceed max.
+// Expired claims are not counted, nor are clones without a cpu or memory limit counted towards those limits.
+func ownerLimitsExceeded(clones []zdap.PublicClone, owner string, max internal.OwnerLimits, l internal.Limits, now time.Time) error {
+	count, cpus, memory := 1, l.CPUs, l.Memory
+	for _, cl := range clones {
+		if cl.Owner != owner || (cl.ExpiresAt != nil && cl.ExpiresAt.Before(now)) {
+			continue
+		}
+		count++
+		if cl.Limits != nil {
+			cpus += cl.Limits.CPUs
+			memory += cl.Limits.Memory
+		}
+	}
+
+	switch {
+	case max.Clones > 0 && count > max.Clones:
+		return zdap.NewError(zdap.CodeConflict, "%s may have at most %d clones", owner, max.Clones)
+	case max.CPUs > 0 && cpus > max.CPUs:
+		return zdap.NewError(zdap.CodeConflict, "the clones of %s may use at most %g cpus, with another clone they would use %g",
+			owner, max.CPUs, cpus)
+	case max.Memory > 0 && memory > max.Memory:
+		return zdap.NewError(zdap.CodeConflict, "the clones of %s may use at most %s memory, with another clone they would use %s",
+			owner, max.Memory.HumanReadable(), memory.HumanReadable())
+	}
+	return nil
+}
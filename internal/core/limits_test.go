@@ -0,0 +1,36 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/modfin/zdap"
+	"github.com/modfin/zdap/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ownerLimitsExceeded(t *testing.T) {
+	now := time.Now()
+	expired := now.Add(-time.Minute)
+	claimed := now.Add(time.Minute)
+	clones := []zdap.PublicClone{
+		{Owner: "alice", Limits: &internal.Limits{CPUs: 2, Memory: 4 * datasize.GB}},
+		{Owner: "alice", ExpiresAt: &claimed, Limits: &internal.Limits{CPUs: 1}},
+		{Owner: "alice", ExpiresAt: &expired, Limits: &internal.Limits{CPUs: 8}},
+		{Owner: "alice"},
+		{Owner: "bob", Limits: &internal.Limits{CPUs: 8, Memory: 32 * datasize.GB}},
+	}
+	limits := internal.Limits{CPUs: 1, Memory: 4 * datasize.GB}
+
+	assert.NoError(t, ownerLimitsExceeded(clones, "alice", internal.OwnerLimits{}, limits, now))
+	assert.NoError(t, ownerLimitsExceeded(clones, "alice", internal.OwnerLimits{Clones: 4, CPUs: 4, Memory: 8 * datasize.GB}, limits, now))
+
+	var apiErr *zdap.APIError
+	err := ownerLimitsExceeded(clones, "alice", internal.OwnerLimits{Clones: 3}, limits, now)
+	assert.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, zdap.CodeConflict, apiErr.Code)
+	assert.Error(t, ownerLimitsExceeded(clones, "alice", internal.OwnerLimits{CPUs: 3.5}, limits, now))
+	assert.Error(t, ownerLimitsExceeded(clones, "alice", internal.OwnerLimits{Memory: 6 * datasize.GB}, limits, now))
+	assert.NoError(t, ownerLimitsExceeded(clones, "carol", internal.OwnerLimits{Clones: 1, CPUs: 1, Memory: 4 * datasize.GB}, limits, now))
+}
@@ -0,0 +1,156 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/modfin/zdap"
+	"github.com/modfin/zdap/internal"
+	"github.com/modfin/zdap/internal/bases"
+	"github.com/modfin/zdap/internal/cloning"
+	"github.com/modfin/zdap/internal/reconcile"
+	"github.com/modfin/zdap/internal/zfs"
+)
+
+// Reconcile finds the drift between the datasets, containers and proxies of the clones, and fixes the kinds of drift
+// in fix
+func (c *Core) Reconcile(fix reconcile.Policy) ([]reconcile.Finding, error) {
+	o, err := c.observe()
+	if err != nil {
+		return nil, err
+	}
+	findings := reconcile.Find(o)
+	for i, f := range findings {
+		if !fix[f.Kind] {
+			continue
+		}
+		findings[i].Err = c.fix(f)
+		findings[i].Fixed = findings[i].Err == nil
+	}
+	return findings, nil
+}
+
+func (c *Core) observe() (reconcile.Observed, error) {
+	o := reconcile.Observed{Now: time.Now(), Building: map[string]bool{}, Ready: map[string]bool{}}
+
+	dss, err := c.z.Open()
+	if err != nil {
+		return o, fmt.Errorf("could not open dataset, %w", err)
+	}
+	defer dss.Close()
+	clones, err := c.z.ListClones(dss)
+	if err != nil {
+		return o, fmt.Errorf("could not list clones, %w", err)
+	}
+	for _, clone := range clones {
+		o.Clones = append(o.Clones, clone.PublicClone)
+		o.Ready[clone.Name] = clone.Ready
+	}
+	snaps, err := c.z.ListSnaps(dss)
+	if err != nil {
+		return o, fmt.Errorf("could not list snaps, %w", err)
+	}
+	for _, s := range snaps {
+		o.Snaps = append(o.Snaps, s.PublicSnap)
+	}
+
+	o.Containers, err = c.docker.ContainerList(context.Background(), container.ListOptions{All: true})
+	if err != nil {
+		return o, fmt.Errorf("could not list containers, %w", err)
+	}
+	o.Members, err = bases.NetworkMembers(c.docker)
+	if err != nil {
+		return o, fmt.Errorf("could not list the members of the clone network, %w", err)
+	}
+	for _, b := range c.BuildQueue().Running {
+		o.Building[b.Resource] = true
+	}
+	o.Builds = map[string]*zdap.BuildStatus{}
+	for _, ct := range o.Containers {
+		for _, name := range ct.Names {
+			if resource, ok := zfs.BaseResource(strings.TrimPrefix(name, "/")); ok {
+				o.Builds[resource] = bases.PersistedStatus(c.z, resource)
+			}
+		}
+	}
+	o.BuildTimeout = func(resource string) time.Duration {
+		r := c.getResource(resource)
+		if r == nil {
+			r = &internal.Resource{}
+		}
+		return bases.BuildTimeout(r)
+	}
+	o.HasProxy = c.hasProxy
+	return o, nil
+}
+
+// hasProxy returns true if clone is proxied. Outside of the running zdapd, e.g. in zdapd doctor, the proxies of zdapd
+// can only be seen by connecting to their ports.
+func (c *Core) hasProxy(clone zdap.PublicClone) bool {
+	if c.started {
+		return c.proxies.Has(clone.Name)
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(clone.Port)), time.Second)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// fix repairs the drift of f. An orphan dataset of a clone which has been handed out gets a new container, while one
+// that never was is destroyed.
+func (c *Core) fix(f reconcile.Finding) error {
+	switch f.Kind {
+	case reconcile.OrphanDataset:
+		if r := c.getResource(f.Clone.Resource); r != nil && f.Recreate {
+			return cloning.RecreateContainer(c.docker, c.z, r, *f.Clone)
+		}
+		c.proxies.Remove(f.Clone.Name)
+		return bases.DestroyClone(f.Clone.Name, c.docker, c.z)
+	case reconcile.VanishedSnap:
+		c.proxies.Remove(f.Clone.Name)
+		return bases.DestroyClone(f.Clone.Name, c.docker, c.z)
+	case reconcile.OrphanContainer:
+		return c.docker.ContainerRemove(context.Background(), f.ContainerID, container.RemoveOptions{Force: true})
+	case reconcile.MissingProxy:
+		if !c.started {
+			return errors.New("only the running zdapd can add proxies, it adds missing proxies by itself")
+		}
+		r := c.getResource(f.Clone.Resource)
+		if r == nil {
+			return fmt.Errorf("resource %s does not exist", f.Clone.Resource)
+		}
+		return c.proxies.Add(f.Clone.Name, f.Clone.Port, f.Clone.Owner, cloning.CloneTarget(c.docker, f.Clone.Name, r.Docker.Port))
+	case reconcile.StaleNetworkMember:
+		return bases.DisconnectNetwork(c.docker, f.ContainerID)
+	}
+	return fmt.Errorf("unknown kind %s", f.Kind)
+}
+
+// reconcileLoop runs the reconciler each interval and logs what it finds
+func (c *Core) reconcileLoop() {
+	for range time.Tick(c.reconcileConfig.Interval) {
+		findings, err := c.Reconcile(c.reconcileConfig.Fix)
+		if err != nil {
+			fmt.Println("[RECONCILE] Error:", err)
+			continue
+		}
+		for _, f := range findings {
+			switch {
+			case f.Fixed:
+				fmt.Printf("[RECONCILE] Fixed %s %s, %s\n", f.Kind, f.Name, f.Detail)
+			case f.Err != nil:
+				fmt.Printf("[RECONCILE] Error: could not fix %s %s, %s, %v\n", f.Kind, f.Name, f.Detail, f.Err)
+			default:
+				fmt.Printf("[RECONCILE] Found %s %s, %s\n", f.Kind, f.Name, f.Detail)
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"time"
+
+	"github.com/modfin/zdap"
+	"github.com/modfin/zdap/internal/servermodel"
+	"github.com/modfin/zdap/internal/utils"
+	"github.com/modfin/zdap/internal/zfs"
+)
+
+// snapAt returns the snaps of resourceName and the index of the one created at
+func (c *Core) snapAt(dss *zfs.Dataset, resourceName string, at time.Time) ([]servermodel.ServerInternalSnapshot, int, error) {
+	if !c.ResourcesExists(resourceName) {
+		return nil, -1, zdap.NewError(zdap.CodeNotFound, "could not find resource %s", resourceName).WithResource(resourceName)
+	}
+	snaps, err := c.GetResourceSnaps(dss, resourceName)
+	if err != nil {
+		return nil, -1, err
+	}
+	for i, s := range snaps {
+		if s.CreatedAt.Equal(at) {
+			return snaps, i, nil
+		}
+	}
+	return nil, -1, zdap.NewError(zdap.CodeNotFound, "could not find snap %s@%s", resourceName, at.Format(utils.TimestampFormat)).
+		WithResource(resourceName).WithSnap(at.Format(utils.TimestampFormat))
+}
+
+// setSnapProperties sets user properties of the snap and lets the clone pool of the resource catch up with a new
+// default snap
+func (c *Core) setSnapProperties(snap servermodel.ServerInternalSnapshot, props map[string]string) error {
+	err := c.z.SetUserProperties(snap.Name, props)
+	if err != nil {
+		return err
+	}
+	if pool := c.clonePool(snap.Resource); pool != nil {
+		pool.TriggerGC()
+	}
+	return nil
+}
+
+// PinSnap makes the snap of resourceName created at the default snap of the resource, the snap pinned before it is
+// unpinned. The pinned snap is held, so that it can not be destroyed until it is unpinned.
+func (c *Core) PinSnap(dss *zfs.Dataset, resourceName string, at time.Time) (*zdap.PublicSnap, error) {
+	snaps, i, err := c.snapAt(dss, resourceName, at)
+	if err != nil {
+		return nil, err
+	}
+	snap := snaps[i]
+	if snap.Deprecated {
+		return nil, zdap.NewError(zdap.CodeConflict, "snap %s is deprecated and can not be pinned", snap.Name).
+			WithResource(resourceName).WithSnap(at.Format(utils.TimestampFormat))
+	}
+	for _, s := range snaps {
+		if s.Pinned && s.Name != snap.Name {
+			err = c.unpin(s)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = c.z.HoldSnap(snap.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = c.setSnapProperties(snap, map[string]string{zfs.PropPinned: "true"})
+	if err != nil {
+		return nil, err
+	}
+	snap.Pinned = true
+	return &snap.PublicSnap, nil
+}
+
+// UnpinSnap unpins the snap of resourceName created at, the latest snap becomes the default snap again
+func (c *Core) UnpinSnap(dss *zfs.Dataset, resourceName string, at time.Time) (*zdap.PublicSnap, error) {
+	snaps, i, err := c.snapAt(dss, resourceName, at)
+	if err != nil {
+		return nil, err
+	}
+	snap := snaps[i]
+	err = c.setSnapProperties(snap, map[string]string{zfs.PropPinned: "false"})
+	if err == nil {
+		err = c.z.ReleaseSnap(snap.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	snap.Pinned = false
+	return &snap.PublicSnap, nil
+}
+
+// unpin unpins a snap pinned before another snap is pinned
+func (c *Core) unpin(snap servermodel.ServerInternalSnapshot) error {
+	err := c.z.SetUserProperties(snap.Name, map[string]string{zfs.PropPinned: "false"})
+	if err != nil {
+		return err
+	}
+	return c.z.ReleaseSnap(snap.Name)
+}
+
+// DeprecateSnap hides the snap of resourceName created at from new clones, existing clones are kept. A pinned snap is
+// unpinned.
+func (c *Core) DeprecateSnap(dss *zfs.Dataset, resourceName string, at time.Time, reason string) (*zdap.PublicSnap, error) {
+	snaps, i, err := c.snapAt(dss, resourceName, at)
+	if err != nil {
+		return nil, err
+	}
+	snap := snaps[i]
+	if reason == "" {
+		reason = "deprecated"
+	}
+	err = c.setSnapProperties(snap, map[string]string{
+		zfs.PropDeprecated:        "true",
+		zfs.PropDeprecationReason: reason,
+		zfs.PropPinned:            "false",
+	})
+	if err == nil {
+		err = c.z.ReleaseSnap(snap.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	snap.Deprecated, snap.DeprecationReason, snap.Pinned = true, reason, false
+	return &snap.PublicSnap, nil
+}
+
+// UndeprecateSnap makes the snap of resourceName created at available to new clones again
+func (c *Core) UndeprecateSnap(dss *zfs.Dataset, resourceName string, at time.Time) (*zdap.PublicSnap, error) {
+	snaps, i, err := c.snapAt(dss, resourceName, at)
+	if err != nil {
+		return nil, err
+	}
+	snap := snaps[i]
+	err = c.setSnapProperties(snap, map[string]string{zfs.PropDeprecated: "false"})
+	if err != nil {
+		return nil, err
+	}
+	snap.Deprecated, snap.DeprecationReason = false, ""
+	return &snap.PublicSnap, nil
+}
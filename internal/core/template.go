@@ -0,0 +1,256 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/modfin/zdap/internal/secrets"
+	"gopkg.in/yaml.v3"
+)
+
+// templateSuffix is the suffix of files holding templates, templates are only used through the extends key of other
+// templates and resources and are never loaded as resources by themselves
+const templateSuffix = ".template.yml"
+
+// interpolatedPaths are the parts of a resource where ${...} references are expanded
+var interpolatedPaths = [][]string{{"docker", "env"}, {"script_env"}, {"restore_params"}, {"clone_params"}, {"source"}}
+
+// resolveTemplates applies the templates each file extends, expands references and decodes the resources. Files that
+// could not be resolved are marked as failed.
+func resolveTemplates(files []*resourceFile, store *secrets.Store) ValidationErrors {
+	var errs ValidationErrors
+	origins := map[*yaml.Node]string{}
+
+	byName := map[string]*resourceFile{}
+	for _, f := range files {
+		f.origins = origins
+		if f.name == "" {
+			continue
+		}
+		first, ok := byName[f.name]
+		if !ok {
+			byName[f.name] = f
+			continue
+		}
+		if f.template || first.template { // duplicate resources are reported when the resources are validated
+			file, line := first.line("name")
+			errs = append(errs, f.errorf("name", "template '%s' is already defined in %s:%d", f.name, file, line))
+		}
+	}
+
+	var chain []*resourceFile
+	var resolve func(f *resourceFile)
+	resolve = func(f *resourceFile) {
+		if f.merged != nil || f.failed {
+			return
+		}
+		own := copyNode(f.root(), f.path, origins)
+		if own == nil {
+			own = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: 1}
+		}
+		if f.extends == "" {
+			f.merged = own
+			return
+		}
+
+		base, ok := byName[f.extends]
+		if !ok {
+			errs = append(errs, f.errorf("extends", "there is no template or resource named '%s'", f.extends))
+			f.failed = true
+			return
+		}
+		chain = append(chain, f)
+		defer func() { chain = chain[:len(chain)-1] }()
+		for i, c := range chain {
+			if c != base {
+				continue
+			}
+			var names []string
+			for _, c := range chain[i:] {
+				names = append(names, c.name)
+			}
+			errs = append(errs, f.errorf("extends", "templates form a cycle, %s -> %s", strings.Join(names, " -> "), base.name))
+			f.failed = true
+			return
+		}
+
+		resolve(base)
+		if base.failed {
+			errs = append(errs, f.errorf("extends", "'%s' could not be resolved", f.extends))
+			f.failed = true
+			return
+		}
+		f.merged = mergeNodes(copyNode(base.merged, "", origins), own)
+	}
+
+	for _, f := range files {
+		resolve(f)
+		if f.failed || f.template {
+			continue
+		}
+		// references are expanded in a copy, as the merged nodes of a resource may be used by resources extending it
+		resolved := copyNode(f.merged, "", origins)
+		ierrs := f.interpolate(resolved, store)
+		if len(ierrs) > 0 {
+			errs = append(errs, ierrs...)
+			f.failed = true
+			continue
+		}
+		err := resolved.Decode(&f.resource)
+		if err != nil {
+			errs = append(errs, ValidationError{File: f.path, Message: fmt.Sprintf("could not decode resource, %v", err)})
+			f.failed = true
+		}
+	}
+	return errs
+}
+
+// copyNode deep copies n and records the file of every copied node in origins, an empty file keeps the origin of the
+// node copied
+func copyNode(n *yaml.Node, file string, origins map[*yaml.Node]string) *yaml.Node {
+	if n == nil {
+		return nil
+	}
+	c := *n
+	c.Content = make([]*yaml.Node, len(n.Content))
+	for i, child := range n.Content {
+		c.Content[i] = copyNode(child, file, origins)
+	}
+	if file == "" {
+		file = origins[n]
+	}
+	origins[&c] = file
+	return &c
+}
+
+// mergeNodes merges over into base, mappings are merged key by key while every other value of over replaces the value
+// of base. Lists are replaced rather than appended to, so that a resource can override e.g. the cmd of a template.
+func mergeNodes(base, over *yaml.Node) *yaml.Node {
+	if base.Kind != yaml.MappingNode || over.Kind != yaml.MappingNode {
+		return over
+	}
+	merged := *over
+	merged.Content = append([]*yaml.Node{}, base.Content...)
+	for i := 0; i+1 < len(over.Content); i += 2 {
+		key, value := over.Content[i], over.Content[i+1]
+		found := false
+		for j := 0; j+1 < len(merged.Content); j += 2 {
+			if merged.Content[j].Value == key.Value {
+				merged.Content[j], merged.Content[j+1] = key, mergeNodes(merged.Content[j+1], value)
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged.Content = append(merged.Content, key, value)
+		}
+	}
+	return &merged
+}
+
+// interpolate expands the references of the interpolated parts of root
+func (f *resourceFile) interpolate(root *yaml.Node, store *secrets.Store) ValidationErrors {
+	var errs ValidationErrors
+	var walk func(n *yaml.Node, field string)
+	walk = func(n *yaml.Node, field string) {
+		if n.Kind != yaml.ScalarNode {
+			for _, c := range n.Content {
+				walk(c, field)
+			}
+			return
+		}
+		file := f.origins[n]
+		value, err := expand(n.Value, filepath.Dir(file), store)
+		if err != nil {
+			errs = append(errs, ValidationError{File: file, Line: n.Line, Field: field, Message: err.Error()})
+			return
+		}
+		n.Value = value
+	}
+
+	for _, path := range interpolatedPaths {
+		n := root
+		for _, key := range path {
+			var next *yaml.Node
+			for i := 0; n != nil && n.Kind == yaml.MappingNode && i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == key {
+					next = n.Content[i+1]
+					break
+				}
+			}
+			n = next
+		}
+		if n != nil {
+			walk(n, strings.Join(path, "."))
+		}
+	}
+	return errs
+}
+
+// expand replaces the references in s with their values, references are written as
+//   - ${NAME} or ${env:NAME}, the value of an environment variable of zdapd
+//   - ${file:path}, the content of a file without its trailing newline, relative paths are relative to dir
+//   - ${secret:name}, a secret of store
+//
+// $${ is expanded to a literal ${
+func expand(s string, dir string, store *secrets.Store) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1])
+			b.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+		end := strings.Index(s[i:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("reference '%s' is missing a closing }", s[i:])
+		}
+		value, err := lookupReference(s[i+2:i+end], dir, store)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+		s = s[i+end+1:]
+	}
+}
+
+func lookupReference(ref string, dir string, store *secrets.Store) (string, error) {
+	kind, key, found := strings.Cut(ref, ":")
+	if !found {
+		kind, key = "env", ref
+	}
+	switch kind {
+	case "env":
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			return "", fmt.Errorf("environment variable '%s' referenced by '${%s}' is not set", key, ref)
+		}
+		return value, nil
+	case "file":
+		path := key
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("could not read file referenced by '${%s}', %w", ref, err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case "secret":
+		if store == nil { // the config is validated without access to the secrets
+			return "${" + ref + "}", nil
+		}
+		return store.Lookup(key)
+	default:
+		return "", fmt.Errorf("unknown reference '${%s}', expected ${env:<name>}, ${file:<path>} or ${secret:<name>}", ref)
+	}
+}
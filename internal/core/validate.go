@@ -0,0 +1,489 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/modfin/zdap/internal"
+	"github.com/modfin/zdap/internal/retrieval"
+	"github.com/modfin/zdap/internal/secrets"
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is a problem found in a resource file, Line is 0 when the problem can't be tied to a line
+type ValidationError struct {
+	File    string
+	Line    int
+	Field   string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	pos := e.File
+	if e.Line > 0 {
+		pos = fmt.Sprintf("%s:%d", e.File, e.Line)
+	}
+	if e.Field == "" {
+		return fmt.Sprintf("%s: %s", pos, e.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", pos, e.Field, e.Message)
+}
+
+// ValidationErrors is every problem found in a config dir, ordered by file and line
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return fmt.Sprintf("invalid resource config, %d error(s)\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+func (e ValidationErrors) sort() {
+	sort.SliceStable(e, func(i, j int) bool {
+		if e[i].File != e[j].File {
+			return e[i].File < e[j].File
+		}
+		return e[i].Line < e[j].Line
+	})
+}
+
+// ValidateConfig loads and validates every resource in dir, the returned error is a ValidationErrors if the
+// resources could be read but are invalid. Secret references are not resolved if store is nil.
+func ValidateConfig(dir string, store *secrets.Store) ([]internal.Resource, error) {
+	return loadResources(dir, store)
+}
+
+// resourceFile is a parsed resource or template file, the nodes are kept to be able to point out lines of invalid
+// values
+type resourceFile struct {
+	path     string
+	node     *yaml.Node
+	template bool
+	name     string
+	extends  string
+
+	merged   *yaml.Node            // the root of the file with the templates it extends applied
+	origins  map[*yaml.Node]string // the file each node of merged was read from
+	failed   bool
+	resource internal.Resource
+}
+
+func parseResourceFile(path string) (*resourceFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read resource file, %w", err)
+	}
+	f := &resourceFile{path: path, node: &yaml.Node{}, template: strings.HasSuffix(path, templateSuffix)}
+	err = yaml.Unmarshal(b, f.node)
+	if err != nil {
+		return nil, f.yamlError(err)
+	}
+
+	// decoding the file by itself reports unknown fields and values of the wrong type at the right line, the resource
+	// is decoded once its templates are applied
+	var raw internal.Resource
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	err = dec.Decode(&raw)
+	if err != nil && !errors.Is(err, io.EOF) { // an empty file is reported as an empty resource
+		return nil, f.yamlError(err)
+	}
+	f.name = raw.Name
+	f.extends = raw.Extends
+	return f, nil
+}
+
+// yamlError turns the "yaml: line N: ..." errors of the yaml package into validation errors
+func (f *resourceFile) yamlError(err error) error {
+	var errs ValidationErrors
+	var typeErr *yaml.TypeError
+	msgs := []string{err.Error()}
+	if errors.As(err, &typeErr) {
+		msgs = typeErr.Errors
+	}
+	for _, msg := range msgs {
+		msg = strings.TrimPrefix(msg, "yaml: ")
+		line := 0
+		if rest, ok := strings.CutPrefix(msg, "line "); ok {
+			num, tail, found := strings.Cut(rest, ": ")
+			if n, err := strconv.Atoi(num); found && err == nil {
+				line, msg = n, tail
+			}
+		}
+		errs = append(errs, ValidationError{File: f.path, Line: line, Message: msg})
+	}
+	return errs
+}
+
+// root returns the root mapping of the file as written, nil if the file is empty
+func (f *resourceFile) root() *yaml.Node {
+	n := f.node
+	if n.Kind == yaml.DocumentNode {
+		if len(n.Content) == 0 {
+			return nil
+		}
+		n = n.Content[0]
+	}
+	return n
+}
+
+// line returns the file and line of the key at path, or of the closest parent that exists. Keys inherited from a
+// template are reported at the line of the template.
+func (f *resourceFile) line(path ...string) (string, int) {
+	n := f.merged
+	if n == nil {
+		n = f.root()
+	}
+	if n == nil {
+		return f.path, 0
+	}
+	file, line := f.path, n.Line
+	for _, key := range path {
+		var next, at *yaml.Node
+		switch n.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == key {
+					next, at = n.Content[i+1], n.Content[i]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			i, err := strconv.Atoi(key)
+			if err == nil && i < len(n.Content) {
+				next, at = n.Content[i], n.Content[i]
+			}
+		}
+		if next == nil {
+			return file, line
+		}
+		line = at.Line
+		if origin, ok := f.origins[at]; ok {
+			file = origin
+		}
+		n = next
+	}
+	return file, line
+}
+
+func (f *resourceFile) errorf(path string, format string, args ...any) ValidationError {
+	var keys []string
+	if path != "" {
+		keys = strings.Split(path, ".")
+	}
+	file, line := f.line(keys...)
+	return ValidationError{File: file, Line: line, Field: path, Message: fmt.Sprintf(format, args...)}
+}
+
+// validate checks a single resource, scripts are resolved relative to dir the same way they are when bases are
+// created
+func (f *resourceFile) validate(dir string) []ValidationError {
+	var errs []ValidationError
+	r := f.resource
+
+	if r.Name == "" {
+		errs = append(errs, f.errorf("name", "must be set"))
+	} else if !validResourceName(r.Name) {
+		errs = append(errs, f.errorf("name", "must only contain lowercase letters, digits, '-', '_' and '.', it is part of zfs property names, got '%s'", r.Name))
+	}
+	if r.Docker.Image == "" {
+		errs = append(errs, f.errorf("docker.image", "must be set"))
+	}
+	if r.Docker.Port <= 0 || r.Docker.Port > 65535 {
+		errs = append(errs, f.errorf("docker.port", "must be a port between 1 and 65535, got %d", r.Docker.Port))
+	}
+	if r.Docker.Healthcheck == "" {
+		errs = append(errs, f.errorf("docker.healthcheck", "must be set in order to know when the container is started"))
+	}
+
+	var scripts []struct{ field, path string }
+	if r.Restore.Driver == "" || r.Creation != "" { // the creation script is optional after a restore driver
+		scripts = append(scripts, struct{ field, path string }{"creation", r.Creation})
+	}
+	if r.Update != "" {
+		scripts = append(scripts, struct{ field, path string }{"update", r.Update})
+	}
+	if r.Verify.Script != "" {
+		scripts = append(scripts, struct{ field, path string }{"verify.script", r.Verify.Script})
+	}
+	if r.Restore.Driver != "" {
+		errs = append(errs, f.validateRestore()...)
+	}
+	switch {
+	case r.Source.Driver == "":
+		scripts = append(scripts, struct{ field, path string }{"retrieval", r.Retrieval})
+	case r.Retrieval != "":
+		errs = append(errs, f.errorf("retrieval", "must not be set together with source, which replaces the retrieval script"))
+	default:
+		errs = append(errs, f.validateSource()...)
+	}
+	for _, script := range scripts {
+		if script.path == "" {
+			errs = append(errs, f.errorf(script.field, "must be set"))
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, script.path))
+		switch {
+		case err != nil:
+			errs = append(errs, f.errorf(script.field, "script '%s' could not be found, %v", script.path, err))
+		case info.IsDir():
+			errs = append(errs, f.errorf(script.field, "script '%s' is a directory", script.path))
+		case info.Mode().Perm()&0111 == 0:
+			errs = append(errs, f.errorf(script.field, "script '%s' is not executable", script.path))
+		}
+	}
+
+	if r.ScriptTimeout < 0 {
+		errs = append(errs, f.errorf("script_timeout", "must not be negative"))
+	}
+	durations := []struct {
+		field string
+		value time.Duration
+	}{
+		{"timeouts.retrieval", r.Timeouts.Retrieval},
+		{"timeouts.restore", r.Timeouts.Restore},
+		{"timeouts.healthy", r.Timeouts.Healthy},
+		{"timeouts.creation", r.Timeouts.Creation},
+		{"timeouts.update", r.Timeouts.Update},
+		{"timeouts.verify", r.Timeouts.Verify},
+		{"retry.backoff", r.Retry.Backoff},
+		{"retry.max_backoff", r.Retry.MaxBackoff},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			errs = append(errs, f.errorf(d.field, "must not be negative"))
+		}
+	}
+	if r.Retry.Attempts < 0 {
+		errs = append(errs, f.errorf("retry.attempts", "must not be negative"))
+	}
+	tables := make([]string, 0, len(r.Verify.MinRows))
+	for table := range r.Verify.MinRows {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		if r.Verify.MinRows[table] < 0 {
+			errs = append(errs, f.errorf("verify.min_rows", "must not be negative, got %d for %s", r.Verify.MinRows[table], table))
+		}
+	}
+	if r.Verify.MaxShrink < 0 || r.Verify.MaxShrink > 100 {
+		errs = append(errs, f.errorf("verify.max_shrink", "must be a percentage between 0 and 100, got %d", r.Verify.MaxShrink))
+	}
+	if r.Build.Weight < 0 {
+		errs = append(errs, f.errorf("build.weight", "must not be negative"))
+	}
+
+	if r.Cron != "" {
+		_, err := cron.ParseStandard(r.Cron)
+		if err != nil {
+			errs = append(errs, f.errorf("cron", "'%s' is not a valid cron schedule, %v", r.Cron, err))
+		}
+	}
+
+	pool := r.ClonePool
+	if pool.MinClones < 0 {
+		errs = append(errs, f.errorf("clone_pool.min_clones", "must not be negative"))
+	}
+	if pool.MinClones > pool.MaxClones {
+		errs = append(errs, f.errorf("clone_pool.min_clones", "must not be larger than max_clones (%d > %d)", pool.MinClones, pool.MaxClones))
+	}
+	if pool.ClaimMaxTimeoutSeconds < 0 {
+		errs = append(errs, f.errorf("clone_pool.claim_max_timeout_seconds", "must not be negative"))
+	}
+	if pool.DefaultTimeoutSeconds < 0 {
+		errs = append(errs, f.errorf("clone_pool.claim_default_timeout_seconds", "must not be negative"))
+	}
+
+	for _, params := range []struct {
+		field string
+		props []string
+	}{{"restore_params.zfs", r.RestoreParams.ZfsProperties}, {"clone_params.zfs", r.CloneParams.ZfsProperties}} {
+		for i, p := range params.props {
+			kv := strings.Split(p, "=")
+			if len(kv) != 2 || kv[0] == "" {
+				errs = append(errs, f.errorf(fmt.Sprintf("%s.%d", params.field, i), "'%s' isn't a valid ZFS property/value combination, expected <property>=<value>", p))
+			}
+		}
+	}
+
+	for _, limits := range []struct {
+		field  string
+		limits internal.Limits
+	}{{"limits", r.Limits}, {"restore_params.limits", r.RestoreParams.Limits}, {"clone_params.limits", r.CloneParams.Limits}} {
+		l := limits.limits
+		if l.CPUs < 0 {
+			errs = append(errs, f.errorf(limits.field+".cpus", "must not be negative"))
+		}
+		if l.Memory > 0 && l.Memory < 6*datasize.MB {
+			errs = append(errs, f.errorf(limits.field+".memory", "must be at least 6MB, got %s", l.Memory.HumanReadable()))
+		}
+		if l.Pids < 0 {
+			errs = append(errs, f.errorf(limits.field+".pids", "must not be negative"))
+		}
+		if l.BlkioWeight != 0 && (l.BlkioWeight < 10 || l.BlkioWeight > 1000) {
+			errs = append(errs, f.errorf(limits.field+".blkio_weight", "must be between 10 and 1000, got %d", l.BlkioWeight))
+		}
+	}
+
+	return errs
+}
+
+// validateSource checks the config of the built-in retrieval driver
+func (f *resourceFile) validateSource() []ValidationError {
+	var errs []ValidationError
+	src := f.resource.Source
+
+	switch src.Driver {
+	case internal.SourceLocal:
+		if src.Path == "" {
+			errs = append(errs, f.errorf("source.path", "must be set"))
+		} else if _, err := filepath.Match(src.Path, ""); err != nil {
+			errs = append(errs, f.errorf("source.path", "'%s' is not a valid glob, %v", src.Path, err))
+		}
+	case internal.SourceHTTP:
+		u, err := url.Parse(src.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, f.errorf("source.url", "must be an http or https url, got '%s'", src.URL))
+		}
+		for i, h := range src.Headers {
+			if k, _, ok := strings.Cut(h, ":"); !ok || strings.TrimSpace(k) == "" {
+				errs = append(errs, f.errorf(fmt.Sprintf("source.headers.%d", i), "must be written as <key>: <value>"))
+			}
+		}
+	case internal.SourceS3:
+		s3 := src.S3
+		if s3.Endpoint != "" {
+			u, err := url.Parse(s3.Endpoint)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, f.errorf("source.s3.endpoint", "must be an http or https url, got '%s'", s3.Endpoint))
+			}
+		}
+		if s3.Bucket == "" {
+			errs = append(errs, f.errorf("source.s3.bucket", "must be set"))
+		}
+		if (s3.Key == "") == (s3.Prefix == "") {
+			errs = append(errs, f.errorf("source.s3", "exactly one of key and prefix must be set"))
+		}
+		if (s3.AccessKey == "") != (s3.SecretKey == "") {
+			errs = append(errs, f.errorf("source.s3", "access_key and secret_key must be set together"))
+		}
+	case internal.SourcePgDump:
+		pg := src.PgDump
+		if pg.Host == "" {
+			errs = append(errs, f.errorf("source.pg_dump.host", "must be set"))
+		}
+		if pg.Database == "" {
+			errs = append(errs, f.errorf("source.pg_dump.database", "must be set"))
+		}
+		if pg.Port < 0 || pg.Port > 65535 {
+			errs = append(errs, f.errorf("source.pg_dump.port", "must be a port between 1 and 65535, got %d", pg.Port))
+		}
+		switch pg.Format {
+		case "", "custom", "plain", "directory":
+		default:
+			errs = append(errs, f.errorf("source.pg_dump.format", "must be custom, plain or directory, got '%s'", pg.Format))
+		}
+		if pg.Jobs < 0 || (pg.Jobs > 0 && pg.Format != "directory") {
+			errs = append(errs, f.errorf("source.pg_dump.jobs", "can only be used with the directory format"))
+		}
+		if src.SHA256 != "" || src.ChecksumSuffix != "" {
+			errs = append(errs, f.errorf("source", "checksums can't be used with the pg_dump driver"))
+		}
+	default:
+		errs = append(errs, f.errorf("source.driver", "unknown driver '%s', expected %s, %s, %s or %s", src.Driver,
+			internal.SourceLocal, internal.SourceHTTP, internal.SourceS3, internal.SourcePgDump))
+	}
+
+	if src.SHA256 != "" && src.ChecksumSuffix != "" {
+		errs = append(errs, f.errorf("source.checksum_suffix", "must not be set together with sha256"))
+	}
+	if src.SHA256 != "" {
+		if _, err := retrieval.ParseChecksum(src.SHA256); err != nil {
+			errs = append(errs, f.errorf("source.sha256", "%v", err))
+		}
+	}
+	return errs
+}
+
+// validateRestore checks the config of the built-in restore driver
+func (f *resourceFile) validateRestore() []ValidationError {
+	var errs []ValidationError
+	rs := f.resource.Restore
+
+	switch rs.Driver {
+	case internal.RestorePgRestore, internal.RestorePsql:
+		if rs.Owner != "" {
+			errs = append(errs, f.errorf("restore.owner", "can only be used with the %s driver", internal.RestorePhysical))
+		}
+		if rs.Driver == internal.RestorePsql && (rs.Jobs != 0 || rs.NoOwner) {
+			errs = append(errs, f.errorf("restore", "jobs and no_owner can only be used with the %s driver", internal.RestorePgRestore))
+		}
+		if rs.Jobs < 0 {
+			errs = append(errs, f.errorf("restore.jobs", "must not be negative"))
+		}
+	case internal.RestorePhysical:
+		if rs.Database != "" || rs.User != "" || len(rs.Roles) > 0 || rs.Jobs != 0 || rs.NoOwner || rs.IgnoreErrors || len(rs.Args) > 0 {
+			errs = append(errs, f.errorf("restore", "only owner can be used with the %s driver", internal.RestorePhysical))
+		}
+		if rs.Owner != "" {
+			u, g, ok := strings.Cut(rs.Owner, ":")
+			_, uerr := strconv.ParseUint(u, 10, 32)
+			_, gerr := strconv.ParseUint(g, 10, 32)
+			if !ok || uerr != nil || gerr != nil {
+				errs = append(errs, f.errorf("restore.owner", "must be written as <uid>:<gid>, got '%s'", rs.Owner))
+			}
+		}
+		if f.resource.Docker.Volume == "" {
+			errs = append(errs, f.errorf("docker.volume", "must be set to the data dir of the container to restore a physical backup"))
+		}
+	default:
+		errs = append(errs, f.errorf("restore.driver", "unknown driver '%s', expected %s, %s or %s", rs.Driver,
+			internal.RestorePgRestore, internal.RestorePsql, internal.RestorePhysical))
+	}
+	return errs
+}
+
+// validateResources validates every file and that resource names are unique
+func validateResources(dir string, files []*resourceFile) ValidationErrors {
+	var errs ValidationErrors
+	seen := map[string]*resourceFile{}
+	for _, f := range files {
+		errs = append(errs, f.validate(dir)...)
+
+		name := f.resource.Name
+		if name == "" {
+			continue
+		}
+		if first, ok := seen[name]; ok {
+			file, line := first.line("name")
+			errs = append(errs, f.errorf("name", "resource '%s' is already defined in %s:%d", name, file, line))
+			continue
+		}
+		seen[name] = f
+	}
+	return errs
+}
+
+// validResourceName reports if name can be used in zfs user property names, which only allow lowercase letters
+func validResourceName(name string) bool {
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package health
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/modfin/zdap"
+)
+
+// Config of the health monitor
+type Config struct {
+	Interval time.Duration // how often the clones are checked, the monitor is off if 0
+	Failures int           // the failed checks in a row after which a clone is repaired
+}
+
+// historySize is the number of checks kept per clone
+const historySize = 20
+
+// State returns the state of a clone container and what is wrong with it, s is nil if the container does not exist
+func State(s *types.ContainerState) (string, string) {
+	switch {
+	case s == nil:
+		return zdap.CloneMissing, "the container does not exist"
+	case s.Restarting:
+		return zdap.CloneStarting, ""
+	case !s.Running || s.Paused:
+		if s.OOMKilled {
+			return zdap.CloneStopped, "the container was killed for using too much memory"
+		}
+		return zdap.CloneStopped, fmt.Sprintf("the container is %s, exit code %d", s.Status, s.ExitCode)
+	case s.Health == nil:
+		return zdap.CloneHealthy, "" // the container has no healthcheck, running is as healthy as it gets
+	}
+
+	switch strings.ToLower(s.Health.Status) {
+	case "healthy":
+		return zdap.CloneHealthy, ""
+	case "starting":
+		return zdap.CloneStarting, ""
+	}
+	detail := "the healthcheck failed"
+	if n := len(s.Health.Log); n > 0 {
+		if out := strings.TrimSpace(s.Health.Log[n-1].Output); out != "" {
+			detail += ", " + out
+		}
+	}
+	return zdap.CloneUnhealthy, detail
+}
+
+// History keeps the latest health checks of every clone
+type History struct {
+	mu     sync.Mutex
+	clones map[string]*zdap.CloneHealth
+}
+
+func NewHistory() *History {
+	return &History{clones: map[string]*zdap.CloneHealth{}}
+}
+
+// Record adds a check of clone and returns the health of clone after it. A starting clone is not healthy, but it is
+// not counted as a failure either.
+func (h *History) Record(clone string, check zdap.HealthCheck) zdap.CloneHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch, ok := h.clones[clone]
+	if !ok {
+		ch = &zdap.CloneHealth{Clone: clone}
+		h.clones[clone] = ch
+	}
+	ch.Healthy = check.State == zdap.CloneHealthy
+	switch {
+	case ch.Healthy:
+		ch.ConsecutiveFailures = 0
+	case check.State != zdap.CloneStarting:
+		ch.ConsecutiveFailures++
+	}
+	ch.History = append(ch.History, check)
+	if len(ch.History) > historySize {
+		ch.History = ch.History[len(ch.History)-historySize:]
+	}
+	return copyHealth(ch)
+}
+
+// Repaired records the repair of clone on its latest check, its failures are counted anew after a repair
+func (h *History) Repaired(clone string, repair string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch, ok := h.clones[clone]
+	if !ok || len(ch.History) == 0 {
+		return
+	}
+	last := &ch.History[len(ch.History)-1]
+	last.Repair = repair
+	if err != nil {
+		last.Error = strings.TrimPrefix(last.Error+", the repair failed, "+err.Error(), ", ")
+	}
+	now := time.Now()
+	ch.Repairs++
+	ch.LastRepairAt = &now
+	ch.ConsecutiveFailures = 0
+}
+
+// Get returns the health of clone, nil if it has not been checked
+func (h *History) Get(clone string) *zdap.CloneHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch, ok := h.clones[clone]
+	if !ok {
+		return nil
+	}
+	cp := copyHealth(ch)
+	return &cp
+}
+
+// Retain forgets the clones that are not in exists
+func (h *History) Retain(exists map[string]bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for name := range h.clones {
+		if !exists[name] {
+			delete(h.clones, name)
+		}
+	}
+}
+
+// Restarted returns true if the clone was restarted since it was last healthy, so that another restart is unlikely to
+// help
+func Restarted(ch zdap.CloneHealth) bool {
+	for i := len(ch.History) - 1; i >= 0; i-- {
+		switch {
+		case ch.History[i].State == zdap.CloneHealthy:
+			return false
+		case ch.History[i].Repair == zdap.RepairRestarted:
+			return true
+		}
+	}
+	return false
+}
+
+func copyHealth(ch *zdap.CloneHealth) zdap.CloneHealth {
+	cp := *ch
+	cp.History = append([]zdap.HealthCheck{}, ch.History...)
+	return cp
+}
@@ -0,0 +1,74 @@
+package health
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/modfin/zdap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestState(t *testing.T) {
+	state := func(s *types.ContainerState) string {
+		st, _ := State(s)
+		return st
+	}
+	assert.Equal(t, zdap.CloneMissing, state(nil))
+	assert.Equal(t, zdap.CloneStopped, state(&types.ContainerState{Status: "exited", ExitCode: 1}))
+	assert.Equal(t, zdap.CloneStarting, state(&types.ContainerState{Running: true, Restarting: true}))
+	assert.Equal(t, zdap.CloneHealthy, state(&types.ContainerState{Running: true}))
+	assert.Equal(t, zdap.CloneStarting, state(&types.ContainerState{Running: true, Health: &types.Health{Status: "starting"}}))
+	assert.Equal(t, zdap.CloneHealthy, state(&types.ContainerState{Running: true, Health: &types.Health{Status: "healthy"}}))
+
+	st, detail := State(&types.ContainerState{Running: true, Health: &types.Health{Status: "unhealthy", Log: []*types.HealthcheckResult{
+		{Output: "psql: error: connection refused\n"},
+	}}})
+	assert.Equal(t, zdap.CloneUnhealthy, st)
+	assert.Equal(t, "the healthcheck failed, psql: error: connection refused", detail)
+
+	_, detail = State(&types.ContainerState{OOMKilled: true})
+	assert.Contains(t, detail, "memory")
+}
+
+func TestHistory(t *testing.T) {
+	h := NewHistory()
+	assert.Nil(t, h.Get("a"))
+
+	check := func(state string) zdap.CloneHealth {
+		return h.Record("a", zdap.HealthCheck{At: time.Now(), State: state})
+	}
+	assert.True(t, check(zdap.CloneHealthy).Healthy)
+	assert.Equal(t, 1, check(zdap.CloneUnhealthy).ConsecutiveFailures)
+	ch := check(zdap.CloneStarting)
+	assert.False(t, ch.Healthy)
+	assert.Equal(t, 1, ch.ConsecutiveFailures, "a starting clone is not a failure")
+	assert.Equal(t, 2, check(zdap.CloneStopped).ConsecutiveFailures)
+	assert.False(t, Restarted(*h.Get("a")))
+
+	h.Repaired("a", zdap.RepairRestarted, errors.New("no such container"))
+	ch = *h.Get("a")
+	assert.Equal(t, 0, ch.ConsecutiveFailures)
+	assert.Equal(t, 1, ch.Repairs)
+	assert.Equal(t, zdap.RepairRestarted, ch.History[3].Repair)
+	assert.Equal(t, "the repair failed, no such container", ch.History[3].Error)
+	assert.True(t, Restarted(ch))
+
+	check(zdap.CloneUnhealthy)
+	assert.True(t, Restarted(*h.Get("a")), "the clone has not been healthy since it was restarted")
+	check(zdap.CloneHealthy)
+	assert.False(t, Restarted(*h.Get("a")))
+
+	for i := 0; i < 2*historySize; i++ {
+		check(zdap.CloneHealthy)
+	}
+	assert.Len(t, h.Get("a").History, historySize)
+
+	ch = *h.Get("a")
+	ch.History[0].State = zdap.CloneMissing
+	assert.Equal(t, zdap.CloneHealthy, h.Get("a").History[0].State, "the health must be returned as a copy")
+
+	h.Retain(map[string]bool{"b": true})
+	assert.Nil(t, h.Get("a"))
+}
@@ -0,0 +1,134 @@
+package ports
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/modfin/zdap"
+)
+
+// Registry hands out clone ports from a configured range. The assignments are persisted in the zdap:port
+// property of each clone, the registry only keeps track of ports that have been reserved but not yet persisted.
+type Registry struct {
+	min, max int
+	stable   bool
+
+	mu       sync.Mutex
+	reserved map[int]time.Time
+}
+
+// reservationTimeout is how long a reserved port is kept if it is never released, e.g. if zdapd crashes mid clone
+const reservationTimeout = 10 * time.Minute
+
+func NewRegistry(min, max int, stable bool) (*Registry, error) {
+	if min <= 0 || max > 65535 || min > max {
+		return nil, fmt.Errorf("invalid port range %d-%d", min, max)
+	}
+	return &Registry{min: min, max: max, stable: stable, reserved: map[int]time.Time{}}, nil
+}
+
+// Stable reports if an owners clones of a resource keep their port when recreated
+func (r *Registry) Stable() bool {
+	return r.stable
+}
+
+// ParseRange parses a port range on the form <min>-<max>
+func ParseRange(s string) (int, int, error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("port range '%s' must be on the form <min>-<max>", s)
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range '%s', %w", s, err)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range '%s', %w", s, err)
+	}
+	return min, max, nil
+}
+
+// Reserve picks a port for a new clone of resource owned by owner. assigned must return the clones that
+// currently exist, it is called while the registry is locked so that two concurrent reservations never get the
+// same port. The returned release func must be called once the port has been persisted on the clone, or the
+// clone creation failed.
+//
+// If the registry is stable, non pooled clones of the same owner and resource share a port, and a port derived
+// from owner and resource is preferred for the first one.
+func (r *Registry) Reserve(owner, resource string, pooled bool, assigned func() ([]zdap.PublicClone, error)) (int, func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clones, err := assigned()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	now := time.Now()
+	used := map[int]bool{}
+	for p, at := range r.reserved {
+		if now.Sub(at) > reservationTimeout {
+			delete(r.reserved, p)
+			continue
+		}
+		used[p] = true
+	}
+
+	stable := r.stable && !pooled
+	var latest *zdap.PublicClone
+	for i, c := range clones {
+		used[c.Port] = true
+		if stable && !c.ClonePooled && c.Port != 0 && c.Owner == owner && c.Resource == resource {
+			if latest == nil || c.CreatedAt.After(latest.CreatedAt) {
+				latest = &clones[i]
+			}
+		}
+	}
+	if latest != nil && latest.Port >= r.min && latest.Port <= r.max {
+		return latest.Port, func() {}, nil
+	}
+
+	size := r.max - r.min + 1
+	start := 0
+	if stable {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(owner + "\x00" + resource))
+		start = int(h.Sum32() % uint32(size))
+	}
+	for i := 0; i < size; i++ {
+		port := r.min + (start+i)%size
+		if used[port] || !available(port) {
+			continue
+		}
+		r.reserved[port] = now
+		return port, r.release(port), nil
+	}
+	return 0, nil, zdap.NewError(zdap.CodeUnavailable, "no free port in range %d-%d", r.min, r.max).WithRetryAfter(time.Minute)
+}
+
+func (r *Registry) release(port int) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			delete(r.reserved, port)
+			r.mu.Unlock()
+		})
+	}
+}
+
+// available checks that nothing outside of zdap is listening on the port
+func available(port int) bool {
+	l, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
+	if err != nil {
+		return false
+	}
+	_ = l.Close()
+	return true
+}
@@ -0,0 +1,119 @@
+package ports
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/modfin/zdap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	min, max, err := ParseRange("40000-40010")
+	assert.NoError(t, err)
+	assert.Equal(t, 40000, min)
+	assert.Equal(t, 40010, max)
+
+	_, _, err = ParseRange("40000")
+	assert.Error(t, err)
+	_, _, err = ParseRange("a-b")
+	assert.Error(t, err)
+}
+
+func TestRegistry_ReserveConcurrent(t *testing.T) {
+	r, err := NewRegistry(41000, 41099, false)
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var persisted []zdap.PublicClone
+	assigned := func() ([]zdap.PublicClone, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]zdap.PublicClone{}, persisted...), nil
+	}
+
+	var wg sync.WaitGroup
+	got := make(chan int, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			port, release, err := r.Reserve("owner", "resource", false, assigned)
+			if !assert.NoError(t, err) {
+				return
+			}
+			if i%2 == 0 {
+				mu.Lock()
+				persisted = append(persisted, zdap.PublicClone{Port: port})
+				mu.Unlock()
+			}
+			release()
+			got <- port
+		}()
+	}
+	wg.Wait()
+	close(got)
+
+	// released ports that were never persisted may be handed out again, persisted ones must be unique
+	mu.Lock()
+	defer mu.Unlock()
+	seen := map[int]bool{}
+	for _, c := range persisted {
+		assert.False(t, seen[c.Port], "port %d was handed out twice", c.Port)
+		seen[c.Port] = true
+		assert.True(t, c.Port >= 41000 && c.Port <= 41099)
+	}
+}
+
+func TestRegistry_ReserveUntilReleased(t *testing.T) {
+	r, err := NewRegistry(41100, 41101, false)
+	require.NoError(t, err)
+	none := func() ([]zdap.PublicClone, error) { return nil, nil }
+
+	p1, _, err := r.Reserve("a", "resource", false, none)
+	require.NoError(t, err)
+	p2, release2, err := r.Reserve("b", "resource", false, none)
+	require.NoError(t, err)
+	assert.NotEqual(t, p1, p2)
+
+	_, _, err = r.Reserve("c", "resource", false, none)
+	assert.Error(t, err, "range should be exhausted")
+
+	release2()
+	p3, _, err := r.Reserve("c", "resource", false, none)
+	require.NoError(t, err)
+	assert.Equal(t, p2, p3)
+}
+
+func TestRegistry_Stable(t *testing.T) {
+	r, err := NewRegistry(41200, 41299, true)
+	require.NoError(t, err)
+	none := func() ([]zdap.PublicClone, error) { return nil, nil }
+
+	p1, release, err := r.Reserve("owner", "resource", false, none)
+	require.NoError(t, err)
+	release()
+	p2, release, err := r.Reserve("owner", "resource", false, none)
+	require.NoError(t, err)
+	release()
+	assert.Equal(t, p1, p2, "owner and resource should map to the same port")
+
+	existing := func() ([]zdap.PublicClone, error) {
+		return []zdap.PublicClone{
+			{Owner: "owner", Resource: "resource", Port: 41250, CreatedAt: time.Now().Add(-time.Hour)},
+			{Owner: "owner", Resource: "resource", Port: 41251, CreatedAt: time.Now()},
+			{Owner: "other", Resource: "resource", Port: 41252, CreatedAt: time.Now()},
+		}, nil
+	}
+	p, release, err := r.Reserve("owner", "resource", false, existing)
+	require.NoError(t, err)
+	release()
+	assert.Equal(t, 41251, p, "a refreshed clone should share the port of the latest clone")
+
+	p, release, err = r.Reserve("owner", "resource", true, existing)
+	require.NoError(t, err)
+	release()
+	assert.NotContains(t, []int{41250, 41251, 41252}, p, "pooled clones never share ports")
+}
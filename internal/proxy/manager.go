@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Manager owns the listening ports of all clones on a zdapd server and forwards them to the clone containers,
+// replacing the per clone zdap-proxy container.
+//
+// Several clones may share a port, new connections are then forwarded to the clone that was added last. This
+// lets a stable port follow an owners clone of a resource when it is refreshed.
+type Manager struct {
+	drainTimeout time.Duration
+
+	mu          sync.Mutex
+	seq         uint64
+	listeners   map[int]*TCPProxy
+	routes      map[string]*route
+	tlsConfig   *tls.Config
+	tlsRequired bool
+}
+
+type route struct {
+	port    int
+	owner   string
+	resolve func() (string, error)
+	seq     uint64
+}
+
+func NewManager(drainTimeout time.Duration) *Manager {
+	return &Manager{
+		drainTimeout: drainTimeout,
+		listeners:    map[int]*TCPProxy{},
+		routes:       map[string]*route{},
+	}
+}
+
+// EnableTLS lets clients tunnel their connections over (mutual) TLS, plain connections are rejected if required
+// is set. It only applies to proxies added after the call.
+func (m *Manager) EnableTLS(config *tls.Config, required bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tlsConfig = config
+	m.tlsRequired = required
+}
+
+// Add starts listening on listenPort and forwards every connection to the address returned by resolveTarget. Clients
+// tunneling over TLS must present a certificate issued to owner.
+func (m *Manager) Add(name string, listenPort int, owner string, resolveTarget func() (string, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r, ok := m.routes[name]; ok {
+		if r.port == listenPort {
+			return nil
+		}
+		return fmt.Errorf("a proxy for %s already exists on port %d", name, r.port)
+	}
+
+	m.seq++
+	r := &route{port: listenPort, owner: owner, resolve: resolveTarget, seq: m.seq}
+	if _, ok := m.listeners[listenPort]; ok {
+		log.Printf("Routing new connections on port %d to %s\n", listenPort, name)
+		m.routes[name] = r
+		return nil
+	}
+
+	p := &TCPProxy{
+		ListenPort:    listenPort,
+		ResolveTarget: m.resolver(listenPort),
+		Metric: &Metric{
+			CreatedAt: time.Now(),
+		},
+		MetricServer: true,
+		TLSConfig:    m.tlsConfig,
+		TLSRequired:  m.tlsRequired,
+		VerifyPeer:   m.verifier(listenPort),
+	}
+	err := p.Start(context.Background())
+	if err != nil {
+		return fmt.Errorf("could not start proxy for %s on port %d, %w", name, listenPort, err)
+	}
+	m.listeners[listenPort] = p
+	m.routes[name] = r
+	return nil
+}
+
+// latest returns the latest route added for port, or nil if there is none
+func (m *Manager) latest(port int) *route {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var latest *route
+	for _, r := range m.routes {
+		if r.port == port && (latest == nil || r.seq > latest.seq) {
+			latest = r
+		}
+	}
+	return latest
+}
+
+// resolver resolves the target of the latest route added for port
+func (m *Manager) resolver(port int) func() (string, error) {
+	return func() (string, error) {
+		latest := m.latest(port)
+		if latest == nil {
+			return "", fmt.Errorf("no route for port %d", port)
+		}
+		return latest.resolve()
+	}
+}
+
+// verifier checks that a client certificate is issued to the owner of the latest route added for port
+func (m *Manager) verifier(port int) func(commonName string) error {
+	return func(commonName string) error {
+		latest := m.latest(port)
+		if latest == nil {
+			return fmt.Errorf("no route for port %d", port)
+		}
+		m.mu.Lock()
+		owner := latest.owner
+		m.mu.Unlock()
+		if commonName != owner {
+			return fmt.Errorf("the certificate is issued to %s, the clone on port %d is owned by %s", commonName, port, owner)
+		}
+		return nil
+	}
+}
+
+// SetOwner changes the owner of the route for name, e.g. when a pooled clone is claimed
+func (m *Manager) SetOwner(name, owner string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.routes[name]; ok {
+		r.owner = owner
+	}
+}
+
+// Remove removes the route for name. If it was the last route on its port, the port stops accepting new connections
+// before Remove returns, and the open connections are drained in the background. The returned channel is closed once
+// they are.
+func (m *Manager) Remove(name string) <-chan struct{} {
+	done := make(chan struct{})
+	m.mu.Lock()
+	r, ok := m.routes[name]
+	if !ok {
+		m.mu.Unlock()
+		close(done)
+		return done
+	}
+	delete(m.routes, name)
+	for _, other := range m.routes {
+		if other.port == r.port {
+			m.mu.Unlock()
+			close(done)
+			return done
+		}
+	}
+	p := m.listeners[r.port]
+	delete(m.listeners, r.port)
+	m.mu.Unlock()
+
+	if p == nil {
+		close(done)
+		return done
+	}
+	p.StopAccepting()
+	log.Printf("Draining proxy for %s on port %d (%d open connections)\n", name, p.ListenPort, p.ActiveConnections())
+	go func() {
+		p.Drain(m.drainTimeout)
+		close(done)
+	}()
+	return done
+}
+
+func (m *Manager) Has(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.routes[name]
+	return ok
+}
+
+func (m *Manager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close drops all proxies and their connections without draining
+func (m *Manager) Close() {
+	m.mu.Lock()
+	listeners := m.listeners
+	m.listeners = map[int]*TCPProxy{}
+	m.routes = map[string]*route{}
+	m.mu.Unlock()
+
+	for _, p := range listeners {
+		p.Stop()
+	}
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/modfin/zdap/internal/certs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				s := bufio.NewScanner(c)
+				for s.Scan() {
+					_, _ = fmt.Fprintln(c, s.Text())
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestManager_AddRemove(t *testing.T) {
+	target := echoServer(t)
+	port := freePort(t)
+
+	m := NewManager(time.Second)
+	defer m.Close()
+	require.NoError(t, m.Add("clone-1", port, "owner", func() (string, error) { return target, nil }))
+	assert.True(t, m.Has("clone-1"))
+	assert.NoError(t, m.Add("clone-1", port, "owner", nil), "adding the same proxy twice should be a no-op")
+	assert.Error(t, m.Add("clone-1", port+1, "owner", nil))
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	_, err = fmt.Fprintln(conn, "ping")
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}()
+	start := time.Now()
+	drained := m.Remove("clone-1")
+	assert.Less(t, time.Since(start), 50*time.Millisecond, "remove should not wait for the open connection")
+	assert.False(t, m.Has("clone-1"))
+
+	_, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.Error(t, err, "the port must stop accepting connections before remove returns")
+
+	select {
+	case <-drained:
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond, "the drain must wait for the open connection")
+	case <-time.After(time.Second):
+		t.Error("the drain should finish once the open connection is closed")
+	}
+}
+
+func TestManager_RemoveDrainTimeout(t *testing.T) {
+	target := echoServer(t)
+	port := freePort(t)
+
+	m := NewManager(100 * time.Millisecond)
+	require.NoError(t, m.Add("clone-1", port, "owner", func() (string, error) { return target, nil }))
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintln(conn, "ping")
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	_, err = r.ReadString('\n')
+	require.NoError(t, err)
+
+	<-m.Remove("clone-1")
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = r.ReadString('\n')
+	assert.Error(t, err, "connection should be closed once the drain timeout is reached")
+}
+
+func TestManager_SharedPort(t *testing.T) {
+	first := echoServer(t)
+	port := freePort(t)
+
+	m := NewManager(time.Second)
+	defer m.Close()
+	require.NoError(t, m.Add("clone-1", port, "owner", func() (string, error) { return first, nil }))
+	require.NoError(t, m.Add("clone-2", port, "owner", func() (string, error) { return "", fmt.Errorf("clone-2 is down") }))
+
+	// new connections go to clone-2, which can not be resolved
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	assert.Error(t, err)
+	conn.Close()
+
+	// removing clone-2 routes new connections back to clone-1 and keeps the port open
+	m.Remove("clone-2")
+	conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintln(conn, "ping")
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+}
+
+func TestManager_TLSOwner(t *testing.T) {
+	authority, err := certs.LoadOrCreate(t.TempDir())
+	require.NoError(t, err)
+	serverTLS, err := authority.ServerTLSConfig([]string{"127.0.0.1"})
+	require.NoError(t, err)
+	clientTLS := func(owner string) *tls.Config {
+		cert, key, _, err := authority.Issue(owner, nil, false)
+		require.NoError(t, err)
+		cfg, err := certs.ClientTLSConfig(string(cert), string(key), string(authority.CertificatePEM()), "")
+		require.NoError(t, err)
+		return cfg
+	}
+	ping := func(port int, owner string) error {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), clientTLS(owner))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = fmt.Fprintln(conn, "ping")
+		if err != nil {
+			return err
+		}
+		_, err = bufio.NewReader(conn).ReadString('\n')
+		return err
+	}
+
+	target := echoServer(t)
+	port := freePort(t)
+	m := NewManager(time.Second)
+	defer m.Close()
+	m.EnableTLS(serverTLS, true)
+	require.NoError(t, m.Add("clone-1", port, "alice", func() (string, error) { return target, nil }))
+
+	assert.NoError(t, ping(port, "alice"))
+	assert.Error(t, ping(port, "mallory"), "a certificate issued to another owner must be rejected")
+
+	m.SetOwner("clone-1", "mallory")
+	assert.NoError(t, ping(port, "mallory"))
+	assert.Error(t, ping(port, "alice"))
+}
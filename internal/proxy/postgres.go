@@ -0,0 +1,780 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pgProtocolVersion3 = 196608
+	pgCancelRequest    = 80877102
+	pgSSLRequest       = 80877103
+	pgGSSENCRequest    = 80877104
+
+	pgMaxStartupLength = 10000
+	pgMaxQueryLength   = 300
+	pgMaxStatements    = 1000
+	pgOtherStatements  = "<other>"
+)
+
+// Postgres makes a TCPProxy aware of the postgres wire protocol, so that the queries of every connection can be
+// logged and measured, and statements that may write can be rejected.
+//
+// Connections that negotiate SSL or GSS encryption with the server can not be inspected and are proxied as is.
+type Postgres struct {
+	LogQueries bool
+	// ReadOnly rejects statements that may write, and starts every session with default_transaction_read_only=on
+	// so that the server rejects writes hidden in e.g. function calls.
+	ReadOnly bool
+
+	mu         sync.Mutex
+	connSeq    uint64
+	statements map[string]*StatementMetric
+}
+
+type StatementMetric struct {
+	Count    int64   `json:"count"`
+	Errors   int64   `json:"errors"`
+	Rejected int64   `json:"rejected"`
+	TotalMs  float64 `json:"total_ms"`
+	MaxMs    float64 `json:"max_ms"`
+}
+
+// Statements returns the metrics of the statements seen so far, keyed by the normalized statement
+func (p *Postgres) Statements() map[string]StatementMetric {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make(map[string]StatementMetric, len(p.statements))
+	for k, v := range p.statements {
+		stats[k] = *v
+	}
+	return stats
+}
+
+func (p *Postgres) record(query string, d time.Duration, failed, rejected bool) {
+	key := normalizeQuery(query)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.statements == nil {
+		p.statements = map[string]*StatementMetric{}
+	}
+	m, ok := p.statements[key]
+	if !ok && len(p.statements) >= pgMaxStatements {
+		key = pgOtherStatements
+		m, ok = p.statements[key]
+	}
+	if !ok {
+		m = &StatementMetric{}
+		p.statements[key] = m
+	}
+	m.Count++
+	if failed {
+		m.Errors++
+	}
+	if rejected {
+		m.Rejected++
+	}
+	ms := float64(d) / float64(time.Millisecond)
+	m.TotalMs += ms
+	if ms > m.MaxMs {
+		m.MaxMs = ms
+	}
+}
+
+const (
+	pgSimple = iota
+	pgExtended
+	pgSync
+)
+
+type pgStatement struct {
+	kind   int
+	query  string
+	start  time.Time
+	tag    string
+	err    string
+	reject string
+}
+
+type pgSession struct {
+	p        *Postgres
+	id       uint64
+	user     string
+	database string
+
+	in, out   net.Conn
+	inR, outR *bufio.Reader
+
+	written, read int64
+
+	mu      sync.Mutex
+	pending []*pgStatement
+
+	// only used by the frontend pump
+	prepared map[string]string
+	portals  map[string]string
+}
+
+// proxy forwards the connection between in and out until both directions are done
+func (p *Postgres) proxy(in, out net.Conn) (written int64, read int64) {
+	p.mu.Lock()
+	p.connSeq++
+	id := p.connSeq
+	p.mu.Unlock()
+
+	s := &pgSession{
+		p:        p,
+		id:       id,
+		in:       in,
+		out:      out,
+		inR:      bufio.NewReader(in),
+		outR:     bufio.NewReader(out),
+		prepared: map[string]string{},
+		portals:  map[string]string{},
+	}
+
+	raw, err := s.startup()
+	if err != nil {
+		log.Printf("[pg %d] startup failed, %v\n", s.id, err)
+		_ = in.Close()
+		_ = out.Close()
+		return s.written, s.read
+	}
+	if raw {
+		log.Printf("[pg %d] connection is encrypted or not a session, proxying it as is\n", s.id)
+	} else {
+		log.Printf("[pg %d] session started for %s@%s\n", s.id, s.user, s.database)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if raw {
+			w, _ := io.Copy(out, s.inR)
+			s.written += w
+		} else {
+			err := s.frontend()
+			if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("[pg %d] client error, %v\n", s.id, err)
+			}
+		}
+		_ = out.Close()
+	}()
+
+	if raw {
+		r, _ := io.Copy(in, s.outR)
+		s.read += r
+	} else {
+		err := s.backend()
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+			log.Printf("[pg %d] server error, %v\n", s.id, err)
+		}
+	}
+	_ = in.Close()
+	<-done
+	if !raw {
+		log.Printf("[pg %d] session ended for %s@%s\n", s.id, s.user, s.database)
+	}
+	return s.written, s.read
+}
+
+// startup handles the startup phase of the connection, raw is returned if the rest of the connection can not be
+// inspected
+func (s *pgSession) startup() (raw bool, err error) {
+	for {
+		var l [4]byte
+		_, err = io.ReadFull(s.inR, l[:])
+		if err != nil {
+			return false, err
+		}
+		n := int(binary.BigEndian.Uint32(l[:]))
+		if n < 8 || n > pgMaxStartupLength {
+			return false, fmt.Errorf("invalid startup message length %d", n)
+		}
+		body := make([]byte, n-4)
+		_, err = io.ReadFull(s.inR, body)
+		if err != nil {
+			return false, err
+		}
+
+		code := binary.BigEndian.Uint32(body)
+		switch code {
+		case pgSSLRequest, pgGSSENCRequest:
+			err = s.writeOut(append(l[:], body...))
+			if err != nil {
+				return false, err
+			}
+			answer, err := s.outR.ReadByte()
+			if err != nil {
+				return false, err
+			}
+			_, err = s.in.Write([]byte{answer})
+			if err != nil {
+				return false, err
+			}
+			s.read++
+			if answer != 'N' {
+				return true, nil
+			}
+		case pgProtocolVersion3:
+			params := parseStartupParams(body[4:])
+			for _, kv := range params {
+				switch kv[0] {
+				case "user":
+					s.user = kv[1]
+				case "database":
+					s.database = kv[1]
+				}
+			}
+			if s.database == "" {
+				s.database = s.user
+			}
+			if s.p.ReadOnly {
+				params = setStartupParam(params, "default_transaction_read_only", "on")
+			}
+			return false, s.writeOut(startupMessage(code, params))
+		default:
+			return true, s.writeOut(append(l[:], body...))
+		}
+	}
+}
+
+func parseStartupParams(b []byte) [][2]string {
+	var params [][2]string
+	parts := bytes.Split(b, []byte{0})
+	for i := 0; i+1 < len(parts); i += 2 {
+		if len(parts[i]) == 0 {
+			break
+		}
+		params = append(params, [2]string{string(parts[i]), string(parts[i+1])})
+	}
+	return params
+}
+
+func setStartupParam(params [][2]string, key, value string) [][2]string {
+	for i, kv := range params {
+		if kv[0] == key {
+			params[i][1] = value
+			return params
+		}
+	}
+	return append(params, [2]string{key, value})
+}
+
+func startupMessage(code uint32, params [][2]string) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0, 0, 0, 0})
+	_ = binary.Write(&b, binary.BigEndian, code)
+	for _, kv := range params {
+		b.WriteString(kv[0])
+		b.WriteByte(0)
+		b.WriteString(kv[1])
+		b.WriteByte(0)
+	}
+	b.WriteByte(0)
+	msg := b.Bytes()
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)))
+	return msg
+}
+
+func (s *pgSession) writeOut(b []byte) error {
+	_, err := s.out.Write(b)
+	s.written += int64(len(b))
+	return err
+}
+
+func (s *pgSession) writeIn(b []byte) error {
+	_, err := s.in.Write(b)
+	s.read += int64(len(b))
+	return err
+}
+
+// readMessage reads the header of the next message, the body is only read if inspect returns true for its type.
+// Otherwise the caller must consume the n bytes of the body from r.
+func readMessage(r *bufio.Reader, inspect func(typ byte) bool) (header []byte, body []byte, n int64, err error) {
+	header = make([]byte, 5)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	n = int64(binary.BigEndian.Uint32(header[1:])) - 4
+	if n < 0 {
+		return nil, nil, 0, fmt.Errorf("invalid message length %d", n+4)
+	}
+	if !inspect(header[0]) {
+		return header, nil, n, nil
+	}
+	body = make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return header, body, 0, err
+}
+
+func message(typ byte, body []byte) []byte {
+	msg := make([]byte, 5, 5+len(body))
+	msg[0] = typ
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(body)+4))
+	return append(msg, body...)
+}
+
+func cstrings(b []byte, n int) []string {
+	var strs []string
+	for i := 0; i < n; i++ {
+		idx := bytes.IndexByte(b, 0)
+		if idx < 0 {
+			strs = append(strs, string(b))
+			b = nil
+			continue
+		}
+		strs = append(strs, string(b[:idx]))
+		b = b[idx+1:]
+	}
+	return strs
+}
+
+// frontend forwards the messages from the client to the server
+func (s *pgSession) frontend() error {
+	inspect := func(typ byte) bool {
+		switch typ {
+		case 'Q', 'P', 'B', 'E', 'C', 'S':
+			return true
+		}
+		return false
+	}
+
+	// discarding holds the reason an extended query batch is rejected, its messages are dropped until Sync
+	var discarding string
+	for {
+		header, body, n, err := readMessage(s.inR, inspect)
+		if err != nil {
+			return err
+		}
+		if body == nil {
+			if discarding != "" {
+				_, err = io.CopyN(io.Discard, s.inR, n)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			err = s.writeOut(header)
+			if err != nil {
+				return err
+			}
+			w, err := io.CopyN(s.out, s.inR, n)
+			s.written += w
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		forward := true
+		switch header[0] {
+		case 'Q':
+			query := cstrings(body, 1)[0]
+			if reason := s.p.rejectReason(query); reason != "" {
+				// let the server answer a sync instead, so the error is sent in order with the other responses
+				s.rejected(query, reason)
+				s.push(&pgStatement{kind: pgSync, reject: reason})
+				err = s.writeOut(message('S', nil))
+				if err != nil {
+					return err
+				}
+				forward = false
+				break
+			}
+			s.push(&pgStatement{kind: pgSimple, query: query, start: time.Now()})
+		case 'P':
+			if discarding != "" {
+				forward = false
+				break
+			}
+			parts := cstrings(body, 2)
+			if reason := s.p.rejectReason(parts[1]); reason != "" {
+				s.rejected(parts[1], reason)
+				discarding = reason
+				forward = false
+				break
+			}
+			s.prepared[parts[0]] = parts[1]
+		case 'B':
+			if discarding != "" {
+				forward = false
+				break
+			}
+			parts := cstrings(body, 2)
+			s.portals[parts[0]] = s.prepared[parts[1]]
+		case 'E':
+			if discarding != "" {
+				forward = false
+				break
+			}
+			portal := cstrings(body, 1)[0]
+			s.push(&pgStatement{kind: pgExtended, query: s.portals[portal], start: time.Now()})
+		case 'C':
+			if discarding != "" {
+				forward = false
+				break
+			}
+			if len(body) > 0 {
+				name := cstrings(body[1:], 1)[0]
+				if body[0] == 'S' {
+					delete(s.prepared, name)
+				} else {
+					delete(s.portals, name)
+				}
+			}
+		case 'S':
+			s.push(&pgStatement{kind: pgSync, reject: discarding})
+			discarding = ""
+		}
+		if !forward {
+			continue
+		}
+		err = s.writeOut(append(header, body...))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// backend forwards the messages from the server to the client
+func (s *pgSession) backend() error {
+	inspect := func(typ byte) bool {
+		switch typ {
+		case 'C', 'E', 'I', 's', 'Z':
+			return true
+		}
+		return false
+	}
+
+	for {
+		header, body, n, err := readMessage(s.outR, inspect)
+		if err != nil {
+			return err
+		}
+		if body == nil {
+			err = s.writeIn(header)
+			if err != nil {
+				return err
+			}
+			r, err := io.CopyN(s.in, s.outR, n)
+			s.read += r
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch header[0] {
+		case 'C':
+			s.complete(cstrings(body, 1)[0], "")
+		case 'I':
+			s.complete("EMPTY", "")
+		case 's':
+			s.complete("SUSPENDED", "")
+		case 'E':
+			s.complete("", errorMessage(body))
+		case 'Z':
+			if reason := s.ready(); reason != "" {
+				err = s.writeIn(errorResponse("25006", reason))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		err = s.writeIn(append(header, body...))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *pgSession) push(stmt *pgStatement) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, stmt)
+}
+
+// complete handles a command completion or error from the server
+func (s *pgSession) complete(tag string, errMsg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return
+	}
+	head := s.pending[0]
+	switch head.kind {
+	case pgSimple:
+		if tag != "" {
+			head.tag = tag
+		}
+		if errMsg != "" {
+			head.err = errMsg
+		}
+	case pgExtended:
+		head.tag = tag
+		head.err = errMsg
+		s.pending = s.pending[1:]
+		s.finish(head)
+		if errMsg != "" {
+			// the server skips everything until the next sync after an error
+			for len(s.pending) > 0 && s.pending[0].kind == pgExtended {
+				s.pending = s.pending[1:]
+			}
+		}
+	}
+}
+
+// ready handles a ready for query message from the server, it returns the reason of a rejected statement that
+// should be reported to the client before it
+func (s *pgSession) ready() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.pending) > 0 {
+		head := s.pending[0]
+		s.pending = s.pending[1:]
+		switch head.kind {
+		case pgSimple:
+			s.finish(head)
+			return ""
+		case pgSync:
+			return head.reject
+		}
+	}
+	return ""
+}
+
+func (s *pgSession) finish(stmt *pgStatement) {
+	d := time.Since(stmt.start)
+	s.p.record(stmt.query, d, stmt.err != "", false)
+	if !s.p.LogQueries {
+		return
+	}
+	result := stmt.tag
+	if stmt.err != "" {
+		result = "ERROR: " + stmt.err
+	}
+	log.Printf("[pg %d %s@%s] %.3fms %s -> %s\n", s.id, s.user, s.database, float64(d)/float64(time.Millisecond), truncateQuery(stmt.query), result)
+}
+
+func (s *pgSession) rejected(query, reason string) {
+	s.p.record(query, 0, false, true)
+	log.Printf("[pg %d %s@%s] rejected %s -> %s\n", s.id, s.user, s.database, truncateQuery(query), reason)
+}
+
+func errorMessage(body []byte) string {
+	for len(body) > 1 {
+		field := body[0]
+		idx := bytes.IndexByte(body[1:], 0)
+		if idx < 0 {
+			break
+		}
+		if field == 'M' {
+			return string(body[1 : idx+1])
+		}
+		body = body[idx+2:]
+	}
+	return "unknown error"
+}
+
+func errorResponse(code, msg string) []byte {
+	var b bytes.Buffer
+	for _, f := range [][2]string{{"S", "ERROR"}, {"V", "ERROR"}, {"C", code}, {"M", msg}} {
+		b.WriteString(f[0])
+		b.WriteString(f[1])
+		b.WriteByte(0)
+	}
+	b.WriteByte(0)
+	return message('E', b.Bytes())
+}
+
+var (
+	whitespaceReg = regexp.MustCompile(`\s+`)
+	stringReg     = regexp.MustCompile(`'(?:[^']|'')*'`)
+	numberReg     = regexp.MustCompile(`(^|[^\w$])\d+(?:\.\d+)?`)
+)
+
+// normalizeQuery replaces literals so that statements only differing in values are grouped together
+func normalizeQuery(query string) string {
+	q := stringReg.ReplaceAllString(query, "?")
+	q = numberReg.ReplaceAllString(q, "${1}?")
+	q = strings.TrimSpace(whitespaceReg.ReplaceAllString(q, " "))
+	return truncateQuery(q)
+}
+
+func truncateQuery(query string) string {
+	query = strings.TrimSpace(whitespaceReg.ReplaceAllString(query, " "))
+	if len(query) > pgMaxQueryLength {
+		return query[:pgMaxQueryLength] + "..."
+	}
+	return query
+}
+
+type pgToken struct {
+	word   string
+	depth  int
+	quoted bool // a quoted identifier, its word is kept as is
+}
+
+// sqlStatements splits a query into its statements and returns the upper cased keywords and identifiers of each,
+// quoted identifiers are returned as is while literals and comments are skipped
+func sqlStatements(query string) [][]pgToken {
+	var statements [][]pgToken
+	var current []pgToken
+	depth := 0
+	isWord := func(c byte) bool {
+		return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+	}
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = len(query)
+				continue
+			}
+			i += end + 1
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+				continue
+			}
+			i += end + 4
+		case c == '\'' || c == '"':
+			j := i + 1
+			for j < len(query) {
+				if query[j] == c {
+					if j+1 < len(query) && query[j+1] == c {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			if c == '"' {
+				word := strings.ReplaceAll(query[i+1:min(j, len(query))], `""`, `"`)
+				current = append(current, pgToken{word: word, depth: depth, quoted: true})
+			}
+			i = j + 1
+		case c == '$':
+			j := i + 1
+			for j < len(query) && isWord(query[j]) && !(query[j] >= '0' && query[j] <= '9' && j == i+1) {
+				j++
+			}
+			if j < len(query) && query[j] == '$' {
+				tag := query[i : j+1]
+				end := strings.Index(query[j+1:], tag)
+				if end < 0 {
+					i = len(query)
+					continue
+				}
+				i = j + 1 + end + len(tag)
+				continue
+			}
+			i = j
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			depth--
+			i++
+		case c == ';':
+			if len(current) > 0 {
+				statements = append(statements, current)
+			}
+			current = nil
+			depth = 0
+			i++
+		case isWord(c):
+			j := i
+			for j < len(query) && isWord(query[j]) {
+				j++
+			}
+			current = append(current, pgToken{word: strings.ToUpper(query[i:j]), depth: depth})
+			i = j
+		default:
+			i++
+		}
+	}
+	if len(current) > 0 {
+		statements = append(statements, current)
+	}
+	return statements
+}
+
+var pgReadOnlyCommands = map[string]bool{
+	"SELECT": true, "VALUES": true, "TABLE": true, "WITH": true, "SHOW": true, "EXPLAIN": true,
+	"BEGIN": true, "START": true, "COMMIT": true, "END": true, "ROLLBACK": true, "ABORT": true,
+	"SAVEPOINT": true, "RELEASE": true, "SET": true, "RESET": true, "DISCARD": true,
+	"DECLARE": true, "FETCH": true, "MOVE": true, "CLOSE": true, "PREPARE": true, "EXECUTE": true,
+	"DEALLOCATE": true, "LISTEN": true, "UNLISTEN": true, "COPY": true,
+}
+
+var pgWriteKeywords = map[string]bool{
+	"INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true, "TRUNCATE": true, "INTO": true,
+}
+
+// rejectReason returns why a query is rejected in read only mode, or an empty string if it is allowed
+func (p *Postgres) rejectReason(query string) string {
+	if !p.ReadOnly {
+		return ""
+	}
+	for _, tokens := range sqlStatements(query) {
+		command := tokens[0].word
+		if !pgReadOnlyCommands[command] {
+			return fmt.Sprintf("zdap proxy is read-only, %s statements are not allowed", command)
+		}
+		if command == "COPY" && !copiesToStdout(tokens) {
+			return "zdap proxy is read-only, only COPY TO STDOUT is allowed"
+		}
+		for i, t := range tokens {
+			if t.quoted {
+				if t.word == "set_config" {
+					return "zdap proxy is read-only, changing the session is not allowed"
+				}
+				continue
+			}
+			if pgWriteKeywords[t.word] && !(command == "COPY" || command == "FETCH" || command == "MOVE") {
+				return fmt.Sprintf("zdap proxy is read-only, %s is not allowed", t.word)
+			}
+			if t.word == "READ_ONLY" || strings.HasSuffix(t.word, "_READ_ONLY") || t.word == "SESSION_AUTHORIZATION" || t.word == "ROLE" || t.word == "SET_CONFIG" {
+				return "zdap proxy is read-only, changing the session is not allowed"
+			}
+			if t.word == "READ" && i+1 < len(tokens) && tokens[i+1].word == "WRITE" {
+				return "zdap proxy is read-only, read write transactions are not allowed"
+			}
+		}
+	}
+	return ""
+}
+
+// copiesToStdout reports if a COPY statement copies to the client, COPY from or to a file or program reads or writes
+// on the server
+func copiesToStdout(tokens []pgToken) bool {
+	for i, t := range tokens {
+		if t.depth != 0 || t.quoted {
+			continue
+		}
+		switch t.word {
+		case "FROM", "PROGRAM":
+			return false
+		case "TO":
+			return i+1 < len(tokens) && !tokens[i+1].quoted && tokens[i+1].word == "STDOUT"
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePostgres answers every simple query with a command complete and ready for query, the startup parameters
+// it receives are sent on params
+func fakePostgres(t *testing.T, params chan<- [][2]string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				var l [4]byte
+				if _, err := io.ReadFull(r, l[:]); err != nil {
+					return
+				}
+				body := make([]byte, binary.BigEndian.Uint32(l[:])-4)
+				if _, err := io.ReadFull(r, body); err != nil {
+					return
+				}
+				params <- parseStartupParams(body[4:])
+				_, _ = c.Write(message('R', []byte{0, 0, 0, 0}))
+				_, _ = c.Write(message('Z', []byte{'I'}))
+				for {
+					header, _, _, err := readMessage(r, func(byte) bool { return true })
+					if err != nil {
+						return
+					}
+					switch header[0] {
+					case 'Q':
+						_, _ = c.Write(message('C', []byte("SELECT 1\x00")))
+						_, _ = c.Write(message('Z', []byte{'I'}))
+					case 'S':
+						_, _ = c.Write(message('Z', []byte{'I'}))
+					case 'X':
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func readBackend(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	header, body, _, err := readMessage(r, func(byte) bool { return true })
+	require.NoError(t, err)
+	return header[0], body
+}
+
+func TestPostgres_ReadOnly(t *testing.T) {
+	params := make(chan [][2]string, 1)
+	target := fakePostgres(t, params)
+	port := freePort(t)
+
+	pg := &Postgres{ReadOnly: true}
+	p := &TCPProxy{ListenPort: port, TargetAddress: target, Postgres: pg}
+	require.NoError(t, p.Start(t.Context()))
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	_, err = conn.Write(startupMessage(pgProtocolVersion3, [][2]string{{"user", "bob"}, {"database", "db"}}))
+	require.NoError(t, err)
+	assert.Contains(t, <-params, [2]string{"default_transaction_read_only", "on"})
+	typ, _ := readBackend(t, r)
+	assert.Equal(t, byte('R'), typ)
+	typ, _ = readBackend(t, r)
+	assert.Equal(t, byte('Z'), typ)
+
+	_, err = conn.Write(message('Q', []byte("SELECT 1\x00")))
+	require.NoError(t, err)
+	typ, body := readBackend(t, r)
+	assert.Equal(t, byte('C'), typ)
+	assert.Equal(t, "SELECT 1", cstrings(body, 1)[0])
+	typ, _ = readBackend(t, r)
+	assert.Equal(t, byte('Z'), typ)
+
+	_, err = conn.Write(message('Q', []byte("DELETE FROM users WHERE id = 1\x00")))
+	require.NoError(t, err)
+	typ, body = readBackend(t, r)
+	assert.Equal(t, byte('E'), typ)
+	assert.Contains(t, errorMessage(body), "DELETE")
+	typ, _ = readBackend(t, r)
+	assert.Equal(t, byte('Z'), typ)
+
+	stats := pg.Statements()
+	assert.Equal(t, int64(1), stats["SELECT ?"].Count)
+	assert.Equal(t, int64(1), stats["DELETE FROM users WHERE id = ?"].Rejected)
+}
+
+func TestPostgres_RejectReason(t *testing.T) {
+	pg := &Postgres{ReadOnly: true}
+	for _, q := range []string{
+		"SELECT * FROM users",
+		"select 'insert into x' -- update",
+		"WITH a AS (SELECT 1) SELECT * FROM a",
+		"BEGIN; SELECT 1; COMMIT",
+		"COPY (SELECT * FROM users) TO STDOUT",
+		"COPY users TO STDOUT WITH (FORMAT csv)",
+		`SELECT "to", "program" FROM users`,
+		"SELECT $body$ DROP TABLE x $body$",
+		"",
+	} {
+		assert.Empty(t, pg.rejectReason(q), q)
+	}
+	for _, q := range []string{
+		"INSERT INTO users VALUES (1)",
+		"SELECT 1; DROP TABLE users",
+		"WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d",
+		"SELECT * INTO copy FROM users",
+		"COPY users FROM STDIN",
+		"SET default_transaction_read_only = off",
+		"BEGIN READ WRITE",
+		"/* comment */ TRUNCATE users",
+		"SELECT set_config('default_transaction_read_only', 'off', false)",
+		"SELECT pg_catalog.SET_CONFIG('transaction_read_only', 'off', true)",
+		`SELECT "set_config"('default_transaction_read_only', 'off', false)`,
+		"COPY users TO '/tmp/users.csv'",
+		"COPY (SELECT 1) TO PROGRAM 'rm -rf /'",
+		"COPY users FROM PROGRAM 'cat /etc/passwd'",
+		"COPY users FROM '/tmp/users.csv'",
+		`COPY users TO "STDOUT"`,
+	} {
+		assert.NotEmpty(t, pg.rejectReason(q), q)
+	}
+	assert.Empty(t, (&Postgres{}).rejectReason("DROP TABLE users"))
+}
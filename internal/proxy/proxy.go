@@ -0,0 +1,394 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Metric struct {
+	mu               sync.Mutex
+	ActiveConnection int       `json:"active_connection"`
+	TotalConnection  int       `json:"total_connection"`
+	LastConnection   time.Time `json:"last_connection"`
+	FirstConnection  time.Time `json:"first_connection"`
+	CreatedAt        time.Time `json:"created_at"`
+	Written          int64
+	Read             int64
+	// Statements holds per statement metrics when the proxy is postgres protocol aware
+	Statements map[string]StatementMetric `json:"statements,omitempty"`
+}
+
+type TCPProxy struct {
+	ListenPort    int
+	TargetAddress string
+	// ResolveTarget, if set, is called for every accepted connection and takes precedence over TargetAddress
+	ResolveTarget func() (string, error)
+	Metric        *Metric
+	MetricServer  bool
+
+	// TLSConfig, if set, lets clients tunnel their connections over TLS. Plain connections are still accepted
+	// unless TLSRequired is set.
+	TLSConfig   *tls.Config
+	TLSRequired bool
+	// VerifyPeer, if set, is called with the common name of the client certificate of every TLS connection, the
+	// connection is rejected if it returns an error
+	VerifyPeer func(commonName string) error
+	// TargetTLSConfig, if set, tunnels the connections to the target over TLS
+	TargetTLSConfig *tls.Config
+	// Dial, if set, is called for every accepted connection to connect to the target and takes precedence over
+	// TargetAddress, ResolveTarget and TargetTLSConfig
+	Dial func() (net.Conn, error)
+
+	// Postgres, if set, makes the proxy parse the postgres wire protocol of the connections
+	Postgres *Postgres
+
+	metricConn *net.UDPConn
+	proxyConn  *net.Listener
+
+	mu       sync.Mutex
+	conns    map[net.Conn]net.Conn // accepted connections to their target connections, nil until dialed
+	draining bool                  // set once the proxy stops accepting, no connections are tracked after that
+	wg       sync.WaitGroup
+}
+
+func (s *TCPProxy) startMetricServer() {
+	log.Printf("Starting metric server at udp://0.0.0.0:%d\n", s.ListenPort)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{
+		Port: s.ListenPort,
+		IP:   net.ParseIP("0.0.0.0"),
+	})
+	if err != nil {
+		log.Printf("could not start metric server on udp port %d, %v\n", s.ListenPort, err)
+		return
+	}
+
+	s.mu.Lock()
+	s.metricConn = conn
+	s.mu.Unlock()
+	for {
+		var buf [2048]byte
+		n, addr, err := conn.ReadFromUDP(buf[0:])
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println("metric udp read error:", err)
+		}
+
+		payload := strings.ToLower(strings.TrimSpace(string(buf[:n])))
+
+		if payload != "metrics" {
+			log.Println("got wrong udp metric command", payload)
+			_, err = conn.WriteToUDP([]byte("{\"error\": \"only the word 'metrics' is to be send in order to get a response\"}\n"), addr)
+			if err != nil {
+				log.Println("could not respond do udp")
+			}
+			continue
+		}
+
+		s.Metric.mu.Lock()
+		if s.Postgres != nil {
+			s.Metric.Statements = s.Postgres.Statements()
+		}
+		b, _ := json.Marshal(s.Metric)
+		s.Metric.mu.Unlock()
+
+		_, _ = conn.WriteToUDP(append(b, byte('\n')), addr)
+	}
+
+}
+
+func (s *TCPProxy) Start(_ context.Context) error {
+	if s.MetricServer && s.Metric == nil {
+		s.Metric = &Metric{CreatedAt: time.Now()}
+	}
+
+	log.Printf("Starting zdap tcp proxy server at tcp://0.0.0.0:%d, targeting tcp://%s\n", s.ListenPort, s.targetDescription())
+	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", s.ListenPort))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.proxyConn = &listener
+	s.conns = map[net.Conn]net.Conn{}
+	s.mu.Unlock()
+
+	if s.MetricServer {
+		go s.startMetricServer()
+	}
+
+	go func() {
+		defer listener.Close()
+
+		for {
+			in, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Println("could not accept connection,", err)
+				continue
+			}
+			go s.proxy(in)
+		}
+	}()
+	return nil
+}
+
+// Stop closes the listener and drops all open connections
+func (s *TCPProxy) Stop() {
+	s.Drain(0)
+}
+
+// StopAccepting closes the listener, open connections are kept
+func (s *TCPProxy) StopAccepting() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+	if s.proxyConn != nil {
+		(*s.proxyConn).Close()
+		s.proxyConn = nil
+	}
+	if s.metricConn != nil {
+		s.metricConn.Close()
+		s.metricConn = nil
+	}
+}
+
+// Drain stops accepting new connections and waits up to timeout for the open connections to finish,
+// any connection still open after that is closed.
+func (s *TCPProxy) Drain(timeout time.Duration) {
+	s.StopAccepting()
+
+	if timeout > 0 {
+		done := make(chan struct{})
+		go func() {
+			s.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return
+		case <-time.After(timeout):
+			log.Printf("Drain timeout for tcp://0.0.0.0:%d reached, closing remaining connections\n", s.ListenPort)
+		}
+	}
+
+	s.mu.Lock()
+	for in, out := range s.conns {
+		_ = in.Close()
+		if out != nil {
+			_ = out.Close()
+		}
+	}
+	s.mu.Unlock()
+}
+
+// ActiveConnections returns the number of connections currently being proxied
+func (s *TCPProxy) ActiveConnections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *TCPProxy) targetDescription() string {
+	if s.Dial != nil || s.ResolveTarget != nil {
+		return "<resolved on connect>"
+	}
+	return s.TargetAddress
+}
+
+func (s *TCPProxy) target() (string, error) {
+	if s.ResolveTarget != nil {
+		return s.ResolveTarget()
+	}
+	return s.TargetAddress, nil
+}
+
+// track registers an accepted connection so that Drain waits for it, it returns false if the proxy is draining
+// and the connection must be rejected
+func (s *TCPProxy) track(in net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.wg.Add(1)
+	s.conns[in] = nil
+	return true
+}
+
+// connected records the target connection of a tracked connection, so that it is closed with it
+func (s *TCPProxy) connected(in, out net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[in] = out
+}
+
+func (s *TCPProxy) untrack(in net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, in)
+	s.wg.Done()
+}
+
+// sniffTimeout is how long we wait for a TLS client hello before treating a connection as plain, protocols where
+// the server speaks first never send anything before the timeout.
+const sniffTimeout = time.Second
+
+const tlsRecordTypeHandshake = 0x16
+
+// peekedConn is a connection where the first bytes already have been read into r
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (s *TCPProxy) handshake(conn net.Conn) (net.Conn, error) {
+	if s.TLSConfig == nil {
+		return conn, nil
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	r := bufio.NewReader(conn)
+	first, err := r.Peek(1)
+	_ = conn.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+		return nil, err
+	}
+	conn = &peekedConn{Conn: conn, r: r}
+
+	if len(first) == 0 || first[0] != tlsRecordTypeHandshake {
+		if s.TLSRequired {
+			return nil, errors.New("plain connection rejected, tls is required")
+		}
+		return conn, nil
+	}
+
+	tconn := tls.Server(conn, s.TLSConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*sniffTimeout)
+	defer cancel()
+	err = tconn.HandshakeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s.VerifyPeer != nil {
+		peers := tconn.ConnectionState().PeerCertificates
+		if len(peers) == 0 {
+			_ = tconn.Close()
+			return nil, errors.New("tls connection rejected, no client certificate")
+		}
+		err = s.VerifyPeer(peers[0].Subject.CommonName)
+		if err != nil {
+			_ = tconn.Close()
+			return nil, fmt.Errorf("tls connection rejected, %w", err)
+		}
+	}
+	return tconn, nil
+}
+
+func (s *TCPProxy) dial() (net.Conn, error) {
+	if s.Dial != nil {
+		return s.Dial()
+	}
+	target, err := s.target()
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve target, %w", err)
+	}
+	if s.TargetTLSConfig != nil {
+		return tls.Dial("tcp", target, s.TargetTLSConfig)
+	}
+	return net.Dial("tcp", target)
+}
+
+func (s *TCPProxy) proxy(accepted net.Conn) {
+	if !s.track(accepted) {
+		log.Println("could not accept connection, the proxy is draining")
+		_ = accepted.Close()
+		return
+	}
+	in, err := s.handshake(accepted)
+	if err != nil {
+		log.Println("could not accept connection,", err)
+		_ = accepted.Close()
+		s.untrack(accepted)
+		return
+	}
+
+	if s.MetricServer {
+		s.Metric.mu.Lock()
+		s.Metric.ActiveConnection += 1
+		s.Metric.TotalConnection += 1
+		s.Metric.LastConnection = time.Now()
+		if s.Metric.FirstConnection.IsZero() {
+			s.Metric.FirstConnection = time.Now()
+		}
+		s.Metric.mu.Unlock()
+	}
+	log.Println("Accepted connection - Dialing recipient")
+	out, err := s.dial()
+	if err != nil {
+		log.Println("could not dial target,", err)
+		_ = in.Close()
+		s.untrack(accepted)
+		s.connectionDone(0)
+		return
+	}
+	s.connected(accepted, out)
+
+	if s.Postgres != nil {
+		go func() {
+			w, r := s.Postgres.proxy(in, out)
+			s.untrack(accepted)
+			if s.MetricServer {
+				s.Metric.mu.Lock()
+				s.Metric.Written += w
+				s.Metric.mu.Unlock()
+			}
+			s.connectionDone(r)
+		}()
+		return
+	}
+
+	go func() {
+		w, _ := io.Copy(out, in)
+		log.Println("closing out", out.Close())
+		if s.MetricServer {
+			s.Metric.mu.Lock()
+			s.Metric.Written += w
+			s.Metric.mu.Unlock()
+		}
+	}()
+	go func() {
+		r, _ := io.Copy(in, out)
+		log.Println("closing in", in.Close())
+		s.untrack(accepted)
+		s.connectionDone(r)
+	}()
+}
+
+func (s *TCPProxy) connectionDone(read int64) {
+	if !s.MetricServer {
+		return
+	}
+	s.Metric.mu.Lock()
+	s.Metric.ActiveConnection -= 1
+	s.Metric.Read += read
+	s.Metric.mu.Unlock()
+}
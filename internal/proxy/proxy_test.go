@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/modfin/zdap/internal/certs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPProxy_TLSTunnel(t *testing.T) {
+	authority, err := certs.LoadOrCreate(t.TempDir())
+	require.NoError(t, err)
+	serverTLS, err := authority.ServerTLSConfig([]string{"127.0.0.1"})
+	require.NoError(t, err)
+	cert, key, _, err := authority.Issue("user@host", nil, false)
+	require.NoError(t, err)
+	clientTLS, err := certs.ClientTLSConfig(string(cert), string(key), string(authority.CertificatePEM()), "")
+	require.NoError(t, err)
+
+	server := &TCPProxy{
+		ListenPort:    freePort(t),
+		TargetAddress: echoServer(t),
+		TLSConfig:     serverTLS,
+		TLSRequired:   true,
+	}
+	require.NoError(t, server.Start(context.Background()))
+	defer server.Stop()
+
+	client := &TCPProxy{
+		ListenPort:      freePort(t),
+		TargetAddress:   fmt.Sprintf("127.0.0.1:%d", server.ListenPort),
+		TargetTLSConfig: clientTLS,
+	}
+	require.NoError(t, client.Start(context.Background()))
+	defer client.Stop()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", client.ListenPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintln(conn, "ping")
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+
+	// plain connections are rejected when tls is required
+	plain, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", server.ListenPort))
+	require.NoError(t, err)
+	defer plain.Close()
+	_, err = fmt.Fprintln(plain, "ping")
+	require.NoError(t, err)
+	_ = plain.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = bufio.NewReader(plain).ReadString('\n')
+	assert.Error(t, err)
+}
+
+func TestTCPProxy_TLSUnknownClient(t *testing.T) {
+	authority, err := certs.LoadOrCreate(t.TempDir())
+	require.NoError(t, err)
+	serverTLS, err := authority.ServerTLSConfig([]string{"127.0.0.1"})
+	require.NoError(t, err)
+
+	other, err := certs.LoadOrCreate(t.TempDir())
+	require.NoError(t, err)
+	cert, key, _, err := other.Issue("user@host", nil, false)
+	require.NoError(t, err)
+	clientTLS, err := certs.ClientTLSConfig(string(cert), string(key), string(authority.CertificatePEM()), "")
+	require.NoError(t, err)
+
+	server := &TCPProxy{
+		ListenPort:    freePort(t),
+		TargetAddress: echoServer(t),
+		TLSConfig:     serverTLS,
+	}
+	require.NoError(t, server.Start(context.Background()))
+	defer server.Stop()
+
+	client := &TCPProxy{
+		ListenPort:      freePort(t),
+		TargetAddress:   fmt.Sprintf("127.0.0.1:%d", server.ListenPort),
+		TargetTLSConfig: clientTLS,
+	}
+	require.NoError(t, client.Start(context.Background()))
+	defer client.Stop()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", client.ListenPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, _ = fmt.Fprintln(conn, "ping")
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	assert.Error(t, err, "certificates from another authority should be rejected")
+
+	// plain connections are still accepted when tls is optional
+	plain, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", server.ListenPort))
+	require.NoError(t, err)
+	defer plain.Close()
+	_, err = fmt.Fprintln(plain, "ping")
+	require.NoError(t, err)
+	line, err := bufio.NewReader(plain).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+}
+
+func TestTCPProxy_DrainWaitsForDialingConnection(t *testing.T) {
+	target := echoServer(t)
+	dialing, release := make(chan struct{}), make(chan struct{})
+	server := &TCPProxy{
+		ListenPort: freePort(t),
+		Dial: func() (net.Conn, error) {
+			close(dialing)
+			<-release
+			return net.Dial("tcp", target)
+		},
+	}
+	require.NoError(t, server.Start(context.Background()))
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", server.ListenPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	<-dialing
+	assert.Equal(t, 1, server.ActiveConnections(), "the connection must be tracked before the target is dialed")
+
+	drained := make(chan struct{})
+	go func() {
+		server.Drain(5 * time.Second)
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		t.Fatal("the drain must wait for the connection that is still dialing")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	_, err = fmt.Fprintln(conn, "ping")
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+	require.NoError(t, conn.Close())
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("the drain should finish once the connection is closed")
+	}
+
+	// connections accepted after the drain started are rejected
+	in, out := net.Pipe()
+	defer out.Close()
+	server.proxy(in)
+	_ = out.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = out.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, 0, server.ActiveConnections())
+}
@@ -0,0 +1,193 @@
+package reconcile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/modfin/zdap"
+	"github.com/modfin/zdap/internal/zfs"
+)
+
+// The kinds of drift between the datasets and containers of zdap
+const (
+	OrphanDataset      = "orphan-dataset"       // a clone without a container
+	OrphanContainer    = "orphan-container"     // a clone or base container without a clone or a running build
+	MissingProxy       = "missing-proxy"        // a clone which is not served on its port
+	StaleNetworkMember = "stale-network-member" // an endpoint of the clone network whose container is gone
+	VanishedSnap       = "vanished-snap"        // a clone whose snap no longer exists
+)
+
+// Kinds are all kinds of drift, in the order they are reported
+var Kinds = []string{OrphanDataset, OrphanContainer, MissingProxy, StaleNetworkMember, VanishedSnap}
+
+// grace is how old a clone must be before it is reconciled, so that clones which are being created are left alone
+const grace = 5 * time.Minute
+
+// Config of the reconciler
+type Config struct {
+	Interval time.Duration // how often the reconciler runs, it is off if 0
+	Fix      Policy
+}
+
+// Policy holds the kinds of drift that are fixed, the others are only reported
+type Policy map[string]bool
+
+// ParsePolicy parses a comma separated list of kinds, "all" or "none"
+func ParsePolicy(s string) (Policy, error) {
+	p := Policy{}
+	for _, k := range strings.Split(s, ",") {
+		k = strings.TrimSpace(k)
+		switch k {
+		case "", "none":
+		case "all":
+			for _, k := range Kinds {
+				p[k] = true
+			}
+		default:
+			if !known(k) {
+				return nil, fmt.Errorf("unknown kind '%s', expected all, none or one of %s", k, strings.Join(Kinds, ", "))
+			}
+			p[k] = true
+		}
+	}
+	return p, nil
+}
+
+func snapKey(resource string, at time.Time) string {
+	return fmt.Sprintf("%s@%d", resource, at.Unix())
+}
+
+func known(kind string) bool {
+	for _, k := range Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Finding is one case of drift
+type Finding struct {
+	Kind   string
+	Name   string // the clone, container or network member
+	Detail string
+
+	Clone       *zdap.PublicClone // the clone of an orphan dataset, a missing proxy or a vanished snap
+	ContainerID string            // the container of an orphan container or a stale network member
+	// Recreate is set for an orphan dataset of a clone that was handed out, which gets a new container rather than
+	// being destroyed
+	Recreate bool
+
+	Fixed bool
+	Err   error // why the fix failed
+}
+
+// Observed is the state the findings are made from
+type Observed struct {
+	Clones     []zdap.PublicClone
+	Ready      map[string]bool // the clones that have been created and handed out
+	Snaps      []zdap.PublicSnap
+	Containers []types.Container
+	Members    map[string]string // the containers of the clone network, names by id
+	Building   map[string]bool   // the resources with a build running in this zdapd
+	// Builds are the persisted build statuses of the resources, which show builds of any zdapd sharing the pool
+	Builds map[string]*zdap.BuildStatus
+	// BuildTimeout is how long an attempt to build a base of the resource may take, grace if nil
+	BuildTimeout func(resource string) time.Duration
+	HasProxy     func(clone zdap.PublicClone) bool
+	Now          time.Time
+}
+
+// building reports if the base container c of resource may belong to a live build. A build runs in this zdapd, in
+// another zdapd process sharing the pool, e.g. zdapd create snap, or started too recently for its container to be
+// removed. A persisted status left running by a zdapd that died is ignored once all attempts would have timed out.
+func (o Observed) building(resource string, c types.Container) bool {
+	if o.Building[resource] {
+		return true
+	}
+	timeout := grace
+	if o.BuildTimeout != nil {
+		timeout = max(o.BuildTimeout(resource), grace)
+	}
+	if o.Now.Sub(time.Unix(c.Created, 0)) < timeout {
+		return true
+	}
+	s := o.Builds[resource]
+	if s == nil || (s.State != zdap.BuildRunning && s.State != zdap.BuildRetrying) {
+		return false
+	}
+	return o.Now.Sub(s.StartedAt) < time.Duration(max(s.Attempts, 1))*timeout
+}
+
+// Find returns the drift in o
+func Find(o Observed) []Finding {
+	var findings []Finding
+
+	containers := map[string]types.Container{}
+	ids := map[string]bool{}
+	for _, c := range o.Containers {
+		ids[c.ID] = true
+		for _, n := range c.Names {
+			containers[strings.TrimPrefix(n, "/")] = c
+		}
+	}
+	snaps := map[string]bool{}
+	for _, s := range o.Snaps {
+		snaps[snapKey(s.Resource, s.CreatedAt)] = true
+	}
+
+	clones := map[string]bool{}
+	for _, c := range o.Clones {
+		clones[c.Name] = true
+		if o.Now.Sub(c.CreatedAt) < grace || (c.ExpiresAt != nil && c.ExpiresAt.Before(o.Now)) {
+			continue
+		}
+		clone := c
+		_, hasContainer := containers[c.Name]
+		_, legacy := containers[c.Name+"-proxy"]
+		switch {
+		case !hasContainer && o.Ready[c.Name]:
+			findings = append(findings, Finding{Kind: OrphanDataset, Name: c.Name, Clone: &clone, Recreate: true, Detail: "the clone has no container"})
+		case !hasContainer:
+			findings = append(findings, Finding{Kind: OrphanDataset, Name: c.Name, Clone: &clone, Detail: "the clone has no container and was never handed out"})
+		case c.Port != 0 && !legacy && o.HasProxy != nil && !o.HasProxy(c):
+			findings = append(findings, Finding{Kind: MissingProxy, Name: c.Name, Clone: &clone,
+				Detail: fmt.Sprintf("port %d is not proxied to the clone", c.Port)})
+		}
+		if !snaps[snapKey(c.Resource, c.SnappedAt)] {
+			findings = append(findings, Finding{Kind: VanishedSnap, Name: c.Name, Clone: &clone,
+				Detail: fmt.Sprintf("the snap of %s at %s does not exist", c.Resource, c.SnappedAt.UTC().Format(zfs.TimestampFormat))})
+		}
+	}
+
+	for name, c := range containers {
+		clone := strings.TrimSuffix(name, "-proxy")
+		if zfs.IsClone(clone) && !clones[clone] {
+			findings = append(findings, Finding{Kind: OrphanContainer, Name: name, ContainerID: c.ID, Detail: "the clone does not exist"})
+		}
+		if resource, ok := zfs.BaseResource(name); ok && !o.building(resource, c) {
+			findings = append(findings, Finding{Kind: OrphanContainer, Name: name, ContainerID: c.ID, Detail: "no build of " + resource + " is running"})
+		}
+	}
+
+	for id, name := range o.Members {
+		if !ids[id] {
+			findings = append(findings, Finding{Kind: StaleNetworkMember, Name: name, ContainerID: id, Detail: "the container does not exist"})
+		}
+	}
+
+	order := map[string]int{}
+	for i, k := range Kinds {
+		order[k] = i
+	}
+	sort.SliceStable(findings, func(i, k int) bool {
+		if findings[i].Kind != findings[k].Kind {
+			return order[findings[i].Kind] < order[findings[k].Kind]
+		}
+		return findings[i].Name < findings[k].Name
+	})
+	return findings
+}
@@ -0,0 +1,100 @@
+package reconcile
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/modfin/zdap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy("orphan-container, missing-proxy")
+	assert.NoError(t, err)
+	assert.Equal(t, Policy{OrphanContainer: true, MissingProxy: true}, p)
+
+	p, err = ParsePolicy("all")
+	assert.NoError(t, err)
+	assert.Len(t, p, len(Kinds))
+
+	p, err = ParsePolicy("none")
+	assert.NoError(t, err)
+	assert.Empty(t, p)
+
+	_, err = ParsePolicy("orphans")
+	assert.Error(t, err)
+}
+
+func TestFind(t *testing.T) {
+	now := time.Now()
+	snapped := now.Add(-24 * time.Hour).Truncate(time.Second)
+	clone := func(name string, created time.Time) zdap.PublicClone {
+		return zdap.PublicClone{Name: name, Resource: "users", CreatedAt: created, SnappedAt: snapped, Port: 40001}
+	}
+	name := func(n string) string {
+		return fmt.Sprintf("zdap-users-base-2024-01-01T00.00.00-clone-2024-01-0%sT00.00.00.abc", n)
+	}
+
+	o := Observed{
+		Clones: []zdap.PublicClone{
+			clone(name("1"), now.Add(-time.Hour)),   // ok
+			clone(name("2"), now.Add(-time.Hour)),   // no container
+			clone(name("3"), now.Add(-time.Minute)), // no container, but still being created
+			clone(name("4"), now.Add(-time.Hour)),   // not proxied
+			clone(name("5"), now.Add(-2*time.Hour)), // legacy proxy container
+			clone(name("7"), now.Add(-time.Hour)),   // no container, was handed out
+		},
+		Ready: map[string]bool{name("1"): true, name("4"): true, name("5"): true, name("7"): true},
+		Snaps: []zdap.PublicSnap{{Resource: "users", CreatedAt: snapped}},
+		Containers: []types.Container{
+			{ID: "1", Names: []string{"/" + name("1")}},
+			{ID: "4", Names: []string{"/" + name("4")}},
+			{ID: "5", Names: []string{"/" + name("5")}},
+			{ID: "5p", Names: []string{"/" + name("5") + "-proxy"}},
+			{ID: "6", Names: []string{"/" + name("6")}},
+			{ID: "b", Names: []string{"/zdap-users-base-2024-01-01T00.00.00"}},
+			{ID: "c", Names: []string{"/zdap-events-base-2024-01-01T00.00.00"}},
+			{ID: "d", Names: []string{"/zdap-orders-base-2024-01-01T00.00.00"}},
+			{ID: "e", Names: []string{"/zdap-billing-base-2024-01-01T00.00.00"}},
+			{ID: "f", Names: []string{"/zdap-items-base-2024-01-01T00.00.00"}, Created: now.Add(-30 * time.Minute).Unix()},
+			{ID: "x", Names: []string{"/postgres"}},
+		},
+		Members:  map[string]string{"1": name("1"), "gone": "zdap-old"},
+		Building: map[string]bool{"events": true},
+		Builds: map[string]*zdap.BuildStatus{
+			// built by another zdapd process
+			"orders": {State: zdap.BuildRunning, Attempts: 1, StartedAt: now.Add(-30 * time.Minute)},
+			// left running by a zdapd that died
+			"billing": {State: zdap.BuildRunning, Attempts: 2, StartedAt: now.Add(-3 * time.Hour)},
+		},
+		BuildTimeout: func(string) time.Duration { return time.Hour },
+		HasProxy:     func(c zdap.PublicClone) bool { return c.Name != name("4") && c.Name != name("5") },
+		Now:          now,
+	}
+
+	var got []string
+	recreate := map[string]bool{}
+	for _, f := range Find(o) {
+		got = append(got, f.Kind+" "+f.Name)
+		recreate[f.Name] = f.Recreate
+	}
+	assert.True(t, recreate[name("7")], "a clone that was handed out should get a new container")
+	assert.False(t, recreate[name("2")], "a clone that was never handed out should be destroyed")
+	assert.Equal(t, []string{
+		OrphanDataset + " " + name("2"),
+		OrphanDataset + " " + name("7"),
+		OrphanContainer + " zdap-billing-base-2024-01-01T00.00.00",
+		OrphanContainer + " zdap-users-base-2024-01-01T00.00.00",
+		OrphanContainer + " " + name("6"),
+		MissingProxy + " " + name("4"),
+		StaleNetworkMember + " zdap-old",
+	}, got)
+
+	o.Snaps = nil
+	o.Clones = o.Clones[:1]
+	f := Find(o)
+	assert.Equal(t, VanishedSnap, f[len(f)-1].Kind)
+	assert.Equal(t, name("1"), f[len(f)-1].Clone.Name)
+}
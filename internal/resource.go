@@ -3,7 +3,9 @@ package internal
 import (
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/c2h5oh/datasize"
 	"github.com/docker/docker/api/types/strslice"
 	"github.com/modfin/henry/slicez"
 )
@@ -11,11 +13,22 @@ import (
 type Resource struct {
 	Name          string
 	Alias         string
-	Retrieval     string
-	Creation      string
+	Extends       string  // the name of a template or resource whose config is used as defaults for this resource
+	Retrieval     string  // the retrieval script, used when no source is set
+	Source        Source  // a built-in retrieval driver
+	Creation      string  // the creation script, run after the restore driver if one is set
+	Restore       Restore // a built-in restore driver
+	Update        string  // the update script, new bases are cloned from the latest snap and updated when set
+	Verify        Verify  // checks a base must pass before it is snapped
 	Cron          string
 	Docker        Docker
 	ClonePool     ClonePoolConfig `yaml:"clone_pool"`
+	ScriptEnv     []string        `yaml:"script_env"`     // environment of the retrieval and creation scripts, KEY=value
+	ScriptTimeout time.Duration   `yaml:"script_timeout"` // how long each script may run, DefaultScriptTimeout if 0
+	Timeouts      Timeouts
+	Retry         Retry
+	Build         Build
+	Limits        Limits          // limits of the restore and clone containers, overridden by restore_params and clone_params
 	RestoreParams ContainerParams `yaml:"restore_params"`
 	CloneParams   ContainerParams `yaml:"clone_params"`
 }
@@ -31,6 +44,111 @@ type Docker struct {
 	Shm         int64
 }
 
+// The built-in retrieval drivers
+const (
+	SourceLocal  = "local"
+	SourceHTTP   = "http"
+	SourceS3     = "s3"
+	SourcePgDump = "pg_dump"
+)
+
+// Source retrieves the data of a base without a retrieval script
+type Source struct {
+	Driver         string       // one of the Source* drivers, the retrieval script is used if empty
+	Path           string       // local, a file or a glob of which the newest match is used
+	URL            string       // http, the url of the artifact
+	Headers        []string     // http, extra request headers, Key: value
+	S3             S3Source     `yaml:"s3"`
+	PgDump         PgDumpSource `yaml:"pg_dump"`
+	SHA256         string       `yaml:"sha256"`          // the expected sha256 of the artifact
+	ChecksumSuffix string       `yaml:"checksum_suffix"` // the suffix of a sidecar file holding the sha256 of the artifact, e.g. .sha256
+}
+
+type S3Source struct {
+	Endpoint  string // e.g. https://s3.eu-north-1.amazonaws.com or http://minio:9000
+	Region    string // us-east-1 if empty
+	Bucket    string
+	Key       string // the key of the artifact
+	Prefix    string // or a prefix of which the newest object is used
+	AccessKey string `yaml:"access_key"` // objects are fetched anonymously if empty
+	SecretKey string `yaml:"secret_key"`
+}
+
+type PgDumpSource struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Database string
+	Format   string // custom, plain or directory, custom if empty
+	Jobs     int    // the number of parallel jobs of the directory format
+	Args     []string
+}
+
+// The built-in restore drivers
+const (
+	RestorePgRestore = "pg_restore"
+	RestorePsql      = "psql"
+	RestorePhysical  = "physical"
+)
+
+// DefaultRestoreOwner is the uid:gid of the postgres user of the official postgres images
+const DefaultRestoreOwner = "999:999"
+
+// Restore restores the retrieved data into the base without a creation script
+type Restore struct {
+	Driver       string   // one of the Restore* drivers, the creation script is used if empty
+	Database     string   // pg_restore and psql, the database restored into, created if missing, postgres if empty
+	User         string   // pg_restore and psql, the role used to restore, postgres if empty
+	Roles        []string // pg_restore and psql, roles created before the restore, for dumps referring to roles of the source
+	Jobs         int      // pg_restore, the number of parallel jobs, the number of cpus if 0
+	NoOwner      bool     `yaml:"no_owner"`      // pg_restore, don't restore the ownership of objects
+	IgnoreErrors bool     `yaml:"ignore_errors"` // pg_restore and psql, don't fail the base on errors in the dump
+	Owner        string   // physical, the uid:gid of the restored files, DefaultRestoreOwner if empty
+	Args         []string // pg_restore and psql, extra arguments
+}
+
+const DefaultScriptTimeout = 24 * time.Hour
+const DefaultHealthyTimeout = 15 * time.Minute
+const DefaultRetryBackoff = time.Minute
+const DefaultRetryMaxBackoff = 30 * time.Minute
+
+// Timeouts limit each phase of creating a base, the phases running scripts or restore drivers default to the
+// script timeout
+type Timeouts struct {
+	Retrieval time.Duration
+	Restore   time.Duration
+	Healthy   time.Duration // waiting for the base or a clone container to become healthy, DefaultHealthyTimeout if 0
+	Creation  time.Duration
+	Update    time.Duration
+	Verify    time.Duration
+}
+
+// Verify holds the checks a base must pass before it is snapped, a base failing them is discarded and the previous snap
+// stays the latest
+type Verify struct {
+	Database   string           // the database the checks run in, postgres if empty
+	User       string           // the role running the checks, postgres if empty
+	Tables     []string         // tables that must exist, optionally qualified with their schema
+	MinRows    map[string]int64 `yaml:"min_rows"` // the least number of rows of each table
+	Assertions []string         // sql queries that must return true
+	Script     string           // a script run with the name of the base container, which fails the base unless it exits 0
+	MaxShrink  int              `yaml:"max_shrink"` // how many percent smaller than the previous base the base may be, unchecked if 0
+}
+
+// Build configures how builds of the resource are scheduled
+type Build struct {
+	Priority int // queued builds with a higher priority are started first
+	Weight   int // the number of build slots a build uses, 1 if 0
+}
+
+// Retry configures how failed attempts to create a base are retried
+type Retry struct {
+	Attempts   int           // the number of attempts, 1 if 0
+	Backoff    time.Duration // the wait before the second attempt, doubled for every attempt after it, DefaultRetryBackoff if 0
+	MaxBackoff time.Duration `yaml:"max_backoff"` // the longest wait between attempts, DefaultRetryMaxBackoff if 0
+}
+
 const DefaultClaimTimeoutSeconds = 300
 const DefaultClaimMaxTimeoutSeconds = 90000
 
@@ -47,6 +165,44 @@ type ContainerParams struct {
 	Entrypoint    []string
 	Cmd           []string
 	ZfsProperties []string `yaml:"zfs"`
+	Limits        Limits
+}
+
+// Limits are the resources a container may use, 0 is unlimited
+type Limits struct {
+	CPUs        float64           `json:"cpus,omitempty"`                             // e.g. 1.5
+	Memory      datasize.ByteSize `json:"memory,omitempty"`                           // e.g. 4GB, swap included
+	Pids        int64             `json:"pids,omitempty"`                             // the number of processes
+	BlkioWeight uint16            `yaml:"blkio_weight" json:"blkio_weight,omitempty"` // relative io weight, 10 to 1000
+}
+
+// IsZero returns true if l does not limit anything
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// Override returns l with the limits set in o
+func (l Limits) Override(o Limits) Limits {
+	if o.CPUs != 0 {
+		l.CPUs = o.CPUs
+	}
+	if o.Memory != 0 {
+		l.Memory = o.Memory
+	}
+	if o.Pids != 0 {
+		l.Pids = o.Pids
+	}
+	if o.BlkioWeight != 0 {
+		l.BlkioWeight = o.BlkioWeight
+	}
+	return l
+}
+
+// OwnerLimits limit the clones of each owner on a server, summed over all resources. 0 is unlimited.
+type OwnerLimits struct {
+	Clones int
+	CPUs   float64
+	Memory datasize.ByteSize
 }
 
 func (r Resource) BaseCmd() strslice.StrSlice {
@@ -75,6 +231,10 @@ func (r Resource) BaseZfsProperties() map[string]string {
 	return r.zfsPropMap(r.RestoreParams.ZfsProperties)
 }
 
+func (r Resource) BaseLimits() Limits {
+	return r.Limits.Override(r.RestoreParams.Limits)
+}
+
 func (r Resource) CloneCmd() strslice.StrSlice {
 	if len(r.Docker.Cmd) == 0 && len(r.CloneParams.Cmd) == 0 {
 		return nil
@@ -101,6 +261,10 @@ func (r Resource) CloneZfsProperties() map[string]string {
 	return r.zfsPropMap(r.CloneParams.ZfsProperties)
 }
 
+func (r Resource) CloneLimits() Limits {
+	return r.Limits.Override(r.CloneParams.Limits)
+}
+
 func (r Resource) zfsPropMap(config []string) map[string]string {
 	if len(config) == 0 {
 		return nil
@@ -0,0 +1,87 @@
+package retrieval
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/modfin/zdap/internal"
+)
+
+// http downloads the url of src, a cached artifact is revalidated with its etag or modification time
+func (r *Retriever) http(ctx context.Context, resource string, src internal.Source, workDir string) (Result, error) {
+	expected, err := expectedChecksum(src, func(suffix string) (string, error) {
+		resp, err := r.get(ctx, src, src.URL+suffix, nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return string(b), err
+	})
+	if err != nil {
+		return Result{}, err
+	}
+
+	cached := r.cached(resource, src.URL)
+	header := http.Header{}
+	if cached != nil && cached.ETag != "" {
+		header.Set("If-None-Match", cached.ETag)
+	}
+	if cached != nil && cached.LastModified != "" {
+		header.Set("If-Modified-Since", cached.LastModified)
+	}
+	resp, err := r.get(ctx, src, src.URL, header)
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		if res, ok := r.reuse(resource, cached, expected); ok {
+			return res, nil
+		}
+		// the cached artifact does not match the checksum, download it again unconditionally
+		resp.Body.Close()
+		resp, err = r.get(ctx, src, src.URL, nil)
+		if err != nil {
+			return Result{}, err
+		}
+		defer resp.Body.Close()
+	}
+
+	u, _ := url.Parse(src.URL)
+	e := cacheEntry{
+		Location:     src.URL,
+		File:         fileName(u.Path),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	return r.store(resource, workDir, e, resp.Body, expected)
+}
+
+// get requests rawURL with the headers of src, any status but 200 and 304 is an error
+func (r *Retriever) get(ctx context.Context, src internal.Source, rawURL string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request, %w", err)
+	}
+	for _, h := range src.Headers {
+		k, v, _ := strings.Cut(h, ":")
+		req.Header.Set(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not get %s, %w", rawURL, err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified {
+		resp.Body.Close()
+		return nil, fmt.Errorf("could not get %s, got status %s", rawURL, resp.Status)
+	}
+	return resp, nil
+}
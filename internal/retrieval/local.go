@@ -0,0 +1,83 @@
+package retrieval
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/modfin/zdap/internal"
+)
+
+// local uses the newest file matching the path of src in place, it is only hashed if a checksum is configured
+func (r *Retriever) local(src internal.Source) (Result, error) {
+	path, info, err := newestMatch(src.Path, src.ChecksumSuffix)
+	if err != nil {
+		return Result{}, err
+	}
+
+	expected, err := expectedChecksum(src, func(suffix string) (string, error) {
+		b, err := os.ReadFile(path + suffix)
+		return string(b), err
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	metadata := map[string]string{"source": path, "last_modified": info.ModTime().UTC().Format(time.RFC3339)}
+	if expected != "" {
+		sum, err := hashFile(path)
+		if err != nil {
+			return Result{}, err
+		}
+		err = verify(path, expected, sum)
+		if err != nil {
+			return Result{}, err
+		}
+		metadata["sha256"] = sum
+	}
+	return Result{File: path, Metadata: metadata}, nil
+}
+
+// newestMatch returns the most recently modified file matching pattern, checksum sidecars are skipped
+func newestMatch(pattern string, checksumSuffix string) (string, os.FileInfo, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid path '%s', %w", pattern, err)
+	}
+	var newest string
+	var newestInfo os.FileInfo
+	for _, m := range matches {
+		if checksumSuffix != "" && strings.HasSuffix(m, checksumSuffix) {
+			continue
+		}
+		info, err := os.Stat(m)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if newestInfo == nil || info.ModTime().After(newestInfo.ModTime()) || (info.ModTime().Equal(newestInfo.ModTime()) && m > newest) {
+			newest, newestInfo = m, info
+		}
+	}
+	if newestInfo == nil {
+		return "", nil, fmt.Errorf("no file matches '%s'", pattern)
+	}
+	return newest, newestInfo, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", fmt.Errorf("could not hash %s, %w", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
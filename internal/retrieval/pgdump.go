@@ -0,0 +1,86 @@
+package retrieval
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/modfin/zdap/internal"
+)
+
+const defaultPgPort = 5432
+
+// pgDump dumps the source database into the work dir, live dumps are never cached
+func (r *Retriever) pgDump(ctx context.Context, resource string, src internal.Source, workDir string) (Result, error) {
+	pg := src.PgDump
+	file := filepath.Join(workDir, resource+pgDumpExtension(pg.Format))
+
+	cmd := exec.CommandContext(ctx, "pg_dump", pgDumpArgs(pg, file)...)
+	cmd.Env = os.Environ()
+	if pg.Password != "" {
+		cmd.Env = append(cmd.Env, "PGPASSWORD="+pg.Password)
+	}
+	out := r.secrets.Writer(os.Stdout)
+	defer out.Close()
+	cmd.Stdout, cmd.Stderr = out, out
+
+	location := pgLocation(pg)
+	fmt.Println("[RETRIEVAL] Dumping", location)
+	err := cmd.Run()
+	if err != nil {
+		return Result{}, fmt.Errorf("could not dump %s, %w", location, err)
+	}
+	return Result{File: file, Metadata: map[string]string{"source": location, "format": pgDumpFormat(pg.Format)}}, nil
+}
+
+func pgDumpFormat(format string) string {
+	if format == "" {
+		return "custom"
+	}
+	return format
+}
+
+func pgDumpExtension(format string) string {
+	switch pgDumpFormat(format) {
+	case "plain":
+		return ".sql"
+	case "directory":
+		return ".dir"
+	default:
+		return ".dump"
+	}
+}
+
+func pgPort(pg internal.PgDumpSource) int {
+	if pg.Port == 0 {
+		return defaultPgPort
+	}
+	return pg.Port
+}
+
+// pgLocation describes the dumped database without its password
+func pgLocation(pg internal.PgDumpSource) string {
+	return fmt.Sprintf("postgres://%s@%s:%d/%s", pg.User, pg.Host, pgPort(pg), pg.Database)
+}
+
+// pgDumpArgs returns the arguments of pg_dump, the password is given through the environment
+func pgDumpArgs(pg internal.PgDumpSource, file string) []string {
+	args := []string{
+		"--host", pg.Host,
+		"--port", strconv.Itoa(pgPort(pg)),
+		"--dbname", pg.Database,
+		"--format", pgDumpFormat(pg.Format),
+		"--file", file,
+		"--no-password",
+	}
+	if pg.User != "" {
+		args = append(args, "--username", pg.User)
+	}
+	if pg.Jobs > 0 {
+		args = append(args, "--jobs", strconv.Itoa(pg.Jobs))
+	}
+	return append(args, pg.Args...)
+}
@@ -0,0 +1,222 @@
+package retrieval
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/modfin/zdap/internal"
+	"github.com/modfin/zdap/internal/secrets"
+)
+
+// Result is the retrieved artifact, it has the same shape as the result of a retrieval script
+type Result struct {
+	File     string            `json:"file,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Retriever retrieves the data of bases with the built-in drivers. Downloaded artifacts are kept in the cache dir, one
+// per resource, and are reused as long as the source reports the same version of the artifact.
+type Retriever struct {
+	cacheDir string
+	client   *http.Client
+	secrets  *secrets.Store
+}
+
+// New creates a retriever, artifacts are downloaded to the work dir of each retrieval and not cached if cacheDir is
+// empty
+func New(cacheDir string, secrets *secrets.Store) *Retriever {
+	return &Retriever{cacheDir: cacheDir, client: &http.Client{}, secrets: secrets}
+}
+
+// Retrieve retrieves the artifact of src for resource, files that are not cached are written to workDir
+func (r *Retriever) Retrieve(ctx context.Context, resource string, src internal.Source, workDir string) (Result, error) {
+	switch src.Driver {
+	case internal.SourceLocal:
+		return r.local(src)
+	case internal.SourceHTTP:
+		return r.http(ctx, resource, src, workDir)
+	case internal.SourceS3:
+		return r.s3(ctx, resource, src, workDir)
+	case internal.SourcePgDump:
+		return r.pgDump(ctx, resource, src, workDir)
+	default:
+		return Result{}, fmt.Errorf("unknown retrieval driver '%s'", src.Driver)
+	}
+}
+
+var sha256Reg = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ParseChecksum parses a sha256 as written by sha256sum, the hex digest optionally followed by the file name
+func ParseChecksum(s string) (string, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return "", errors.New("checksum is empty")
+	}
+	sum := strings.ToLower(fields[0])
+	if !sha256Reg.MatchString(sum) {
+		return "", fmt.Errorf("'%s' is not a sha256 checksum", fields[0])
+	}
+	return sum, nil
+}
+
+// expectedChecksum returns the configured checksum of the artifact, reading the sidecar with readSidecar if the
+// source has a checksum suffix. An empty checksum means the artifact is not verified.
+func expectedChecksum(src internal.Source, readSidecar func(suffix string) (string, error)) (string, error) {
+	if src.SHA256 != "" {
+		return ParseChecksum(src.SHA256)
+	}
+	if src.ChecksumSuffix == "" {
+		return "", nil
+	}
+	s, err := readSidecar(src.ChecksumSuffix)
+	if err != nil {
+		return "", fmt.Errorf("could not read checksum sidecar, %w", err)
+	}
+	return ParseChecksum(s)
+}
+
+func verify(location, expected, actual string) error {
+	if expected != "" && expected != actual {
+		return fmt.Errorf("checksum mismatch for %s, expected sha256 %s, got %s", location, expected, actual)
+	}
+	return nil
+}
+
+// cacheEntry describes the artifact cached for a resource
+type cacheEntry struct {
+	Location     string `json:"location"`
+	File         string `json:"file"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	SHA256       string `json:"sha256"`
+	Size         int64  `json:"size"`
+}
+
+const cacheEntryFile = "artifact.json"
+
+func (r *Retriever) resourceCacheDir(resource string) string {
+	return filepath.Join(r.cacheDir, resource)
+}
+
+// cached returns the cache entry of resource if it holds the artifact at location, nil otherwise
+func (r *Retriever) cached(resource, location string) *cacheEntry {
+	if r.cacheDir == "" {
+		return nil
+	}
+	dir := r.resourceCacheDir(resource)
+	b, err := os.ReadFile(filepath.Join(dir, cacheEntryFile))
+	if err != nil {
+		return nil
+	}
+	var e cacheEntry
+	err = json.Unmarshal(b, &e)
+	if err != nil || e.Location != location {
+		return nil
+	}
+	info, err := os.Stat(filepath.Join(dir, e.File))
+	if err != nil || info.Size() != e.Size {
+		return nil
+	}
+	return &e
+}
+
+// reuse returns the result of a cached artifact, or false if it does not match the expected checksum
+func (r *Retriever) reuse(resource string, e *cacheEntry, expected string) (Result, bool) {
+	if e == nil || (expected != "" && e.SHA256 != expected) {
+		return Result{}, false
+	}
+	fmt.Println("[RETRIEVAL] Using cached", e.Location)
+	return e.result(r.resourceCacheDir(resource)), true
+}
+
+func (e cacheEntry) result(dir string) Result {
+	metadata := map[string]string{"source": e.Location, "sha256": e.SHA256}
+	if e.ETag != "" {
+		metadata["etag"] = e.ETag
+	}
+	if e.LastModified != "" {
+		metadata["last_modified"] = e.LastModified
+	}
+	return Result{File: filepath.Join(dir, e.File), Metadata: metadata}
+}
+
+// store writes body as the artifact of resource, replacing the artifact cached before. The artifact is written to
+// workDir if caching is disabled.
+func (r *Retriever) store(resource, workDir string, e cacheEntry, body io.Reader, expected string) (Result, error) {
+	dir := workDir
+	if r.cacheDir != "" {
+		dir = r.resourceCacheDir(resource)
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return Result{}, fmt.Errorf("could not create cache dir, %w", err)
+		}
+	}
+
+	fmt.Println("[RETRIEVAL] Downloading", e.Location)
+	tmp, err := os.CreateTemp(dir, ".download-")
+	if err != nil {
+		return Result{}, fmt.Errorf("could not create download file, %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	e.Size, err = io.Copy(io.MultiWriter(tmp, hash), body)
+	cerr := tmp.Close()
+	if err != nil {
+		return Result{}, fmt.Errorf("could not download %s, %w", e.Location, err)
+	}
+	if cerr != nil {
+		return Result{}, cerr
+	}
+	e.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	err = verify(e.Location, expected, e.SHA256)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if r.cacheDir != "" {
+		// only the latest artifact of a resource is kept
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return Result{}, err
+		}
+		for _, entry := range entries {
+			if filepath.Join(dir, entry.Name()) != tmp.Name() {
+				_ = os.RemoveAll(filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	err = os.Rename(tmp.Name(), filepath.Join(dir, e.File))
+	if err != nil {
+		return Result{}, fmt.Errorf("could not move download in place, %w", err)
+	}
+	if r.cacheDir != "" {
+		b, err := json.MarshalIndent(e, "", "  ")
+		if err != nil {
+			return Result{}, err
+		}
+		err = os.WriteFile(filepath.Join(dir, cacheEntryFile), b, 0600)
+		if err != nil {
+			return Result{}, fmt.Errorf("could not write cache entry, %w", err)
+		}
+	}
+	return e.result(dir), nil
+}
+
+// fileName returns a file name for the artifact at p, keeping its extension for the creation script
+func fileName(p string) string {
+	name := filepath.Base(p)
+	if name == "." || name == "/" || name == cacheEntryFile || strings.HasPrefix(name, ".") {
+		return "artifact"
+	}
+	return name
+}
@@ -0,0 +1,284 @@
+package retrieval
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/modfin/zdap/internal"
+)
+
+const defaultS3Region = "us-east-1"
+
+// emptySHA256 is the sha256 of an empty payload, which every request to s3 has
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3 downloads the object of src, or the newest object under its prefix. A cached artifact is reused as long as the
+// etag of the object is unchanged.
+func (r *Retriever) s3(ctx context.Context, resource string, src internal.Source, workDir string) (Result, error) {
+	c := s3Client{src: src.S3, client: r.client, now: time.Now}
+	var obj s3Object
+	var err error
+	if src.S3.Key != "" {
+		obj, err = c.head(ctx, src.S3.Key)
+	} else {
+		obj, err = c.newest(ctx, src.S3.Prefix, src.ChecksumSuffix)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+
+	expected, err := expectedChecksum(src, func(suffix string) (string, error) {
+		resp, err := c.do(ctx, http.MethodGet, obj.Key+suffix, nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return string(b), err
+	})
+	if err != nil {
+		return Result{}, err
+	}
+
+	location := c.location(obj.Key)
+	cached := r.cached(resource, location)
+	if cached != nil && obj.ETag != "" && cached.ETag == obj.ETag {
+		if res, ok := r.reuse(resource, cached, expected); ok {
+			return res, nil
+		}
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, obj.Key, nil)
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+	e := cacheEntry{
+		Location:     location,
+		File:         fileName(obj.Key),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	return r.store(resource, workDir, e, resp.Body, expected)
+}
+
+type s3Object struct {
+	Key          string
+	ETag         string
+	LastModified time.Time
+}
+
+// s3Client is a minimal client of the s3 api using path style requests, which works with aws as well as minio and
+// other s3 compatible stores
+type s3Client struct {
+	src    internal.S3Source
+	client *http.Client
+	now    func() time.Time
+}
+
+func (c s3Client) region() string {
+	if c.src.Region == "" {
+		return defaultS3Region
+	}
+	return c.src.Region
+}
+
+func (c s3Client) endpoint() string {
+	if c.src.Endpoint == "" {
+		return "https://s3." + c.region() + ".amazonaws.com"
+	}
+	return strings.TrimRight(c.src.Endpoint, "/")
+}
+
+func (c s3Client) location(key string) string {
+	return "s3://" + c.src.Bucket + "/" + key
+}
+
+// do sends a signed request for key in the bucket, any status but 200 is an error
+func (c s3Client) do(ctx context.Context, method string, key string, query url.Values) (*http.Response, error) {
+	u, err := url.Parse(c.endpoint())
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint, %w", err)
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + c.src.Bucket + "/" + key
+	u.RawPath = awsEscape(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request, %w", err)
+	}
+	if c.src.AccessKey != "" {
+		signV4(req, c.src.AccessKey, c.src.SecretKey, c.region(), c.now())
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not request %s, %w", c.location(key), err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("could not request %s, got status %s, %s", c.location(key), resp.Status, strings.TrimSpace(string(b)))
+	}
+	return resp, nil
+}
+
+func (c s3Client) head(ctx context.Context, key string) (s3Object, error) {
+	resp, err := c.do(ctx, http.MethodHead, key, nil)
+	if err != nil {
+		return s3Object{}, err
+	}
+	resp.Body.Close()
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return s3Object{Key: key, ETag: resp.Header.Get("ETag"), LastModified: modified}, nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		ETag         string
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// newest lists the objects under prefix and returns the most recently modified, checksum sidecars are skipped
+func (c s3Client) newest(ctx context.Context, prefix string, checksumSuffix string) (s3Object, error) {
+	var newest s3Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := c.do(ctx, http.MethodGet, "", query)
+		if err != nil {
+			return newest, err
+		}
+		var res listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return newest, fmt.Errorf("could not parse object listing, %w", err)
+		}
+		for _, o := range res.Contents {
+			if strings.HasSuffix(o.Key, "/") || (checksumSuffix != "" && strings.HasSuffix(o.Key, checksumSuffix)) {
+				continue
+			}
+			if newest.Key == "" || o.LastModified.After(newest.LastModified) || (o.LastModified.Equal(newest.LastModified) && o.Key > newest.Key) {
+				newest = s3Object{Key: o.Key, ETag: o.ETag, LastModified: o.LastModified}
+			}
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			break
+		}
+		token = res.NextContinuationToken
+	}
+	if newest.Key == "" {
+		return newest, fmt.Errorf("no object matches %s", c.location(prefix+"*"))
+	}
+	return newest, nil
+}
+
+// signV4 signs req with aws signature version 4, the payload of req must be empty
+func signV4(req *http.Request, accessKey, secretKey, region string, t time.Time) {
+	t = t.UTC()
+	date := t.Format("20060102")
+	req.Header.Set("x-amz-date", t.Format("20060102T150405Z"))
+	req.Header.Set("x-amz-content-sha256", emptySHA256)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "range" || k == "content-md5" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + scope + "\n" + hexSHA256(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// awsEscape escapes s the way aws expects in signed requests, every byte but the unreserved characters is percent
+// encoded, as is / if escapeSlash is set
+func awsEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || (ch == '/' && !escapeSlash) {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hexSHA256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,164 @@
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/modfin/zdap"
+)
+
+// The triggers of a build
+const (
+	TriggerCron   = "cron"
+	TriggerManual = "manual"
+)
+
+// BuildFunc builds a base of resource
+type BuildFunc func(resource string) error
+
+// Job is a queued or running build of a resource
+type Job struct {
+	resource   string
+	priority   int
+	weight     int
+	trigger    string
+	seq        int
+	enqueuedAt time.Time
+	startedAt  time.Time
+
+	done chan struct{}
+	err  error
+}
+
+// Wait blocks until the build is done and returns its error
+func (j *Job) Wait() error {
+	<-j.done
+	return j.err
+}
+
+// Scheduler runs the builds of bases. Builds use as many of the slots as their weight, only one build of a resource
+// runs at a time, and the queued build with the highest priority is started first. A build that does not fit in the
+// free slots is waited for rather than passed by lighter builds, so that heavy builds are not starved.
+type Scheduler struct {
+	mu      sync.Mutex
+	slots   int
+	used    int
+	seq     int
+	queued  []*Job
+	running map[string]*Job
+	build   BuildFunc
+}
+
+// New returns a scheduler running at most slots weight of builds at a time
+func New(slots int, build BuildFunc) *Scheduler {
+	return &Scheduler{
+		slots:   max(slots, 1),
+		running: map[string]*Job{},
+		build:   build,
+	}
+}
+
+// Enqueue queues a build of resource. If a build of the resource is already queued, that build is returned and given
+// the higher of the priorities.
+func (s *Scheduler) Enqueue(resource string, priority int, weight int, trigger string) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, j := range s.queued {
+		if j.resource == resource {
+			j.priority = max(j.priority, priority)
+			return j
+		}
+	}
+	s.seq++
+	j := &Job{
+		resource:   resource,
+		priority:   priority,
+		weight:     min(max(weight, 1), s.slots),
+		trigger:    trigger,
+		seq:        s.seq,
+		enqueuedAt: time.Now(),
+		done:       make(chan struct{}),
+	}
+	s.queued = append(s.queued, j)
+	fmt.Printf("[SCHEDULER] Queued %s build of %s, %d builds queued\n", trigger, resource, len(s.queued))
+	s.dispatch()
+	return j
+}
+
+// dispatch starts the queued builds that fit, s.mu must be held
+func (s *Scheduler) dispatch() {
+	for {
+		sort.SliceStable(s.queued, func(i, k int) bool {
+			if s.queued[i].priority != s.queued[k].priority {
+				return s.queued[i].priority > s.queued[k].priority
+			}
+			return s.queued[i].seq < s.queued[k].seq
+		})
+		next := -1
+		for i, j := range s.queued {
+			if _, ok := s.running[j.resource]; !ok {
+				next = i
+				break
+			}
+		}
+		if next < 0 || s.used+s.queued[next].weight > s.slots {
+			return
+		}
+
+		j := s.queued[next]
+		s.queued = append(s.queued[:next], s.queued[next+1:]...)
+		s.running[j.resource] = j
+		s.used += j.weight
+		j.startedAt = time.Now()
+		go s.run(j)
+	}
+}
+
+func (s *Scheduler) run(j *Job) {
+	fmt.Println("[SCHEDULER] Starting build of", j.resource)
+	err := s.build(j.resource)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.err = err
+	close(j.done)
+	delete(s.running, j.resource)
+	s.used -= j.weight
+	s.dispatch()
+}
+
+// Status returns the running and queued builds, in the order they are started
+func (s *Scheduler) Status() zdap.BuildQueue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := zdap.BuildQueue{Slots: s.slots, Used: s.used, Running: []zdap.QueuedBuild{}, Queued: []zdap.QueuedBuild{}}
+	for _, j := range s.running {
+		q.Running = append(q.Running, j.public())
+	}
+	sort.Slice(q.Running, func(i, k int) bool {
+		return q.Running[i].StartedAt.Before(*q.Running[k].StartedAt)
+	})
+	for _, j := range s.queued {
+		q.Queued = append(q.Queued, j.public())
+	}
+	return q
+}
+
+func (j *Job) public() zdap.QueuedBuild {
+	b := zdap.QueuedBuild{
+		Resource:   j.resource,
+		Priority:   j.priority,
+		Weight:     j.weight,
+		Trigger:    j.trigger,
+		EnqueuedAt: j.enqueuedAt,
+	}
+	if !j.startedAt.IsZero() {
+		started := j.startedAt
+		b.StartedAt = &started
+	}
+	return b
+}
@@ -0,0 +1,98 @@
+package scheduler
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gate holds every build until it is released, and records the order the builds are started in
+type gate struct {
+	mu      sync.Mutex
+	started []string
+	release map[string]chan error
+}
+
+func newGate() *gate {
+	return &gate{release: map[string]chan error{}}
+}
+
+func (g *gate) ch(resource string) chan error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.release[resource] == nil {
+		g.release[resource] = make(chan error)
+	}
+	return g.release[resource]
+}
+
+func (g *gate) build(resource string) error {
+	g.mu.Lock()
+	g.started = append(g.started, resource)
+	g.mu.Unlock()
+	return <-g.ch(resource)
+}
+
+func (g *gate) order() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string{}, g.started...)
+}
+
+func running(s *Scheduler) []string {
+	var names []string
+	for _, b := range s.Status().Running {
+		names = append(names, b.Resource)
+	}
+	return names
+}
+
+func TestScheduler(t *testing.T) {
+	g := newGate()
+	s := New(2, g.build)
+	wait := func(n int) {
+		assert.Eventually(t, func() bool { return len(g.order()) == n }, time.Second, time.Millisecond)
+	}
+
+	a := s.Enqueue("a", 0, 1, TriggerCron)
+	wait(1)
+	heavy := s.Enqueue("heavy", 5, 2, TriggerCron)
+	s.Enqueue("low", 0, 1, TriggerCron)
+	s.Enqueue("high", 10, 1, TriggerManual)
+	wait(2)
+	assert.Equal(t, []string{"a", "high"}, g.order(), "the build with the highest priority must be started first")
+
+	q := s.Status()
+	assert.Equal(t, 2, q.Used)
+	assert.Equal(t, "heavy", q.Queued[0].Resource)
+	assert.Equal(t, "low", q.Queued[1].Resource)
+
+	again := s.Enqueue("a", 20, 1, TriggerManual)
+	assert.NotSame(t, a, again, "a is running rather than queued, so a new build must be queued")
+	assert.Same(t, again, s.Enqueue("a", 0, 1, TriggerCron), "a queued build must be reused")
+	assert.Equal(t, 20, s.Status().Queued[0].Priority)
+
+	g.ch("high") <- nil
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, []string{"a"}, running(s), "a is already running and heavy does not fit, low must not pass heavy")
+
+	g.ch("a") <- errors.New("failed")
+	assert.EqualError(t, a.Wait(), "failed")
+	wait(3)
+	assert.Equal(t, []string{"a", "high", "a"}, g.order())
+
+	g.ch("a") <- nil
+	assert.NoError(t, again.Wait())
+	wait(4)
+	assert.Equal(t, []string{"heavy"}, running(s))
+	assert.Equal(t, 2, s.Status().Used)
+
+	g.ch("heavy") <- nil
+	assert.NoError(t, heavy.Wait())
+	wait(5)
+	assert.Equal(t, []string{"low"}, running(s))
+	g.ch("low") <- nil
+}
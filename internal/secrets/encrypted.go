@@ -0,0 +1,185 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const keySize = 32 // AES-256
+
+// EncryptedStore is a local file of secrets encrypted with AES-GCM, the key is kept in a separate file
+type EncryptedStore struct {
+	path string
+	aead cipher.AEAD
+	mu   sync.Mutex
+}
+
+type storeFile struct {
+	Secrets map[string]string `json:"secrets"` // name to base64 encoded nonce and ciphertext
+}
+
+// OpenEncryptedStore opens the store at path with the base64 encoded key in keyFile. If create is set a new key is
+// generated when keyFile does not exist, the store file itself is created on the first Set.
+func OpenEncryptedStore(path, keyFile string, create bool) (*EncryptedStore, error) {
+	b, err := os.ReadFile(keyFile)
+	if errors.Is(err, os.ErrNotExist) && create {
+		b, err = createKey(keyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read secret store key, %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode secret store key, %w", err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("secret store key must be %d bytes, got %d", keySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedStore{path: path, aead: aead}, nil
+}
+
+func createKey(keyFile string) ([]byte, error) {
+	key := make([]byte, keySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	b := []byte(base64.StdEncoding.EncodeToString(key) + "\n")
+	err = os.MkdirAll(filepath.Dir(keyFile), 0700)
+	if err != nil {
+		return nil, err
+	}
+	// O_EXCL so a key created concurrently is never overwritten
+	f, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, err = f.Write(b)
+	return b, err
+}
+
+func (e *EncryptedStore) read() (storeFile, error) {
+	f := storeFile{Secrets: map[string]string{}}
+	b, err := os.ReadFile(e.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return f, fmt.Errorf("could not read secret store, %w", err)
+	}
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		return f, fmt.Errorf("could not parse secret store, %w", err)
+	}
+	if f.Secrets == nil {
+		f.Secrets = map[string]string{}
+	}
+	return f, nil
+}
+
+func (e *EncryptedStore) write(f storeFile) error {
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := e.path + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write secret store, %w", err)
+	}
+	return os.Rename(tmp, e.path)
+}
+
+// Get returns the decrypted value of the secret name
+func (e *EncryptedStore) Get(name string) (string, bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f, err := e.read()
+	if err != nil {
+		return "", false, err
+	}
+	sealed, ok := f.Secrets[name]
+	if !ok {
+		return "", false, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(b) < e.aead.NonceSize() {
+		return "", false, fmt.Errorf("secret '%s' in the secret store is malformed", name)
+	}
+	nonce, ciphertext := b[:e.aead.NonceSize()], b[e.aead.NonceSize():]
+	// the name is authenticated as well, so that values can't be swapped between secrets
+	value, err := e.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return "", false, fmt.Errorf("could not decrypt secret '%s', %w", name, err)
+	}
+	return string(value), true, nil
+}
+
+// Set encrypts and stores value as the secret name
+func (e *EncryptedStore) Set(name, value string) error {
+	err := ValidName(name)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f, err := e.read()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, e.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	sealed := e.aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	f.Secrets[name] = base64.StdEncoding.EncodeToString(sealed)
+	return e.write(f)
+}
+
+// Remove removes the secret name, it is not an error if it does not exist
+func (e *EncryptedStore) Remove(name string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f, err := e.read()
+	if err != nil {
+		return err
+	}
+	delete(f.Secrets, name)
+	return e.write(f)
+}
+
+// Names returns the names of the secrets in the store
+func (e *EncryptedStore) Names() ([]string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f, err := e.read()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range f.Secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
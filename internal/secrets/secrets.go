@@ -0,0 +1,168 @@
+package secrets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/modfin/zdap"
+)
+
+// EnvPrefix is the prefix of environment variables holding secrets, the secret db-password is read from
+// ZDAP_SECRET_DB_PASSWORD
+const EnvPrefix = "ZDAP_SECRET_"
+
+// Redacted replaces the values of secrets in logs and api responses
+const Redacted = "[REDACTED]"
+
+// minRedactLength is the shortest secret value that is redacted, shorter values would mangle unrelated output
+const minRedactLength = 4
+
+var nameReg = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ValidName returns an error if name can't be used as the name of a secret
+func ValidName(name string) error {
+	if !nameReg.MatchString(name) {
+		return zdap.NewError(zdap.CodeInvalid, "'%s' is not a valid secret name, only letters, digits, '_', '.' and '-' are allowed", name)
+	}
+	return nil
+}
+
+// Store looks up secrets in a dir of files, an encrypted store and the environment, in that order. Every value that
+// has been looked up is redacted by Redact. A nil Store has no secrets.
+type Store struct {
+	dir       string
+	encrypted *EncryptedStore
+
+	mu       sync.RWMutex
+	resolved map[string]string
+}
+
+// NewStore creates a store, dir and encrypted are optional
+func NewStore(dir string, encrypted *EncryptedStore) *Store {
+	return &Store{dir: dir, encrypted: encrypted, resolved: map[string]string{}}
+}
+
+// Lookup returns the value of the secret name
+func (s *Store) Lookup(name string) (string, error) {
+	if s == nil {
+		return "", zdap.NewError(zdap.CodeNotFound, "could not find secret '%s', no secret store is configured", name)
+	}
+	err := ValidName(name)
+	if err != nil {
+		return "", err
+	}
+	value, found, err := s.lookup(name)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", zdap.NewError(zdap.CodeNotFound, "could not find secret '%s'", name)
+	}
+
+	s.mu.Lock()
+	s.resolved[name] = value
+	s.mu.Unlock()
+	return value, nil
+}
+
+func (s *Store) lookup(name string) (string, bool, error) {
+	if s.dir != "" {
+		b, err := os.ReadFile(filepath.Join(s.dir, name))
+		if err == nil {
+			return strings.TrimRight(string(b), "\r\n"), true, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", false, fmt.Errorf("could not read secret '%s', %w", name, err)
+		}
+	}
+	if s.encrypted != nil {
+		value, found, err := s.encrypted.Get(name)
+		if err != nil || found {
+			return value, found, err
+		}
+	}
+	value, found := os.LookupEnv(EnvName(name))
+	return value, found, nil
+}
+
+// EnvName returns the environment variable the secret name is read from
+func EnvName(name string) string {
+	return EnvPrefix + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Redact replaces the values of every secret looked up in s with Redacted
+func (s *Store) Redact(str string) string {
+	if s == nil {
+		return str
+	}
+	s.mu.RLock()
+	var values []string
+	for _, v := range s.resolved {
+		if len(v) >= minRedactLength {
+			values = append(values, v)
+		}
+	}
+	s.mu.RUnlock()
+
+	// longer values first, in case a secret contains another
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	for _, v := range values {
+		str = strings.ReplaceAll(str, v, Redacted)
+	}
+	return str
+}
+
+// Writer returns a writer that redacts secrets before writing to w. Output is redacted line by line, so a secret
+// split over several writes is only redacted if the writes are part of the same line.
+func (s *Store) Writer(w io.Writer) io.WriteCloser {
+	return &redactWriter{store: s, w: w}
+}
+
+type redactWriter struct {
+	store *Store
+	w     io.Writer
+	mu    sync.Mutex
+	buf   []byte
+}
+
+func (r *redactWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf = append(r.buf, p...)
+	i := bytes.LastIndexByte(r.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	_, err := io.WriteString(r.w, r.store.Redact(string(r.buf[:i+1])))
+	r.buf = append(r.buf[:0], r.buf[i+1:]...)
+	return len(p), err
+}
+
+// Close writes what is left of the last line
+func (r *redactWriter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(r.w, r.store.Redact(string(r.buf)))
+	r.buf = r.buf[:0]
+	return err
+}
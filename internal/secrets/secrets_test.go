@@ -0,0 +1,91 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/modfin/zdap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_Lookup(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "db-password"), []byte("from-file\n"), 0600))
+
+	encrypted, err := OpenEncryptedStore(filepath.Join(dir, "store.json"), filepath.Join(dir, "keys", "store.key"), true)
+	assert.NoError(t, err)
+	assert.NoError(t, encrypted.Set("db-password", "from-store"))
+	assert.NoError(t, encrypted.Set("backup-key", "from-store"))
+	t.Setenv("ZDAP_SECRET_BACKUP_KEY", "from-env")
+	t.Setenv("ZDAP_SECRET_S3_TOKEN", "from-env")
+
+	s := NewStore(dir, encrypted)
+	for name, want := range map[string]string{"db-password": "from-file", "backup-key": "from-store", "s3.token": "from-env"} {
+		value, err := s.Lookup(name)
+		assert.NoError(t, err)
+		assert.Equal(t, want, value, name)
+	}
+
+	_, err = s.Lookup("missing")
+	assert.True(t, errors.Is(err, zdap.ErrNotFound), "missing secret, got %v", err)
+	_, err = s.Lookup("../store.json")
+	assert.True(t, errors.Is(err, zdap.ErrInvalid), "invalid name, got %v", err)
+
+	_, err = (*Store)(nil).Lookup("db-password")
+	assert.Error(t, err)
+}
+
+func TestEncryptedStore(t *testing.T) {
+	dir := t.TempDir()
+	path, keyFile := filepath.Join(dir, "store.json"), filepath.Join(dir, "store.key")
+
+	_, err := OpenEncryptedStore(path, keyFile, false)
+	assert.Error(t, err, "a missing key must not be created unless asked to")
+
+	e, err := OpenEncryptedStore(path, keyFile, true)
+	assert.NoError(t, err)
+	assert.NoError(t, e.Set("a", "qwerty"))
+	assert.NoError(t, e.Set("b", "asdfgh"))
+	assert.NoError(t, e.Remove("b"))
+
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "qwerty")
+
+	e, err = OpenEncryptedStore(path, keyFile, false)
+	assert.NoError(t, err)
+	names, err := e.Names()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, names)
+	value, found, err := e.Get("a")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "qwerty", value)
+
+	other, err := OpenEncryptedStore(path, filepath.Join(dir, "other.key"), true)
+	assert.NoError(t, err)
+	_, _, err = other.Get("a")
+	assert.Error(t, err, "a store must not be readable with another key")
+}
+
+func TestStore_Redact(t *testing.T) {
+	t.Setenv("ZDAP_SECRET_PASSWORD", "qwerty")
+	t.Setenv("ZDAP_SECRET_SHORT", "pw")
+	t.Setenv("ZDAP_SECRET_UNUSED", "asdfgh")
+	s := NewStore("", nil)
+	_, _ = s.Lookup("password")
+	_, _ = s.Lookup("short")
+
+	assert.Equal(t, "POSTGRES_PASSWORD=[REDACTED] pw asdfgh", s.Redact("POSTGRES_PASSWORD=qwerty pw asdfgh"))
+
+	var out bytes.Buffer
+	w := s.Writer(&out)
+	_, _ = w.Write([]byte("connecting with qwe"))
+	_, _ = w.Write([]byte("rty\nretrying with qwerty"))
+	assert.Equal(t, "connecting with [REDACTED]\n", out.String())
+	assert.NoError(t, w.Close())
+	assert.Equal(t, "connecting with [REDACTED]\nretrying with [REDACTED]", out.String())
+}
@@ -11,9 +11,11 @@ type ServerInternalResource struct {
 }
 type ServerInternalSnapshot struct {
 	zdap.PublicSnap
-	Clones []ServerInternalClone `json:"clones"`
+	Clones   []ServerInternalClone `json:"clones"`
+	Metadata string                `json:"-"` // json metadata reported by the scripts that created the snap
 }
 type ServerInternalClone struct {
 	zdap.PublicClone
+	Ready   bool // the clone has been created and handed out, unlike Healthy it never changes after that
 	Dataset *zfs.Dataset
 }
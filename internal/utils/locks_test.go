@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	var k KeyedMutex
+	unlock := k.Lock("a")
+
+	// other keys are not blocked
+	done := make(chan struct{})
+	go func() {
+		k.Lock("b")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("locking b was blocked by a")
+	}
+
+	var mu sync.Mutex
+	locked := false
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		unlock := k.Lock("a")
+		defer unlock()
+		mu.Lock()
+		locked = true
+		mu.Unlock()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if locked {
+		t.Fatal("a was locked twice")
+	}
+	mu.Unlock()
+	unlock()
+	<-done
+	if len(k.locks) != 0 {
+		t.Fatalf("expected the released locks to be dropped, got %d", len(k.locks))
+	}
+}
@@ -1,6 +1,7 @@
 package zfs
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"regexp"
@@ -12,6 +13,7 @@ import (
 
 	zfs "github.com/kraudcloud/go-libzfs/v2"
 	"github.com/modfin/zdap"
+	"github.com/modfin/zdap/internal"
 	"github.com/modfin/zdap/internal/servermodel"
 	"github.com/modfin/zdap/internal/utils"
 )
@@ -40,15 +42,40 @@ const PropClonePooled = "zdap:clone_pooled"
 const PropPort = "zdap:port"
 const PropExpires = "zdap:expires_at"
 const PropHealthy = "zdap:healthy"
+const PropReady = "zdap:ready"       // true once the clone has been created and handed out, it never changes after that
+const PropMetadata = "zdap:metadata" // json metadata reported by the scripts that created a snap
+const PropBuild = "zdap:build"       // json build status of a resource, stored on the pool as zdap:build:<resource>
+const PropPinned = "zdap:pinned"     // true if the snap is the default snap of its resource
+const PropDeprecated = "zdap:deprecated"
+const PropDeprecationReason = "zdap:deprecation_reason"
+const PropLimits = "zdap:limits" // json limits of the container of a clone
+
+// HoldPinned is the user hold placed on pinned snaps, zfs refuses to destroy a held snap
+const HoldPinned = "zdap-pinned"
 
 const TimestampFormat = "2006-01-02T15.04.05"
 
 var TimeReg = regexp.MustCompile("[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}.[0-9]{2}.[0-9]{2}")
 
 var cloneReg = regexp.MustCompile("^zdap.*base-[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}.[0-9]{2}.[0-9]{2}-clone-[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}.[0-9]{2}.[0-9]{2}.[a-zA-Z]{3}$")
-var snapReg = regexp.MustCompile("^zdap.*base-[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}.[0-9]{2}.[0-9]{2}@snap$")
+
+// snaps are named <base>@snap, or <base>@snap-<created> once they are moved to a base cloned from them, see PromoteBase
+var snapReg = regexp.MustCompile("^zdap.*base-[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}.[0-9]{2}.[0-9]{2}@snap(-[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}.[0-9]{2}.[0-9]{2})?$")
 var baseReg = regexp.MustCompile("^zdap.*base-[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}.[0-9]{2}.[0-9]{2}$")
 
+// IsClone returns true if name is the name of a clone, and of its container
+func IsClone(name string) bool {
+	return cloneReg.MatchString(name)
+}
+
+// BaseResource returns the resource of the base, or base container, name
+func BaseResource(name string) (string, bool) {
+	if !baseReg.MatchString(name) || !strings.HasPrefix(name, "zdap-") {
+		return "", false
+	}
+	return strings.TrimPrefix(name[:len(name)-len("-base-")-len(TimestampFormat)], "zdap-"), true
+}
+
 func (z *ZFS) GetDatasetBaseNameAt(name string, at time.Time) string {
 	return fmt.Sprintf("zdap-%s-base-%s", name, at.Format(TimestampFormat))
 }
@@ -214,8 +241,119 @@ func (z *ZFS) destroyDatasetRec(path string) error {
 
 }
 
+// Destroy destroys the dataset name with its snaps and their clones. It refuses to if any of the snaps is pinned.
 func (z *ZFS) Destroy(name string) error {
-	return z.destroyDatasetRec(fmt.Sprintf("%s/%s", z.pool, name))
+	path := fmt.Sprintf("%s/%s", z.pool, name)
+	pinned, err := z.pinnedSnaps(path)
+	if err != nil {
+		return err
+	}
+	if len(pinned) > 0 {
+		return fmt.Errorf("could not destroy %s, the snaps %s are pinned", name, strings.Join(pinned, ", "))
+	}
+	return z.destroyDatasetRec(path)
+}
+
+// pinnedSnaps returns the pinned snaps that destroying the dataset at path would destroy
+func (z *ZFS) pinnedSnaps(path string) ([]string, error) {
+	z.readLock()
+	ds, err := zfs.DatasetOpen(path)
+	z.readUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer ds.Close()
+
+	z.readLock()
+	clones, err := ds.Clones()
+	z.readUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("could not get clones: %w", err)
+	}
+	var pinned []string
+	for _, c := range clones {
+		p, err := z.pinnedSnaps(c)
+		if err != nil {
+			return nil, err
+		}
+		pinned = append(pinned, p...)
+	}
+	for i := range ds.Children {
+		c := &ds.Children[i]
+		p, err := c.Path()
+		if err != nil {
+			return nil, fmt.Errorf("could not get path: %w", err)
+		}
+		if !c.IsSnapshot() {
+			cp, err := z.pinnedSnaps(p)
+			if err != nil {
+				return nil, err
+			}
+			pinned = append(pinned, cp...)
+			continue
+		}
+		if isPinned(c) {
+			pinned = append(pinned, strings.TrimPrefix(p, z.pool+"/"))
+		}
+	}
+	return pinned, nil
+}
+
+// isPinned reports if the snap is pinned, either marked by the property or held. Snaps pinned before the hold was
+// introduced only have the property.
+func isPinned(snap *zfs.Dataset) bool {
+	if p, err := snap.GetUserProperty(PropPinned); err == nil && p.Value == "true" {
+		return true
+	}
+	holds, err := snap.Holds()
+	if err != nil {
+		return false
+	}
+	for _, h := range holds {
+		if h.Name == HoldPinned {
+			return true
+		}
+	}
+	return false
+}
+
+// HoldSnap places the HoldPinned hold on the snap name, if it is not held already
+func (z *ZFS) HoldSnap(name string) error {
+	return z.setHold(name, true)
+}
+
+// ReleaseSnap releases the HoldPinned hold of the snap name, if it is held
+func (z *ZFS) ReleaseSnap(name string) error {
+	return z.setHold(name, false)
+}
+
+func (z *ZFS) setHold(name string, hold bool) error {
+	z.writeLock()
+	defer z.writeUnlock()
+
+	ds, err := zfs.DatasetOpenSingle(fmt.Sprintf("%s/%s", z.pool, name))
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	holds, err := ds.Holds()
+	if err != nil {
+		return fmt.Errorf("could not list holds of %s, %w", name, err)
+	}
+	held := false
+	for _, h := range holds {
+		held = held || h.Name == HoldPinned
+	}
+	switch {
+	case hold && !held:
+		err = ds.Hold(HoldPinned)
+	case !hold && held:
+		err = ds.Release(HoldPinned)
+	}
+	if err != nil {
+		return fmt.Errorf("could not change the %s hold of %s, %w", HoldPinned, name, err)
+	}
+	return nil
 }
 
 func (z *ZFS) DestroyAll() error {
@@ -260,6 +398,14 @@ func (z *ZFS) DestroyAll() error {
 		if isClone[path] {
 			continue
 		}
+		pinned, err := z.pinnedSnaps(path)
+		if err != nil {
+			return err
+		}
+		if len(pinned) > 0 {
+			fmt.Println("- Keeping", path, "since the snaps", strings.Join(pinned, ", "), "are pinned")
+			continue
+		}
 
 		fmt.Println("- Destroying", path)
 		err = z.destroyDatasetRec(path)
@@ -346,6 +492,11 @@ func (z *ZFS) ListClones(dss *Dataset) ([]servermodel.ServerInternalClone, error
 		if err != nil {
 			return nil, err
 		}
+		// clones created before the ready mark was introduced were handed out if their health was ever recorded
+		ready := healthy.Value != "-"
+		if p, err := d.GetUserProperty(PropReady); err == nil && p.Value != "-" {
+			ready = p.Value == "true"
+		}
 
 		// TODO for backwards compatibility, should be removed
 		port := 0
@@ -367,6 +518,14 @@ func (z *ZFS) ListClones(dss *Dataset) ([]servermodel.ServerInternalClone, error
 			expiresAt = &expAt
 		}
 
+		var limits *internal.Limits
+		if p, err := d.GetUserProperty(PropLimits); err == nil && p.Value != "-" {
+			l := internal.Limits{}
+			if json.Unmarshal([]byte(p.Value), &l) == nil {
+				limits = &l
+			}
+		}
+
 		clones = append(clones, servermodel.ServerInternalClone{
 			PublicClone: zdap.PublicClone{
 				Name:        c,
@@ -377,7 +536,9 @@ func (z *ZFS) ListClones(dss *Dataset) ([]servermodel.ServerInternalClone, error
 				ClonePooled: clonePooled.Value == "true",
 				Healthy:     healthy.Value == "true",
 				ExpiresAt:   expiresAt,
+				Limits:      limits,
 				Port:        port},
+			Ready:   ready,
 			Dataset: d,
 		})
 	}
@@ -425,11 +586,28 @@ func (z *ZFS) ListSnaps(dss *Dataset) ([]servermodel.ServerInternalSnapshot, err
 			return nil, err
 		}
 
+		var metadata string
+		if m, err := d.GetUserProperty(PropMetadata); err == nil && m.Value != "-" {
+			metadata = m.Value
+		}
+		snap := zdap.PublicSnap{
+			Name:      s,
+			Resource:  resource.Value,
+			CreatedAt: createdAt,
+		}
+		if p, err := d.GetUserProperty(PropPinned); err == nil {
+			snap.Pinned = p.Value == "true"
+		}
+		if p, err := d.GetUserProperty(PropDeprecated); err == nil {
+			snap.Deprecated = p.Value == "true"
+		}
+		if p, err := d.GetUserProperty(PropDeprecationReason); err == nil && snap.Deprecated && p.Value != "-" {
+			snap.DeprecationReason = p.Value
+		}
+
 		snaps = append(snaps, servermodel.ServerInternalSnapshot{
-			PublicSnap: zdap.PublicSnap{
-				Name:      s,
-				Resource:  resource.Value,
-				CreatedAt: createdAt},
+			PublicSnap: snap,
+			Metadata:   metadata,
 		})
 	}
 
@@ -451,7 +629,8 @@ func (z *ZFS) listReg(dss *Dataset, reg *regexp.Regexp) ([]string, error) {
 	return list, nil
 }
 
-func (z *ZFS) SnapDataset(name string, resource string, created time.Time) error {
+// SnapDataset snaps the base name, metadata is stored on the snap unless empty
+func (z *ZFS) SnapDataset(name string, resource string, created time.Time, metadata string) error {
 	z.writeLock()
 	defer z.writeUnlock()
 
@@ -469,9 +648,97 @@ func (z *ZFS) SnapDataset(name string, resource string, created time.Time) error
 	if err != nil {
 		return err
 	}
+	if metadata != "" {
+		err = ds.SetUserProperty(PropMetadata, metadata)
+	}
 	return err
 }
 
+// CloneBase creates the base name as a clone of the snap snapName. The base depends on the base it was cloned from until
+// it is promoted with PromoteBase, which allows it to be destroyed if it is never completed.
+func (z *ZFS) CloneBase(snapName string, name string, resource string, creation time.Time, zfsProps map[string]string) (string, error) {
+	z.writeLock()
+	defer z.writeUnlock()
+
+	dsName, snapPart, ok := strings.Cut(snapName, "@")
+	if !ok {
+		return "", errors.New("snap name is not properly formated")
+	}
+	ds, err := zfs.DatasetOpen(fmt.Sprintf("%s/%s", z.pool, dsName))
+	if err != nil {
+		return "", err
+	}
+	defer ds.Close()
+	ok, snap := ds.FindSnapshotName("@" + snapPart)
+	if !ok {
+		return "", fmt.Errorf("could not find snap %s to clone", snapName)
+	}
+
+	clone, err := snap.Clone(fmt.Sprintf("%s/%s", z.pool, name), zfsPropMap(zfsProps))
+	if err != nil {
+		return "", fmt.Errorf("could not clone %s, %w", snapName, err)
+	}
+	defer clone.Close()
+	err = clone.SetUserProperty(PropResource, resource)
+	if err != nil {
+		return "", err
+	}
+	err = clone.SetUserProperty(PropCreated, creation.Format(TimestampFormat))
+	if err != nil {
+		return "", err
+	}
+
+	err = clone.Mount("", 0)
+	if err != nil {
+		return "", err
+	}
+	mounted, path := clone.IsMounted()
+	if !mounted {
+		return "", errors.New("could not mount fs")
+	}
+	return path, nil
+}
+
+// PromoteBase promotes the base name, created by CloneBase, so that it does not depend on the base it was cloned from.
+// Promoting moves the snap, and the snaps moved to that base before it, to the new base. The moved snap is renamed to
+// snap-<created> so that the new base can be snapped as usual. Once promoted the bases before it depend on the base, it
+// must not be destroyed on its own.
+func (z *ZFS) PromoteBase(name string) error {
+	z.writeLock()
+	defer z.writeUnlock()
+
+	target := fmt.Sprintf("%s/%s", z.pool, name)
+	clone, err := zfs.DatasetOpen(target)
+	if err != nil {
+		return err
+	}
+	defer clone.Close()
+	err = clone.Promote()
+	if err != nil {
+		return fmt.Errorf("could not promote %s, %w", name, err)
+	}
+
+	promoted, err := zfs.DatasetOpen(target)
+	if err != nil {
+		return err
+	}
+	defer promoted.Close()
+	ok, moved := promoted.FindSnapshotName("@snap")
+	if !ok {
+		// the base was cloned from a snap that had already been moved and renamed
+		return nil
+	}
+	created, err := moved.GetUserProperty(PropCreated)
+	if err != nil {
+		return err
+	}
+	err = moved.Rename(fmt.Sprintf("%s@snap-%s", target, created.Value), false, false)
+	if err != nil {
+		return fmt.Errorf("could not rename the snap moved to %s, %w", name, err)
+	}
+	return nil
+}
+
 func (z *ZFS) CloneDataset(owner, snapName string, port int, clonePooled bool, zfsProps map[string]string) (string, string, error) {
 	z.writeLock()
 	defer z.writeUnlock()
@@ -512,7 +779,8 @@ func (z *ZFS) CloneDataset(owner, snapName string, port int, clonePooled bool, z
 		return "", "", err
 	}
 
-	resource, err := ds.GetUserProperty(PropResource)
+	// the props are read from the snap, as snaps moved by CloneBase are not created at the same time as their base
+	resource, err := snap.GetUserProperty(PropResource)
 	if err != nil {
 		return "", "", err
 	}
@@ -520,7 +788,7 @@ func (z *ZFS) CloneDataset(owner, snapName string, port int, clonePooled bool, z
 	if err != nil {
 		return "", "", err
 	}
-	snappedAt, err := ds.GetUserProperty(PropCreated)
+	snappedAt, err := snap.GetUserProperty(PropCreated)
 	if err != nil {
 		return "", "", err
 	}
@@ -536,6 +804,10 @@ func (z *ZFS) CloneDataset(owner, snapName string, port int, clonePooled bool, z
 	if err != nil {
 		return "", "", err
 	}
+	err = clone.SetUserProperty(PropReady, "false")
+	if err != nil {
+		return "", "", err
+	}
 
 	err = clone.Mount("", 0)
 	if err != nil {
@@ -589,6 +861,101 @@ func (z *ZFS) SetUserProperty(dataset zfs.Dataset, prop string, value string) er
 	return dataset.SetUserProperty(prop, value)
 }
 
+// SetUserProperties sets user properties of the dataset or snap name
+func (z *ZFS) SetUserProperties(name string, props map[string]string) error {
+	z.writeLock()
+	defer z.writeUnlock()
+
+	ds, err := zfs.DatasetOpenSingle(fmt.Sprintf("%s/%s", z.pool, name))
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		err = ds.SetUserProperty(k, props[k])
+		if err != nil {
+			return fmt.Errorf("could not set %s of %s, %w", k, name, err)
+		}
+	}
+	return nil
+}
+
+// MountPath returns the path the dataset name is mounted at, mounting it if it is not
+func (z *ZFS) MountPath(name string) (string, error) {
+	z.writeLock()
+	defer z.writeUnlock()
+
+	ds, err := zfs.DatasetOpenSingle(fmt.Sprintf("%s/%s", z.pool, name))
+	if err != nil {
+		return "", err
+	}
+	defer ds.Close()
+	if mounted, path := ds.IsMounted(); mounted {
+		return path, nil
+	}
+	err = ds.Mount("", 0)
+	if err != nil {
+		return "", err
+	}
+	mounted, path := ds.IsMounted()
+	if !mounted {
+		return "", errors.New("could not mount " + name)
+	}
+	return path, nil
+}
+
+// LogicalSize returns the size of the data referenced by the dataset or snap name, before compression
+func (z *ZFS) LogicalSize(name string) (uint64, error) {
+	z.readLock()
+	defer z.readUnlock()
+
+	ds, err := zfs.DatasetOpenSingle(fmt.Sprintf("%s/%s", z.pool, name))
+	if err != nil {
+		return 0, err
+	}
+	defer ds.Close()
+	p, err := ds.GetProperty(zfs.DatasetPropLogicalreferenced)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(p.Value, 10, 64)
+}
+
+// SetPoolUserProperty sets a user property of the pool itself
+func (z *ZFS) SetPoolUserProperty(prop string, value string) error {
+	z.writeLock()
+	defer z.writeUnlock()
+
+	ds, err := zfs.DatasetOpenSingle(z.pool)
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	return ds.SetUserProperty(prop, value)
+}
+
+// GetPoolUserProperty returns a user property of the pool itself, an empty string if it is not set
+func (z *ZFS) GetPoolUserProperty(prop string) (string, error) {
+	z.readLock()
+	defer z.readUnlock()
+
+	ds, err := zfs.DatasetOpenSingle(z.pool)
+	if err != nil {
+		return "", err
+	}
+	defer ds.Close()
+	p, err := ds.GetUserProperty(prop)
+	if err != nil || p.Value == "-" {
+		return "", err
+	}
+	return p.Value, nil
+}
+
 func (z *ZFS) UsedSpace(dss *Dataset) (uint64, error) {
 	//p, err := zfs.PoolOpen(z.pool)
 	p, err := dss.Pool()
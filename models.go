@@ -11,25 +11,120 @@ type PublicResource struct {
 	Alias     string                   `json:"alias"`
 	Snaps     []PublicSnap             `json:"snaps"`
 	ClonePool internal.ClonePoolConfig `json:"pooled_clones"`
+	Build     *BuildStatus             `json:"build,omitempty"`
+}
+
+// The states of a BuildStatus
+const (
+	BuildRunning   = "running"
+	BuildRetrying  = "retrying"
+	BuildSucceeded = "succeeded"
+	BuildFailed    = "failed"
+)
+
+// BuildQueue is the state of the build scheduler of the server
+type BuildQueue struct {
+	Slots   int           `json:"slots"` // the total weight of the builds that may run at once
+	Used    int           `json:"used"`
+	Running []QueuedBuild `json:"running"`
+	Queued  []QueuedBuild `json:"queued"` // in the order the builds are started
+}
+
+// QueuedBuild is a running or queued build of a base
+type QueuedBuild struct {
+	Resource   string     `json:"resource"`
+	Priority   int        `json:"priority"`
+	Weight     int        `json:"weight"`
+	Trigger    string     `json:"trigger"` // cron or manual
+	EnqueuedAt time.Time  `json:"enqueued_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+}
+
+// BuildStatus is the state of the latest creation of a base of a resource
+type BuildStatus struct {
+	State               string     `json:"state"`
+	Phase               string     `json:"phase,omitempty"` // the phase running, or the phase that failed
+	Attempt             int        `json:"attempt"`
+	Attempts            int        `json:"attempts"`
+	StartedAt           time.Time  `json:"started_at"`
+	FinishedAt          *time.Time `json:"finished_at,omitempty"`
+	NextAttemptAt       *time.Time `json:"next_attempt_at,omitempty"`
+	Error               string     `json:"error,omitempty"`
+	LastSuccessAt       *time.Time `json:"last_success_at,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"` // the number of builds that failed since the last success
 }
 type PublicSnap struct {
-	Name      string        `json:"name"`
-	Resource  string        `json:"resource"`
-	CreatedAt time.Time     `json:"created_at"`
-	Clones    []PublicClone `json:"clones"`
+	Name              string        `json:"name"`
+	Resource          string        `json:"resource"`
+	CreatedAt         time.Time     `json:"created_at"`
+	Clones            []PublicClone `json:"clones"`
+	Pinned            bool          `json:"pinned"`     // the snap is the default snap of the resource
+	Deprecated        bool          `json:"deprecated"` // the snap is hidden from new clones
+	DeprecationReason string        `json:"deprecation_reason,omitempty"`
+}
+
+// DefaultSnap returns the index of the snap new clones are made from, the pinned snap or else the latest snap which is
+// not deprecated, or -1 if no snap can be cloned
+func DefaultSnap(snaps []PublicSnap) int {
+	def := -1
+	for i, s := range snaps {
+		switch {
+		case s.Deprecated:
+		case s.Pinned:
+			return i
+		case def < 0 || s.CreatedAt.After(snaps[def].CreatedAt):
+			def = i
+		}
+	}
+	return def
 }
+
 type PublicClone struct {
-	Name        string     `json:"name"`
-	Resource    string     `json:"resource"`
-	Owner       string     `json:"owner"`
-	CreatedAt   time.Time  `json:"created_at"`
-	SnappedAt   time.Time  `json:"snapped_at"`
-	Server      string     `json:"server"`
-	APIPort     int        `json:"api_port"`
-	Port        int        `json:"port"`
-	ClonePooled bool       `json:"clone_pooled"`
-	Healthy     bool       `json:"healthy"`
-	ExpiresAt   *time.Time `json:"expires_at"`
+	Name        string           `json:"name"`
+	Resource    string           `json:"resource"`
+	Owner       string           `json:"owner"`
+	CreatedAt   time.Time        `json:"created_at"`
+	SnappedAt   time.Time        `json:"snapped_at"`
+	Server      string           `json:"server"`
+	APIPort     int              `json:"api_port"`
+	Port        int              `json:"port"`
+	ClonePooled bool             `json:"clone_pooled"`
+	Healthy     bool             `json:"healthy"`
+	ExpiresAt   *time.Time       `json:"expires_at"`
+	Limits      *internal.Limits `json:"limits,omitempty"` // the limits of the clone container, nil if unlimited
+}
+
+// The states of a clone container found by the health monitor
+const (
+	CloneHealthy   = "healthy"
+	CloneStarting  = "starting"
+	CloneUnhealthy = "unhealthy"
+	CloneStopped   = "stopped"
+	CloneMissing   = "missing"
+)
+
+// The repairs of a broken clone
+const (
+	RepairRestarted = "restarted" // the container was restarted
+	RepairRecreated = "recreated" // the container was replaced by a new one on the same dataset
+	RepairReplaced  = "replaced"  // the pooled clone was expired, and is replaced by the clone pool
+)
+
+// CloneHealth is the health of a clone, as checked by the health monitor of zdapd since it started
+type CloneHealth struct {
+	Clone               string        `json:"clone"`
+	Healthy             bool          `json:"healthy"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	Repairs             int           `json:"repairs"`
+	LastRepairAt        *time.Time    `json:"last_repair_at,omitempty"`
+	History             []HealthCheck `json:"history"` // the latest checks, oldest first
+}
+
+type HealthCheck struct {
+	At     time.Time `json:"at"`
+	State  string    `json:"state"`
+	Repair string    `json:"repair,omitempty"`
+	Error  string    `json:"error,omitempty"`
 }
 
 func (c *PublicClone) YAML(listenPort int) string {
@@ -44,6 +139,14 @@ func (c *PublicClone) YAML(listenPort int) string {
 `, c.Resource, listenPort, c.Server, c.Port, listenPort, listenPort)
 }
 
+type PublicCertificate struct {
+	Owner       string    `json:"owner"`
+	Certificate string    `json:"certificate"`
+	Key         string    `json:"key"`
+	CA          string    `json:"ca"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
 type ServerStatus struct {
 	Address         string                           `json:"address"`
 	Resources       []string                         `json:"resources"`
@@ -66,3 +169,10 @@ type ServerResourceDetails struct {
 	Name                  string `json:"name"`
 	PooledClonesAvailable int    `json:"pooled_clones_available"`
 }
+
+// ReloadResult names the resources that changed when zdapd reloaded its resource config
+type ReloadResult struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Updated []string `json:"updated"`
+}
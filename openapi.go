@@ -0,0 +1,8 @@
+package zdap
+
+import _ "embed"
+
+// OpenAPI is the OpenAPI document of the zdapd http api, zdapd serves it at /openapi.json
+//
+//go:embed openapi.json
+var OpenAPI []byte
@@ -0,0 +1,129 @@
+package zdap
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/modfin/zdap/internal"
+)
+
+type openAPIDoc struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+func loadOpenAPI(t *testing.T) openAPIDoc {
+	var doc openAPIDoc
+	if err := json.Unmarshal(OpenAPI, &doc); err != nil {
+		t.Fatalf("could not parse openapi.json, %v", err)
+	}
+	return doc
+}
+
+// operation returns the path template of the documented operation matching method and path
+func (doc openAPIDoc) operation(method, path string) (string, bool) {
+	segments := strings.Split(path, "/")
+	for tmpl, ops := range doc.Paths {
+		if _, ok := ops[strings.ToLower(method)]; !ok {
+			continue
+		}
+		parts := strings.Split(tmpl, "/")
+		if len(parts) != len(segments) {
+			continue
+		}
+		match := true
+		for i, part := range parts {
+			if !strings.HasPrefix(part, "{") && part != segments[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return tmpl, true
+		}
+	}
+	return "", false
+}
+
+func TestOpenAPI_Client(t *testing.T) {
+	doc := loadOpenAPI(t)
+
+	var method, path string
+	tc := newTestClient(func(req *http.Request) *http.Response {
+		method, path = req.Method, req.URL.EscapedPath()
+		return &http.Response{StatusCode: http.StatusInternalServerError, Header: make(http.Header)}
+	})
+	cli := New(testSever, t.Name(), WithHTTPClient(tc), WithRetries(0, 0, 0))
+	now := time.Now()
+
+	calls := map[string]func(){
+		"Status":            func() { _, _ = cli.Status() },
+		"GetResources":      func() { _, _ = cli.GetResources() },
+		"GetResourceSnaps":  func() { _, _ = cli.GetResourceSnaps("postgres-1") },
+		"CloneSnap":         func() { _, _ = cli.CloneSnap("postgres-1", now, ClaimArgs{}) },
+		"CloneSnap(latest)": func() { _, _ = cli.CloneSnap("postgres-1", time.Time{}, ClaimArgs{}) },
+		"CloneSnap(pooled)": func() { _, _ = cli.CloneSnap("postgres-1", now, ClaimArgs{ClaimPooled: true, TtlSeconds: 60}) },
+		"GetClones":         func() { _, _ = cli.GetClones("postgres-1") },
+		"ExpireClaim":       func() { _ = cli.ExpireClaim("postgres-1", "zdap-postgres-1-clone") },
+		"DestroyClone":      func() { _ = cli.DestroyClone("postgres-1", now) },
+		"DestroyClone(all)": func() { _ = cli.DestroyClone("postgres-1", time.Time{}) },
+		"GetCloneHealth":    func() { _, _ = cli.GetCloneHealth("postgres-1", now) },
+		"IssueCertificate":  func() { _, _ = cli.IssueCertificate() },
+	}
+	for name, call := range calls {
+		call()
+		if _, ok := doc.operation(method, path); !ok {
+			t.Errorf("%s calls %s %s, which is not documented in openapi.json", name, method, path)
+		}
+	}
+}
+
+func TestOpenAPI_Schemas(t *testing.T) {
+	doc := loadOpenAPI(t)
+
+	models := map[string]any{
+		"ServerStatus":          ServerStatus{},
+		"ServerResourceDetails": ServerResourceDetails{},
+		"Resource":              PublicResource{},
+		"BuildStatus":           BuildStatus{},
+		"BuildQueue":            BuildQueue{},
+		"QueuedBuild":           QueuedBuild{},
+		"Snap":                  PublicSnap{},
+		"Clone":                 PublicClone{},
+		"Limits":                internal.Limits{},
+		"CloneHealth":           CloneHealth{},
+		"HealthCheck":           HealthCheck{},
+		"Certificate":           PublicCertificate{},
+		"Error":                 APIError{},
+		"ServerVersion":         ServerVersion{},
+		"ReloadResult":          ReloadResult{},
+	}
+	for schema, model := range models {
+		var fields []string
+		typ := reflect.TypeOf(model)
+		for i := 0; i < typ.NumField(); i++ {
+			name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+			if name != "" && name != "-" {
+				fields = append(fields, name)
+			}
+		}
+		var props []string
+		for p := range doc.Components.Schemas[schema].Properties {
+			props = append(props, p)
+		}
+		sort.Strings(fields)
+		sort.Strings(props)
+		if !reflect.DeepEqual(fields, props) {
+			t.Errorf("schema %s has properties %v, but %T has json fields %v", schema, props, model, fields)
+		}
+	}
+}
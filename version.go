@@ -0,0 +1,48 @@
+package zdap
+
+import (
+	"runtime/debug"
+	"slices"
+)
+
+// APIVersion is the version of the zdapd http api implemented by this module, its routes are served under
+// /<APIVersion>/ next to the legacy unversioned routes
+const APIVersion = "v1"
+
+// Features a zdapd server may report in its ServerVersion
+const (
+	FeaturePooling          = "pooling"
+	FeatureClaimTTL         = "claim_ttl"
+	FeatureTLS              = "tls"
+	FeatureStablePorts      = "stable_ports"
+	FeatureStructuredErrors = "structured_errors"
+	FeatureOpenAPI          = "openapi"
+)
+
+// Version is the version of zdap, it is taken from the build info unless set with
+// -ldflags "-X github.com/modfin/zdap.Version=<version>"
+var Version = "dev"
+
+func init() {
+	if Version != "dev" {
+		return
+	}
+	info, ok := debug.ReadBuildInfo()
+	if ok && info.Main.Path == "github.com/modfin/zdap" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		Version = info.Main.Version
+	}
+}
+
+type ServerVersion struct {
+	Version     string   `json:"version"`
+	APIVersions []string `json:"api_versions"`
+	Features    []string `json:"features"`
+}
+
+func (v ServerVersion) SupportsAPI(version string) bool {
+	return slices.Contains(v.APIVersions, version)
+}
+
+func (v ServerVersion) Supports(feature string) bool {
+	return slices.Contains(v.Features, feature)
+}